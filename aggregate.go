@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultPostStreamTimeout bounds the post-transforms of an assembled
+// stream, which no client waits for.
+const defaultPostStreamTimeout = 30 * time.Second
+
+// streamAggregator reassembles an OpenAI chat completion from the SSE chunks
+// of a streamed response as they are relayed to the client.
+type streamAggregator struct {
+	pending []byte
+	result  map[string]interface{}
+	content map[int]*strings.Builder
+	finish  map[int]interface{}
+	roles   map[int]interface{}
+	// done is set once the stream's data: [DONE] sentinel has been seen.
+	done bool
+}
+
+func newStreamAggregator() *streamAggregator {
+	return &streamAggregator{
+		result:  map[string]interface{}{"object": "chat.completion"},
+		content: map[int]*strings.Builder{},
+		finish:  map[int]interface{}{},
+		roles:   map[int]interface{}{},
+	}
+}
+
+// Write consumes relayed stream bytes. Events may be split across writes.
+func (a *streamAggregator) Write(p []byte) (int, error) {
+	a.pending = append(a.pending, p...)
+	for {
+		i := bytes.IndexByte(a.pending, '\n')
+		if i < 0 {
+			break
+		}
+		a.line(string(bytes.TrimRight(a.pending[:i], "\r")))
+		a.pending = a.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+func (a *streamAggregator) line(line string) {
+	data, ok := strings.CutPrefix(line, "data:")
+	if !ok {
+		return
+	}
+	data = strings.TrimSpace(data)
+	if data == "[DONE]" {
+		a.done = true
+		return
+	}
+	if data == "" {
+		return
+	}
+	var chunk map[string]interface{}
+	if err := decodeJSON([]byte(data), &chunk); err != nil {
+		return
+	}
+
+	for _, key := range []string{"id", "created", "model", "system_fingerprint", "usage"} {
+		if v, ok := chunk[key]; ok && v != nil {
+			a.result[key] = v
+		}
+	}
+	choices, _ := chunk["choices"].([]interface{})
+	for n, c := range choices {
+		choice, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		index := n
+		if i, ok := choice["index"].(json.Number); ok {
+			if v, err := i.Int64(); err == nil {
+				index = int(v)
+			}
+		}
+		if a.content[index] == nil {
+			a.content[index] = &strings.Builder{}
+		}
+		if delta, ok := choice["delta"].(map[string]interface{}); ok {
+			if text, ok := delta["content"].(string); ok {
+				a.content[index].WriteString(text)
+			}
+			if role, ok := delta["role"]; ok && role != nil {
+				a.roles[index] = role
+			}
+		}
+		if reason, ok := choice["finish_reason"]; ok && reason != nil {
+			a.finish[index] = reason
+		}
+	}
+}
+
+// completion returns the assembled non-streamed response body. Each call
+// builds a new map, so the caller may hand it on to be changed.
+func (a *streamAggregator) completion() map[string]interface{} {
+	indexes := make([]int, 0, len(a.content))
+	for i := range a.content {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	choices := make([]interface{}, 0, len(indexes))
+	for _, i := range indexes {
+		role := a.roles[i]
+		if role == nil {
+			role = "assistant"
+		}
+		choices = append(choices, map[string]interface{}{
+			"index":         i,
+			"message":       map[string]interface{}{"role": role, "content": a.content[i].String()},
+			"finish_reason": a.finish[i],
+		})
+	}
+	result := make(map[string]interface{}, len(a.result)+1)
+	for key, v := range a.result {
+		result[key] = v
+	}
+	result["choices"] = choices
+	return result
+}
+
+// collectStream reads an upstream SSE response up to its [DONE] sentinel, or
+// to the end for upstreams that send none, and returns a copy of it whose
+// body is the assembled chat.completion as JSON, so it is handled like a
+// non-streamed response from here on.
+func collectStream(upstream *http.Response) (*http.Response, error) {
+	aggregator := newStreamAggregator()
+	buf := make([]byte, 32*1024)
+	for !aggregator.done {
+		n, err := upstream.Body.Read(buf)
+		aggregator.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &UpstreamError{Status: upstream.StatusCode, Err: fmt.Errorf("failed to read stream: %w", err)}
+		}
+	}
+	// The last event may lack its closing newline.
+	if len(aggregator.pending) > 0 {
+		aggregator.line(string(bytes.TrimRight(aggregator.pending, "\r")))
+	}
+
+	body, err := json.Marshal(aggregator.completion())
+	if err != nil {
+		return nil, err
+	}
+	collected := *upstream
+	collected.Header = upstream.Header.Clone()
+	collected.Header.Set("Content-Type", "application/json")
+	collected.Header.Del("Content-Length")
+	collected.Body = io.NopCloser(bytes.NewReader(body))
+	collected.ContentLength = int64(len(body))
+	return &collected, nil
+}
+
+// postStreamTransform runs the rule's post-transforms on the assembled
+// completion once a stream has been fully relayed. The client already has
+// the stream, so the result is discarded and only failures are logged. It
+// runs detached from the client request, which may already be gone, with
+// its own postStreamTimeout deadline.
+func (l *LLMSed) postStreamTransform(ctx context.Context, rule TransformRule, completion map[string]interface{}) {
+	l.postStreams.Add(1)
+	go func() {
+		defer l.postStreams.Done()
+
+		runCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), l.postStreamTimeout)
+		defer cancel()
+		if _, err := l.runChain(runCtx, rule, "post", rule.postChain(), completion); err != nil {
+			l.logf(ctx, levelWarn, "Post-transform on assembled stream failed: %v", err)
+		}
+	}()
+}
+
+// waitPostStreams waits for the post-transforms started by
+// postStreamTransform to finish, and reports false if ctx ends first.
+func (l *LLMSed) waitPostStreams(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		l.postStreams.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamAggregatePostTransform(t *testing.T) {
+	// The upstream holds the rest of the stream until the client has seen
+	// the first chunk, proving chunks are relayed live.
+	firstSeen := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"id\":\"c1\",\"model\":\"gpt-4o\",\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":\"Hel\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		<-firstSeen
+		fmt.Fprint(w, "data: {\"id\":\"c1\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"lo\"},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: {\"id\":\"c1\",\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":2}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	var mu sync.Mutex
+	var assembled map[string]interface{}
+	post, calls := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		assembled = p
+		return map[string]interface{}{"ignored": true}
+	})
+
+	proxy := httptest.NewServer(newTestLLMSed(upstream.URL, TransformRule{Tag: "analytics", Post: post.URL, StreamAggregate: true}).Handler())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	first, _ := reader.ReadString('\n')
+	if !strings.Contains(first, `"Hel"`) {
+		t.Fatalf("first line = %q", first)
+	}
+	close(firstSeen)
+	rest, _ := io.ReadAll(reader)
+	if body := first + string(rest); !strings.Contains(body, `"lo"`) || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("client stream altered: %q", body)
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(calls) == 1 })
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := assembled[reservedParam]; !ok {
+		t.Errorf("assembled completion sent without %s", reservedParam)
+	}
+	delete(assembled, reservedParam)
+	assertJSON(t, assembled, `{
+		"id": "c1", "object": "chat.completion", "model": "gpt-4o",
+		"choices": [{"index": 0, "message": {"role": "assistant", "content": "Hello"}, "finish_reason": "stop"}],
+		"usage": {"prompt_tokens": 3, "completion_tokens": 2}
+	}`)
+}
+
+// A post-transform that never answers is cut off by postStreamTimeout, and
+// shutdown waits for it rather than dropping it.
+func TestStreamAggregatePostTransformTimeout(t *testing.T) {
+	upstream := newSSEUpstream(t, []string{
+		`{"id":"c1","choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":"stop"}]}`,
+		"[DONE]",
+	}, nil)
+	var calls, cancelled int32
+	post := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+		atomic.AddInt32(&cancelled, 1)
+	}))
+	defer post.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "analytics", Post: post.URL, StreamAggregate: true})
+	l.postStreamTimeout = 50 * time.Millisecond
+	proxy := httptest.NewServer(l.Handler())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 1 })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !l.waitPostStreams(ctx) {
+		t.Fatal("post-transform outlived its timeout")
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&cancelled) == 1 })
+}
+
+func TestStreamAggregatorHandlesSplitEvents(t *testing.T) {
+	a := newStreamAggregator()
+	stream := "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"a\"}}]}\n\ndata: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"b\"}}]}\n\n"
+	for i := 0; i < len(stream); i += 7 {
+		a.Write([]byte(stream[i:min(i+7, len(stream))]))
+	}
+	if got := a.completion()["choices"].([]interface{})[0].(map[string]interface{})["message"].(map[string]interface{})["content"]; got != "ab" {
+		t.Errorf("content = %v, want ab", got)
+	}
+}
+
+func TestStreamCollectAnswersWithOneBody(t *testing.T) {
+	// The second event is split across two writes, and the upstream holds
+	// the connection open after [DONE], as some servers do.
+	release := make(chan struct{})
+	defer close(release)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"id\":\"c1\",\"model\":\"gpt-4o\",\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":\"Hel\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		fmt.Fprint(w, "data: {\"id\":\"c1\",\"choices\":[{\"index\":0,\"delta\":{\"con")
+		w.(http.Flusher).Flush()
+		fmt.Fprint(w, "tent\":\"lo\"},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: {\"id\":\"c1\",\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":2}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+
+	post, calls := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		p["checked"] = true
+		return p
+	})
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "legacy", Post: post.URL, StreamCollect: true})
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`)))
+
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	assertJSON(t, decode(t, rec.Body.String()), `{
+		"object": "chat.completion",
+		"id": "c1",
+		"model": "gpt-4o",
+		"usage": {"prompt_tokens": 3, "completion_tokens": 2},
+		"choices": [{"index": 0, "message": {"role": "assistant", "content": "Hello"}, "finish_reason": "stop"}],
+		"checked": true
+	}`)
+	if atomic.LoadInt32(calls) != 1 {
+		t.Errorf("post transform called %d times, want 1", *calls)
+	}
+}
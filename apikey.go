@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultAPIKeyPollInterval is how often -api-key-file is re-read.
+const defaultAPIKeyPollInterval = 10 * time.Second
+
+// readAPIKey returns the key in path, without surrounding whitespace.
+func readAPIKey(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return key, nil
+}
+
+// loadAPIKey reads the -api-key-file key and sends it as the bearer token
+// of every forwarded request from then on.
+func (l *LLMSed) loadAPIKey() error {
+	key, err := readAPIKey(l.apiKeyFile)
+	if err != nil {
+		return err
+	}
+	l.apiKey.Store(&key)
+	return nil
+}
+
+// watchAPIKey re-reads the -api-key-file every interval until ctx ends, so
+// a rotated secret takes effect without a restart. While the file is
+// missing or empty, as it can briefly be mid-rotation, the last key stays
+// in use.
+func (l *LLMSed) watchAPIKey(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			key, err := readAPIKey(l.apiKeyFile)
+			if err != nil {
+				// Log once per outage rather than on every tick.
+				if !failing {
+					log.Printf("API key refresh failed, keeping current key: %v", err)
+				}
+				failing = true
+				continue
+			}
+			failing = false
+			if current := l.apiKey.Load(); current == nil || *current != key {
+				l.apiKey.Store(&key)
+				log.Printf("Reloaded API key from %s", l.apiKeyFile)
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyFileRotation(t *testing.T) {
+	auth := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "api-key")
+	if err := os.WriteFile(path, []byte("sk-old\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	l := newTestLLMSed(upstream.URL, TransformRule{})
+	l.apiKeyFile = path
+	if err := l.loadAPIKey(); err != nil {
+		t.Fatal(err)
+	}
+	go l.watchAPIKey(t.Context(), 10*time.Millisecond)
+
+	send := func() string {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer client-key")
+		l.handleProxy(httptest.NewRecorder(), req)
+		return <-auth
+	}
+	if got := send(); got != "Bearer sk-old" {
+		t.Fatalf("Authorization = %q, want the file's key", got)
+	}
+
+	// Mid-rotation the file is briefly gone; the old key stays in use.
+	os.Remove(path)
+	time.Sleep(50 * time.Millisecond)
+	if got := send(); got != "Bearer sk-old" {
+		t.Fatalf("Authorization = %q while the file is absent", got)
+	}
+
+	if err := os.WriteFile(path, []byte("sk-new"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return *l.apiKey.Load() == "sk-new" })
+	if got := send(); got != "Bearer sk-new" {
+		t.Errorf("Authorization = %q after rotation, want the new key", got)
+	}
+}
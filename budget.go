@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultTokenBudgetHeader is the -token-budget-header default: clients are
+// told apart by their API key.
+const defaultTokenBudgetHeader = "Authorization"
+
+// defaultTokenBudgetPeriod is how often -token-budget allowances are reset.
+const defaultTokenBudgetPeriod = 24 * time.Hour
+
+// errBudgetExhausted is returned for requests from a client that has used
+// its -token-budget for the current period.
+var errBudgetExhausted = errors.New("token budget exhausted for this period")
+
+// tokenBudgets tracks the tokens each client has used in the current
+// period. The zero value is ready to use.
+type tokenBudgets struct {
+	mu   sync.Mutex
+	used map[string]int64
+	// resetAt is when the current period ends, zero if it never does.
+	resetAt time.Time
+}
+
+// budgetKey returns the -token-budget-header value the request is counted
+// under. Requests without the header share one allowance.
+func (l *LLMSed) budgetKey(r *http.Request) string {
+	return r.Header.Get(l.tokenBudgetHeader)
+}
+
+// checkBudget returns errBudgetExhausted once the request's client has used
+// its -token-budget, with the seconds until the period resets to put in
+// Retry-After. A request is let through while any allowance is left, so
+// its response may take the client past the budget.
+func (l *LLMSed) checkBudget(r *http.Request) (retryAfter int, err error) {
+	if l.tokenBudget <= 0 {
+		return 0, nil
+	}
+	b := &l.budgets
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used[l.budgetKey(r)] < l.tokenBudget {
+		return 0, nil
+	}
+	if !b.resetAt.IsZero() {
+		retryAfter = int(math.Ceil(time.Until(b.resetAt).Seconds()))
+	}
+	return max(retryAfter, 0), errBudgetExhausted
+}
+
+// chargeBudget counts the tokens a response body's usage reports against
+// the request's client.
+func (l *LLMSed) chargeBudget(r *http.Request, payload map[string]interface{}) {
+	if l.tokenBudget <= 0 {
+		return
+	}
+	tokens := usageTokens(payload)
+	if tokens == 0 {
+		return
+	}
+	b := &l.budgets
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used == nil {
+		b.used = map[string]int64{}
+	}
+	b.used[l.budgetKey(r)] += tokens
+}
+
+// reset gives every client its full allowance again, until next.
+func (b *tokenBudgets) reset(next time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used = nil
+	b.resetAt = next
+}
+
+// runBudgetReset resets the token budgets every period until ctx ends.
+func (l *LLMSed) runBudgetReset(ctx context.Context, period time.Duration) {
+	l.budgets.reset(time.Now().Add(period))
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.budgets.reset(now.Add(period))
+			log.Printf("Reset token budgets")
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBudgetExhaustedAndReset(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"usage":{"prompt_tokens":4,"completion_tokens":2}}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{})
+	l.tokenBudget = 10
+	l.tokenBudgetHeader = "X-Tenant"
+	send := func(tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`))
+		req.Header.Set("X-Tenant", tenant)
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, req)
+		return rec
+	}
+
+	l.budgets.reset(time.Now().Add(time.Minute))
+
+	// 6 tokens then 12: the second request is let through with 4 left.
+	for i := 1; i <= 2; i++ {
+		if rec := send("acme"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within budget: got %d %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	rec := send("acme")
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "token budget exhausted") {
+		t.Fatalf("exhausted budget: got %d %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+	if rec := send("globex"); rec.Code != http.StatusOK {
+		t.Errorf("other tenant refused: %d", rec.Code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.runBudgetReset(ctx, 20*time.Millisecond)
+	waitFor(t, func() bool { return send("acme").Code == http.StatusOK })
+}
+
+func TestTokenBudgetCountsStreamedUsage(t *testing.T) {
+	upstream := newSSEUpstream(t, []string{
+		`{"choices":[{"index":0,"delta":{"content":"Hi"}}]}`,
+		`{"choices":[],"usage":{"prompt_tokens":8,"completion_tokens":3}}`,
+		"[DONE]",
+	}, nil)
+	l := newTestLLMSed(upstream.URL, TransformRule{})
+	l.tokenBudget = 10
+	proxy := httptest.NewServer(l.Handler())
+	defer proxy.Close()
+
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"stream":true}`))
+		req.Header.Set("Authorization", "Bearer key-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("got %d, want %d", resp.StatusCode, want)
+		}
+	}
+}
+
+// The assembled completion is handed to the post-transforms, which run after
+// the response; charging the budget must not touch it. Run with -race.
+func TestTokenBudgetWithStreamAggregate(t *testing.T) {
+	upstream := newSSEUpstream(t, []string{
+		`{"choices":[{"index":0,"delta":{"content":"Hi"}}]}`,
+		`{"choices":[],"usage":{"prompt_tokens":8,"completion_tokens":3}}`,
+		"[DONE]",
+	}, nil)
+	post, calls := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		return p
+	})
+	l := newTestLLMSed(upstream.URL, TransformRule{Post: post.URL, StreamAggregate: true})
+	l.tokenBudget = 100
+	proxy := httptest.NewServer(l.Handler())
+	defer proxy.Close()
+
+	for i := 0; i < 5; i++ {
+		resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"stream":true}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(calls) == 5 })
+	l.budgets.mu.Lock()
+	defer l.budgets.mu.Unlock()
+	if got := l.budgets.used[""]; got != 55 {
+		t.Errorf("charged %d tokens, want 55", got)
+	}
+}
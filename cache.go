@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultCacheMaxEntries is the default for -cache-max-entries.
+const defaultCacheMaxEntries = 1000
+
+// cachedResponse is a complete response as written to the client.
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// responseCache holds responses for rules with a CacheTTL. Expired entries
+// are dropped when they are looked up or when a new entry is stored. When
+// it holds maxEntries, a new entry replaces the one closest to expiring;
+// zero leaves it unbounded.
+type responseCache struct {
+	mu         sync.Mutex
+	entries    map[string]cachedResponse
+	maxEntries int
+}
+
+func (c *responseCache) get(key string) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return cachedResponse{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return cachedResponse{}, false
+	}
+	return entry, true
+}
+
+// store caches a 2xx response for ttl. Other responses are not cached.
+func (c *responseCache) store(key string, status int, header http.Header, body []byte, ttl time.Duration) {
+	if status < 200 || status > 299 {
+		return
+	}
+	header = header.Clone()
+	header.Del("X-Cache")
+	header.Del(headerRule)
+	header.Del(headerCorrelationID)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]cachedResponse)
+	}
+	if _, ok := c.entries[key]; !ok && c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		var oldest string
+		for k, entry := range c.entries {
+			if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = cachedResponse{status: status, header: header, body: body, expires: now.Add(ttl)}
+}
+
+// cacheKey reports whether the request may be answered from the cache and
+// the key it is cached under: only GETs matched by a rule with a CacheTTL.
+// The key includes a hash of the client's credential headers, since what
+// an upstream answers may depend on the key, and one client must never be
+// served a response fetched with another's.
+func (l *LLMSed) cacheKey(r *http.Request, rule TransformRule) (string, bool) {
+	if r.Method != http.MethodGet || rule.CacheTTL <= 0 {
+		return "", false
+	}
+	h := sha256.New()
+	for _, name := range credentialHeaders {
+		for _, value := range r.Header.Values(name) {
+			fmt.Fprintf(h, "%s: %s\n", name, value)
+		}
+	}
+	return r.Method + " " + r.URL.RequestURI() + " " + rule.Tag + " " + hex.EncodeToString(h.Sum(nil)), true
+}
+
+// serveCached writes the cached response for key, if any, and reports
+// whether it did.
+func (l *LLMSed) serveCached(w http.ResponseWriter, key string) bool {
+	entry, ok := l.cache.get(key)
+	if !ok {
+		return false
+	}
+	copyHeader(w.Header(), entry.header, l.singletonHeaders)
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+	return true
+}
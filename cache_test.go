@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheServesGETWithinTTL(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Upstream", "yes")
+		fmt.Fprintf(w, `{"object":"list","call":%d}`, n)
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "models", CacheTTL: Duration(100 * time.Millisecond)})
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+		return rec
+	}
+
+	first := get()
+	if first.Code != http.StatusOK || first.Header().Get("X-Cache") != "MISS" || first.Body.String() != `{"call":1,"object":"list"}` {
+		t.Fatalf("first: code %d X-Cache %q body %s", first.Code, first.Header().Get("X-Cache"), first.Body.String())
+	}
+
+	second := get()
+	if second.Header().Get("X-Cache") != "HIT" || second.Body.String() != first.Body.String() || second.Header().Get("X-Upstream") != "yes" {
+		t.Errorf("second: X-Cache %q body %s headers %v", second.Header().Get("X-Cache"), second.Body.String(), second.Header())
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("upstream called %d times within the TTL, want 1", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	third := get()
+	if third.Header().Get("X-Cache") != "MISS" || third.Body.String() != `{"call":2,"object":"list"}` {
+		t.Errorf("after expiry: X-Cache %q body %s", third.Header().Get("X-Cache"), third.Body.String())
+	}
+}
+
+func TestCacheSkipsNonGETAndErrors(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "models", CacheTTL: Duration(time.Minute)})
+	for i := 0; i < 2; i++ {
+		l.handleProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/models", nil))
+		l.handleProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Errorf("upstream called %d times, want every POST and error response uncached", n)
+	}
+}
+
+func TestCacheKeysOnCredentials(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		fmt.Fprintf(w, `{"call":%d}`, n)
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "models", CacheTTL: Duration(time.Minute)})
+	get := func(auth string) string {
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, req)
+		return rec.Body.String()
+	}
+
+	alice := get("Bearer sk-alice")
+	if bob := get("Bearer sk-bob"); bob == alice {
+		t.Errorf("a client with another key got %s from the cache", bob)
+	}
+	if again := get("Bearer sk-alice"); again != alice {
+		t.Errorf("same key: got %s, want the cached %s", again, alice)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("upstream called %d times, want 2", n)
+	}
+}
+
+func TestCacheEvictsAtMaxEntries(t *testing.T) {
+	c := responseCache{maxEntries: 2}
+	c.store("a", http.StatusOK, http.Header{}, []byte("a"), time.Minute)
+	c.store("b", http.StatusOK, http.Header{}, []byte("b"), 2*time.Minute)
+	c.store("a", http.StatusOK, http.Header{}, []byte("a2"), time.Minute)
+	if _, ok := c.get("b"); !ok {
+		t.Fatal("replacing an entry evicted another")
+	}
+	c.store("c", http.StatusOK, http.Header{}, []byte("c"), 3*time.Minute)
+	if len(c.entries) != 2 {
+		t.Errorf("%d entries, want 2", len(c.entries))
+	}
+	if _, ok := c.get("a"); ok {
+		t.Error("the entry closest to expiring was kept")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("entry %s was evicted", key)
+		}
+	}
+}
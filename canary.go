@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Upstream targets, the "target" label of llsed_upstream_requests_total.
+const (
+	targetPrimary = "primary"
+	targetCanary  = "canary"
+)
+
+// CanaryConfig sends a share of a rule's requests to a canary backend
+// instead of the upstream.
+type CanaryConfig struct {
+	// URL is the canary's base URL; the request path is appended to it.
+	URL string `json:"url"`
+
+	// Percent of the rule's requests, from 0 to 100, that go to the canary.
+	// Each request is picked at random.
+	Percent float64 `json:"percent"`
+}
+
+func (c CanaryConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("canary url must be an http(s) URL, got %q", c.URL)
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("canary percent must be between 0 and 100, got %v", c.Percent)
+	}
+	return nil
+}
+
+// upstreamBase picks the base URL r is forwarded to under rule: the
+// rule's canary for its share of requests, the upstream otherwise.
+func (l *LLMSed) upstreamBase(r *http.Request, rule TransformRule) string {
+	base, target := l.serverURL, targetPrimary
+	if rule.Canary != nil && rand.Float64()*100 < rule.Canary.Percent {
+		base, target = strings.TrimSuffix(rule.Canary.URL, "/"), targetCanary
+		l.logf(r.Context(), levelDebug, "Rule %s sending request to canary %s", rule.Tag, base)
+	}
+	l.metrics.upstreamRequests.WithLabelValues(rule.Tag, target).Inc()
+	return base
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCanaryGetsConfiguredShare(t *testing.T) {
+	var primary, canary int32
+	count := func(n *int32) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(n, 1)
+			w.Write([]byte(`{}`))
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	upstream, canaryServer := count(&primary), count(&canary)
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "chat", Canary: &CanaryConfig{URL: canaryServer.URL, Percent: 20}})
+	const requests = 1000
+	for i := 0; i < requests; i++ {
+		l.handleProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	}
+
+	// 200 expected; the bounds are more than five standard deviations out.
+	if canary < 130 || canary > 270 || primary+canary != requests {
+		t.Errorf("%d requests to the canary and %d to the primary, want about 20%% canary", canary, primary)
+	}
+	if got := testutil.ToFloat64(l.metrics.upstreamRequests.WithLabelValues("chat", targetCanary)); got != float64(canary) {
+		t.Errorf("canary metric = %v, want %d", got, canary)
+	}
+	if got := testutil.ToFloat64(l.metrics.upstreamRequests.WithLabelValues("chat", targetPrimary)); got != float64(primary) {
+		t.Errorf("primary metric = %v, want %d", got, primary)
+	}
+}
+
+func TestCanaryValidation(t *testing.T) {
+	for _, c := range []CanaryConfig{{URL: "http://canary", Percent: 101}, {URL: "http://canary", Percent: -1}, {URL: "canary", Percent: 5}} {
+		if err := (Config{Rules: []TransformRule{{Canary: &c}}}).validate(); err == nil {
+			t.Errorf("%+v: expected validation error", c)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for -capture-max-bytes and -capture-body-bytes.
+const (
+	defaultCaptureMaxBytes  = 100 << 20
+	defaultCaptureBodyBytes = 64 << 10
+)
+
+// defaultCaptureRedact lists the body fields masked in captures unless
+// -capture-redact says otherwise.
+const defaultCaptureRedact = "api_key,authorization,password"
+
+// capture appends one JSON line per proxied request to a file, rotating it
+// to path.1 when it would grow past maxBytes.
+type capture struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+
+	// bodyBytes caps each captured body; larger ones are replaced by their
+	// size.
+	bodyBytes int
+	// redact holds lowercased field names whose values are masked wherever
+	// they appear in a body.
+	redact map[string]bool
+}
+
+func openCapture(path string, maxBytes int64, bodyBytes int, redact []string) (*capture, error) {
+	c := &capture{path: path, maxBytes: maxBytes, bodyBytes: bodyBytes, redact: make(map[string]bool)}
+	for _, name := range redact {
+		if name = strings.TrimSpace(name); name != "" {
+			c.redact[strings.ToLower(name)] = true
+		}
+	}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *capture) open() error {
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.file, c.size = f, info.Size()
+	return nil
+}
+
+func (c *capture) rotate() error {
+	c.file.Close()
+	if err := os.Rename(c.path, c.path+".1"); err != nil {
+		return err
+	}
+	return c.open()
+}
+
+// write appends v as a JSON line.
+func (c *capture) write(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.maxBytes > 0 && c.size > 0 && c.size+int64(len(line)) > c.maxBytes {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := c.file.Write(line)
+	c.size += int64(n)
+	return err
+}
+
+func (c *capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.file.Close()
+}
+
+// body prepares a request, transform or response body for a capture line:
+// JSON is redacted, anything else is kept as a string, and bodies over the
+// size limit are replaced by their size.
+func (c *capture) body(data []byte) json.RawMessage {
+	if len(data) == 0 {
+		return nil
+	}
+	var v interface{}
+	if decodeJSON(data, &v) == nil {
+		data, _ = json.Marshal(c.redactValue(v))
+	} else {
+		data, _ = json.Marshal(string(data))
+	}
+	if c.bodyBytes > 0 && len(data) > c.bodyBytes {
+		data, _ = json.Marshal(map[string]int{"truncated_bytes": len(data)})
+	}
+	return data
+}
+
+func (c *capture) redactValue(v interface{}) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for k, child := range node {
+			if c.redact[strings.ToLower(k)] {
+				node[k] = "[REDACTED]"
+			} else {
+				node[k] = c.redactValue(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range node {
+			node[i] = c.redactValue(child)
+		}
+	}
+	return v
+}
+
+// captureStep is a transform step as written to a capture line.
+type captureStep struct {
+	Stage     string          `json:"stage"`
+	Transform string          `json:"transform"`
+	Output    json.RawMessage `json:"output,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+type captureRecord struct {
+	Time       string          `json:"time"`
+	Rule       string          `json:"rule,omitempty"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Status     int             `json:"status"`
+	DurationMS float64         `json:"duration_ms"`
+	Request    json.RawMessage `json:"request,omitempty"`
+	Transforms []captureStep   `json:"transforms"`
+	Response   json.RawMessage `json:"response,omitempty"`
+}
+
+// captureWriter records the status and body written to the client. It
+// buffers at most limit bytes of the body, so long streams only count.
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	limit  int
+	total  int
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.total += len(p)
+	if w.limit <= 0 || w.total <= w.limit {
+		w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to extend
+// the write deadline of a stream.
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// captured writes a capture line for every request handled by next when a
+// capture file is configured.
+func (l *LLMSed) captured(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.capture == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, ok := l.readBody(w, r)
+		if !ok {
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		t := &requestTrace{keepOutput: true}
+		cw := &captureWriter{ResponseWriter: w, limit: l.capture.bodyBytes}
+		start := time.Now()
+		next.ServeHTTP(cw, r.WithContext(withTrace(r.Context(), t)))
+
+		record := captureRecord{
+			Time:       start.UTC().Format(time.RFC3339Nano),
+			Rule:       t.Rule(),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     cw.status,
+			DurationMS: milliseconds(time.Since(start)),
+			Request:    l.capture.body(body),
+			Transforms: []captureStep{},
+		}
+		if cw.limit > 0 && cw.total > cw.limit {
+			record.Response, _ = json.Marshal(map[string]int{"truncated_bytes": cw.total})
+		} else {
+			record.Response = l.capture.body(cw.body.Bytes())
+		}
+		for _, step := range t.Steps() {
+			record.Transforms = append(record.Transforms, captureStep{
+				Stage:     step.Stage,
+				Transform: step.Transform,
+				Output:    l.capture.body(step.Output),
+				Error:     step.Error,
+			})
+		}
+		if err := l.capture.write(record); err != nil {
+			log.Printf("Writing capture failed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readCapture(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("capture line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestCaptureWritesStages(t *testing.T) {
+	post, _ := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		p["post"] = true
+		return p
+	})
+	l := newTestLLMSed(newEchoUpstream(t).URL, TransformRule{
+		Tag:    "captured",
+		Type:   transformSystemPrompt,
+		Params: map[string]interface{}{"prompt": "Be brief."},
+		Post:   post.URL,
+	})
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	c, err := openCapture(path, defaultCaptureMaxBytes, defaultCaptureBodyBytes, strings.Split(defaultCaptureRedact, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	l.capture = c
+
+	rec := httptest.NewRecorder()
+	l.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"hi"}],"api_key":"sk-live"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code %d: %s", rec.Code, rec.Body.String())
+	}
+
+	records := readCapture(t, path)
+	if len(records) != 1 {
+		t.Fatalf("%d capture lines, want 1", len(records))
+	}
+	record := records[0]
+	if record["rule"] != "captured" || record["status"] != float64(200) || record["path"] != "/v1/chat/completions" {
+		t.Errorf("record header fields = %v", record)
+	}
+	assertJSON(t, record["request"], `{"messages":[{"role":"user","content":"hi"}],"api_key":"[REDACTED]"}`)
+	assertJSON(t, record["transforms"], `[
+		{"stage":"pre","transform":"system-prompt","output":{"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"hi"}],"api_key":"[REDACTED]"}},
+		{"stage":"post","transform":"`+post.URL+`","output":{"ok":true,"post":true}}
+	]`)
+	assertJSON(t, record["response"], `{"ok":true,"post":true}`)
+}
+
+func TestCaptureRotatesAndLimitsBodies(t *testing.T) {
+	l := newTestLLMSed(newEchoUpstream(t).URL, TransformRule{Tag: "passthrough"})
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	c, err := openCapture(path, 200, 32, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	l.capture = c
+
+	for i := 0; i < 2; i++ {
+		l.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+			strings.NewReader(`{"prompt":"`+strings.Repeat("x", 100)+`"}`)))
+	}
+
+	rotated := readCapture(t, path+".1")
+	current := readCapture(t, path)
+	if len(rotated) != 1 || len(current) != 1 {
+		t.Fatalf("got %d rotated and %d current lines, want 1 each", len(rotated), len(current))
+	}
+	assertJSON(t, current[0]["request"], `{"truncated_bytes":113}`)
+}
+
+// The capture reads the body before the proxy does, under the same limit.
+func TestCaptureHonoursMaxBodyBytes(t *testing.T) {
+	l := newTestLLMSed(newEchoUpstream(t).URL, TransformRule{Tag: "passthrough"})
+	l.maxBodyBytes = 16
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	c, err := openCapture(path, defaultCaptureMaxBytes, defaultCaptureBodyBytes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	l.capture = c
+
+	rec := httptest.NewRecorder()
+	l.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"prompt":"`+strings.Repeat("x", 1000)+`"}`)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("code = %d, want 413", rec.Code)
+	}
+	if data, _ := os.ReadFile(path); len(data) != 0 {
+		t.Errorf("oversized request was captured: %s", data)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// defaultRecordMaxBytes is the default for -record-max-bytes.
+const defaultRecordMaxBytes = 10 << 20
+
+// cassette is a request and the response the client got for it, stored in
+// -record-dir and served again from -replay-dir.
+type cassette struct {
+	Method  string      `json:"method"`
+	URI     string      `json:"uri"`
+	Request string      `json:"request"`
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Body    string      `json:"body"`
+	// Base64 is set when Body is base64 because the response was not
+	// UTF-8, e.g. when it was gzipped.
+	Base64 bool `json:"base64,omitempty"`
+}
+
+// cassetteName returns the file a request is recorded in: a hash of its
+// method, path, query and body.
+func cassetteName(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)) + ".json"
+}
+
+// cassettes records each request and its response to -record-dir, and
+// answers requests found in -replay-dir from there without running next,
+// so neither the transforms nor the upstream are contacted. A request
+// missing from -replay-dir is proxied and recorded when -record-dir is set
+// too, and answered with a 404 otherwise. Request bodies are read under
+// -max-body-bytes, and responses over -record-max-bytes are not recorded.
+func (l *LLMSed) cassettes(next http.Handler) http.Handler {
+	if l.recordDir == "" && l.replayDir == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := l.readBody(w, r)
+		if !ok {
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		name := cassetteName(r, body)
+
+		if l.replayDir != "" {
+			c, err := readCassette(filepath.Join(l.replayDir, name))
+			if err == nil {
+				l.logf(r.Context(), levelDebug, "Replaying %s %s from %s", r.Method, r.URL.Path, name)
+				c.play(w, l.singletonHeaders)
+				return
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Reading cassette %s failed: %v", name, err)
+			}
+			if l.recordDir == "" {
+				writeJSON(w, http.StatusNotFound, map[string]interface{}{
+					"error": map[string]interface{}{
+						"message": fmt.Sprintf("no recorded response for %s %s in %s", r.Method, r.URL.RequestURI(), l.replayDir),
+						"type":    "llsed_error",
+					},
+				})
+				return
+			}
+		}
+
+		cw := &captureWriter{ResponseWriter: w, limit: l.recordMaxBytes}
+		next.ServeHTTP(cw, r)
+		if cw.limit > 0 && cw.total > cw.limit {
+			log.Printf("Not recording cassette %s: %d-byte response exceeds -record-max-bytes", name, cw.total)
+			return
+		}
+		c := cassette{
+			Method:  r.Method,
+			URI:     r.URL.RequestURI(),
+			Request: string(body),
+			Status:  cw.status,
+			Header:  w.Header().Clone(),
+		}
+		if c.Status == 0 {
+			c.Status = http.StatusOK
+		}
+		if data := cw.body.Bytes(); utf8.Valid(data) {
+			c.Body = string(data)
+		} else {
+			c.Body, c.Base64 = base64.StdEncoding.EncodeToString(data), true
+		}
+		if err := writeCassette(filepath.Join(l.recordDir, name), c); err != nil {
+			log.Printf("Recording cassette %s failed: %v", name, err)
+		}
+	})
+}
+
+func readCassette(path string) (cassette, error) {
+	var c cassette
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// writeCassette writes c to path through a temporary file, so a replay
+// never reads a half-written cassette.
+func writeCassette(path string, c cassette) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// play writes the recorded response to w, with the singletons headers sent
+// once.
+func (c cassette) play(w http.ResponseWriter, singletons []string) {
+	body := []byte(c.Body)
+	if c.Base64 {
+		decoded, err := base64.StdEncoding.DecodeString(c.Body)
+		if err != nil {
+			http.Error(w, "corrupt recorded response", http.StatusInternalServerError)
+			return
+		}
+		body = decoded
+	}
+	copyHeader(w.Header(), c.Header, singletons)
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-LLMSed-Replayed", "true")
+	w.WriteHeader(c.Status)
+	w.Write(body)
+}
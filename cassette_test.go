@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRecordThenReplayWithoutUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Upstream", "recorded")
+		w.Write([]byte(`{"choices":[{"message":{"content":"hi"}}]}`))
+	}))
+	dir := t.TempDir()
+	const body = `{"model":"gpt-4","messages":[{"role":"user","content":"hello"}]}`
+
+	recorder := newTestLLMSed(upstream.URL, TransformRule{Tag: "chat"})
+	recorder.recordDir = dir
+	rec := httptest.NewRecorder()
+	recorder.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("recording: status %d: %s", rec.Code, rec.Body)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("recorded %d files, want 1", len(files))
+	}
+	upstream.Close()
+
+	replayer := newTestLLMSed(upstream.URL, TransformRule{Tag: "chat"})
+	replayer.replayDir = dir
+	h := replayer.Handler()
+	replay := httptest.NewRecorder()
+	h.ServeHTTP(replay, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+	if replay.Code != http.StatusOK || replay.Body.String() != rec.Body.String() {
+		t.Errorf("replay = %d %q, want %q", replay.Code, replay.Body, rec.Body)
+	}
+	if replay.Header().Get("X-Upstream") != "recorded" || replay.Header().Get("X-LLMSed-Replayed") != "true" {
+		t.Errorf("replay headers = %v", replay.Header())
+	}
+
+	// A different body is a different request, and there is no recording.
+	miss := httptest.NewRecorder()
+	h.ServeHTTP(miss, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4"}`)))
+	if miss.Code != http.StatusNotFound || !strings.Contains(miss.Body.String(), "no recorded response") {
+		t.Errorf("unrecorded request = %d %q, want a 404", miss.Code, miss.Body)
+	}
+}
+
+func TestRecordSkipsOversizedResponses(t *testing.T) {
+	dir := t.TempDir()
+	l := newTestLLMSed(newEchoUpstream(t).URL, TransformRule{Tag: "chat"})
+	l.recordDir = dir
+	l.recordMaxBytes = 4
+	rec := httptest.NewRecorder()
+	l.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"ok":true}` {
+		t.Fatalf("response = %d %q", rec.Code, rec.Body)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("recorded %d files for an oversized response, want none", len(files))
+	}
+
+	l.recordMaxBytes = defaultRecordMaxBytes
+	l.maxBodyBytes = 16
+	rec = httptest.NewRecorder()
+	l.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"prompt":"`+strings.Repeat("x", 1000)+`"}`)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized request = %d, want 413", rec.Code)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("recorded %d files for an oversized request, want none", len(files))
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+)
+
+// celEnv declares what "cel" expressions can use: the parsed body as body,
+// and map.with(key, value), which returns a copy of the map with key set.
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	jsonObject := cel.MapType(cel.StringType, cel.DynType)
+	return cel.NewEnv(
+		cel.Variable("body", jsonObject),
+		cel.Function("with",
+			cel.MemberOverload("map_with_string_dyn",
+				[]*cel.Type{jsonObject, cel.StringType, cel.DynType}, jsonObject,
+				cel.FunctionBinding(celWith),
+			),
+		),
+	)
+})
+
+// celPrograms caches compiled programs by expression, so each expression is
+// compiled once, when the config is loaded.
+var celPrograms sync.Map
+
+// celProgram returns the compiled program for a "cel" transform's params.
+func celProgram(typ string, params map[string]interface{}) (cel.Program, error) {
+	expr, ok := params["expression"].(string)
+	if !ok || expr == "" {
+		return nil, fmt.Errorf("%s: params.expression must be a non-empty string", typ)
+	}
+	if prg, ok := celPrograms.Load(expr); ok {
+		return prg.(cel.Program), nil
+	}
+
+	env, err := celEnv()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", typ, err)
+	}
+	ast, issues := env.Compile(expr)
+	if issues.Err() != nil {
+		return nil, fmt.Errorf("%s: invalid expression: %w", typ, issues.Err())
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", typ, err)
+	}
+	celPrograms.Store(expr, prg)
+	return prg, nil
+}
+
+// celTransform replaces the body with the result of a CEL expression, for
+// "cel" on the request and "cel-response" on the response.
+//
+// Params:
+//   - expression: a CEL expression over body (required). It must evaluate to
+//     a map, which becomes the new body. To change one field, use
+//     body.with("model", "gpt-4o").
+func celTransform(typ string, params map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, error) {
+	prg, err := celProgram(typ, params)
+	if err != nil {
+		return nil, err
+	}
+	out, _, err := prg.Eval(map[string]interface{}{"body": celInput(payload)})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", typ, err)
+	}
+	result, err := celOutput(out)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", typ, err)
+	}
+	body, ok := result.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: expression must evaluate to a map, got %s", typ, out.Type())
+	}
+	return body, nil
+}
+
+// celWith implements map.with(key, value).
+func celWith(args ...ref.Val) ref.Val {
+	m, ok := args[0].(traits.Mapper)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(args[0])
+	}
+	entries := map[ref.Val]ref.Val{}
+	for it := m.Iterator(); it.HasNext() == types.True; {
+		key := it.Next()
+		entries[key] = m.Get(key)
+	}
+	entries[args[1]] = args[2]
+	return types.NewRefValMap(types.DefaultTypeAdapter, entries)
+}
+
+// celInput converts the json.Number values of a decoded body into int64 or
+// float64, which CEL understands.
+func celInput(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = celInput(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = celInput(e)
+		}
+		return out
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+// celOutput converts a CEL value back into JSON-encodable Go values.
+func celOutput(v ref.Val) (interface{}, error) {
+	switch v := v.(type) {
+	case types.Null:
+		return nil, nil
+	case types.Bool:
+		return bool(v), nil
+	case types.Int:
+		return int64(v), nil
+	case types.Uint:
+		return uint64(v), nil
+	case types.Double:
+		return float64(v), nil
+	case types.String:
+		return string(v), nil
+	case traits.Mapper:
+		out := map[string]interface{}{}
+		for it := v.Iterator(); it.HasNext() == types.True; {
+			key := it.Next()
+			name, ok := key.(types.String)
+			if !ok {
+				return nil, fmt.Errorf("map key %v is not a string", key)
+			}
+			value, err := celOutput(v.Get(key))
+			if err != nil {
+				return nil, err
+			}
+			out[string(name)] = value
+		}
+		return out, nil
+	case traits.Lister:
+		var out []interface{}
+		for it := v.Iterator(); it.HasNext() == types.True; {
+			value, err := celOutput(it.Next())
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, value)
+		}
+		if out == nil {
+			out = []interface{}{}
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported value of type %s", v.Type())
+	}
+}
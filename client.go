@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Duration is a time.Duration written in config as a string such as "30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\", got %s", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ClientConfig overrides HTTP client settings for one rule's upstream and
+// transform calls.
+type ClientConfig struct {
+	Timeout            Duration `json:"timeout"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify"`
+	Proxy              string   `json:"proxy"`
+}
+
+func (c ClientConfig) validate() error {
+	if c.Proxy != "" {
+		if _, err := url.Parse(c.Proxy); err != nil {
+			return fmt.Errorf("invalid client proxy: %w", err)
+		}
+	}
+	return nil
+}
+
+// transportOptions are the process-wide settings shared by every upstream
+// and transform transport.
+type transportOptions struct {
+	// egressProxy, when set, overrides HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+	egressProxy *url.URL
+
+	// disableHTTP2 restricts connections to HTTP/1.1.
+	disableHTTP2 bool
+}
+
+// newTransport returns a transport for upstream and transform traffic. It
+// sends requests through the egress proxy when set, and otherwise through
+// the proxy named by HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func newTransport(opts transportOptions) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if opts.egressProxy != nil {
+		transport.Proxy = http.ProxyURL(opts.egressProxy)
+	}
+	if opts.disableHTTP2 {
+		// A non-nil, empty TLSNextProto stops the transport from
+		// negotiating h2 via ALPN.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+// parseEgressProxy parses an -egress-proxy URL. HTTP, HTTPS and SOCKS5
+// proxies are supported.
+func parseEgressProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", raw)
+	}
+	return u, nil
+}
+
+// setTransportOptions rebuilds the shared client and drops cached per-rule
+// clients so that all upstream and transform traffic uses opts.
+func (l *LLMSed) setTransportOptions(opts transportOptions) {
+	l.httpClient = &http.Client{Transport: newTransport(opts)}
+	l.clients.mu.Lock()
+	defer l.clients.mu.Unlock()
+	l.clients.opts = opts
+	l.clients.clients = nil
+}
+
+// clientCache builds one http.Client per distinct ClientConfig and reuses
+// it, so per-rule clients keep their connection pools across requests.
+type clientCache struct {
+	mu      sync.Mutex
+	clients map[ClientConfig]*http.Client
+	opts    transportOptions
+}
+
+func (c *clientCache) get(cfg ClientConfig) (*http.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if client, ok := c.clients[cfg]; ok {
+		return client, nil
+	}
+
+	transport := newTransport(c.opts)
+	if cfg.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	client := &http.Client{Transport: transport, Timeout: time.Duration(cfg.Timeout)}
+
+	if c.clients == nil {
+		c.clients = make(map[ClientConfig]*http.Client)
+	}
+	c.clients[cfg] = client
+	return client, nil
+}
+
+// clientFor returns the HTTP client for a rule: its own client when the rule
+// has a client block, the shared client otherwise.
+func (l *LLMSed) clientFor(rule TransformRule) (*http.Client, error) {
+	if rule.Client == nil {
+		return l.httpClient, nil
+	}
+	return l.clients.get(*rule.Client)
+}
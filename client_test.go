@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRulesUseTheirOwnClientTimeouts(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL,
+		TransformRule{Tag: "impatient", Client: &ClientConfig{Timeout: Duration(20 * time.Millisecond)}},
+		TransformRule{Tag: "patient", Client: &ClientConfig{Timeout: Duration(2 * time.Second)}},
+	)
+	l.ruleOverrideParam = "rule"
+
+	for tag, want := range map[string]int{"impatient": http.StatusBadGateway, "patient": http.StatusOK} {
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions?rule="+tag, strings.NewReader(`{}`)))
+		if rec.Code != want {
+			t.Errorf("%s: code = %d, want %d", tag, rec.Code, want)
+		}
+	}
+}
+
+func TestClientCacheReusesClients(t *testing.T) {
+	var cache clientCache
+	a, _ := cache.get(ClientConfig{Timeout: Duration(time.Second)})
+	b, _ := cache.get(ClientConfig{Timeout: Duration(time.Second)})
+	c, _ := cache.get(ClientConfig{Timeout: Duration(2 * time.Second)})
+	if a != b {
+		t.Error("same config built two clients")
+	}
+	if a == c {
+		t.Error("different configs share a client")
+	}
+}
+
+func TestClientConfigUnmarshal(t *testing.T) {
+	var rule TransformRule
+	err := json.Unmarshal([]byte(`{"tag":"x","client":{"timeout":"1m30s","insecure_skip_verify":true,"proxy":"http://proxy:3128"}}`), &rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ClientConfig{Timeout: Duration(90 * time.Second), InsecureSkipVerify: true, Proxy: "http://proxy:3128"}
+	if *rule.Client != want {
+		t.Errorf("client = %+v, want %+v", *rule.Client, want)
+	}
+
+	if err := json.Unmarshal([]byte(`{"client":{"timeout":30}}`), &rule); err == nil {
+		t.Error("expected error for numeric timeout")
+	}
+}
+
+func TestEgressProxyCarriesForwardedTraffic(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy sees the absolute upstream URL.
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte(`{"via":"proxy"}`))
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := parseEgressProxy(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The upstream host does not resolve; only the proxy can answer.
+	l := newTestLLMSed("http://upstream.invalid",
+		TransformRule{Tag: "shared"},
+		TransformRule{Tag: "own-client", Client: &ClientConfig{Timeout: Duration(time.Second)}},
+	)
+	l.ruleOverrideParam = "rule"
+	l.setTransportOptions(transportOptions{egressProxy: proxyURL})
+
+	for _, tag := range []string{"shared", "own-client"} {
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions?rule="+tag, strings.NewReader(`{}`)))
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"via":"proxy"}` {
+			t.Errorf("%s: code %d body %s", tag, rec.Code, rec.Body.String())
+		}
+	}
+	if len(proxied) != 2 || proxied[0] != "http://upstream.invalid/v1/chat/completions" {
+		t.Errorf("proxied requests = %q", proxied)
+	}
+}
+
+func TestParseEgressProxy(t *testing.T) {
+	for _, raw := range []string{"http://proxy:3128", "socks5://127.0.0.1:1080", "socks5h://proxy:1080"} {
+		if _, err := parseEgressProxy(raw); err != nil {
+			t.Errorf("%s: %v", raw, err)
+		}
+	}
+	for _, raw := range []string{"ftp://proxy", "proxy:3128", "http://"} {
+		if _, err := parseEgressProxy(raw); err == nil {
+			t.Errorf("%s: expected error", raw)
+		}
+	}
+}
+
+func TestDisableHTTP2NegotiatesHTTP11(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	for _, tt := range []struct {
+		disable bool
+		want    string
+	}{{false, "HTTP/2.0"}, {true, "HTTP/1.1"}} {
+		transport := newTransport(transportOptions{disableHTTP2: tt.disable})
+		transport.TLSClientConfig = &tls.Config{RootCAs: upstream.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+
+		resp, err := (&http.Client{Transport: transport}).Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Proto != tt.want || string(body) != tt.want {
+			t.Errorf("disableHTTP2=%v: negotiated %s (server saw %s), want %s", tt.disable, resp.Proto, body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parsePrefixes parses a comma-separated list of CIDRs or bare IPs.
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", entry, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q: %w", entry, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns the IP of the direct peer of r.
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr.Unmap(), err == nil
+}
+
+// Debug headers sent to -debug-clients: the tag of the rule that handled
+// the request, and its correlation ID in headerCorrelationID.
+const headerRule = "X-LLMSed-Rule"
+
+// debugClient reports whether r comes from a -debug-clients address, which
+// gets full error messages and debug headers. The address is the one
+// clientIP resolves, so clients behind -trusted-proxies are matched too.
+func (l *LLMSed) debugClient(r *http.Request) bool {
+	if len(l.debugClients) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(l.clientIP(r))
+	return err == nil && containsAddr(l.debugClients, addr)
+}
+
+// clientIP returns the IP of the client that sent r. When the direct peer is
+// a trusted proxy, the client is the right-most address in X-Forwarded-For
+// that is not itself a trusted proxy, falling back to X-Real-IP. Otherwise
+// forwarding headers are ignored and the peer address is used.
+func (l *LLMSed) clientIP(r *http.Request) string {
+	peer, ok := remoteAddr(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !containsAddr(l.trustedProxies, peer) {
+		return peer.String()
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		client := ""
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			client = addr.Unmap().String()
+			if !containsAddr(l.trustedProxies, addr) {
+				break
+			}
+		}
+		if client != "" {
+			return client
+		}
+	}
+
+	if real, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return real.Unmap().String()
+	}
+	return peer.String()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parsePrefixes("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTestLLMSed("http://127.0.0.1:0")
+	l.trustedProxies = trusted
+
+	for _, tc := range []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted peer ignores XFF", "203.0.113.9:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.9"},
+		{"untrusted peer ignores X-Real-IP", "203.0.113.9:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "203.0.113.9"},
+		{"trusted peer uses XFF", "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "1.2.3.4"},
+		{"trusted chain skips trusted hops", "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.9.9.9"}, "1.2.3.4"},
+		{"single trusted IP", "192.168.1.1:1234", map[string]string{"X-Real-IP": "5.6.7.8"}, "5.6.7.8"},
+		{"trusted peer without headers", "10.1.2.3:1234", nil, "10.1.2.3"},
+		{"other IP in trusted /32 network", "192.168.1.2:1234", map[string]string{"X-Real-IP": "5.6.7.8"}, "192.168.1.2"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		if got := l.clientIP(r); got != tc.want {
+			t.Errorf("%s: clientIP = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParsePrefixesRejectsInvalid(t *testing.T) {
+	for _, list := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := parsePrefixes(list); err == nil {
+			t.Errorf("%q: expected error", list)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// writeBody sends the final response body. When compression is enabled, a
+// body of at least compressMinBytes is gzipped for clients that accept it,
+// unless the upstream already encoded it.
+func (l *LLMSed) writeBody(w http.ResponseWriter, r *http.Request, status int, body []byte) {
+	if l.compressMinBytes <= 0 || w.Header().Get("Content-Encoding") != "" {
+		w.WriteHeader(status)
+		w.Write(body)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	if len(body) < l.compressMinBytes || !acceptsGzip(r.Header) {
+		w.WriteHeader(status)
+		w.Write(body)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	gz := gzip.NewWriter(w)
+	gz.Write(body)
+	gz.Close()
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, either
+// by name or through "*", with a non-zero quality.
+func acceptsGzip(header http.Header) bool {
+	for _, value := range header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.TrimSpace(coding)
+			if !strings.EqualFold(coding, "gzip") && coding != "*" {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
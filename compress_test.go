@@ -0,0 +1,154 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCompressesLargeResponses(t *testing.T) {
+	large := fmt.Sprintf(`{"text":%q}`, strings.Repeat("token ", 400))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/large" {
+			w.Header().Set("Content-Length", fmt.Sprint(len(large)))
+			io.WriteString(w, large)
+			return
+		}
+		io.WriteString(w, `{"text":"short"}`)
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "passthrough"})
+	l.compressMinBytes = 1024
+	h := l.Handler()
+	send := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{}`))
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send("/large", "gzip, deflate")
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("large body not compressed: headers %v", rec.Header())
+	}
+	if rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", rec.Header().Get("Vary"))
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(gz)
+	if string(body) != large {
+		t.Errorf("decompressed body = %.40s..., want the upstream body", body)
+	}
+
+	for _, c := range []struct{ path, accept string }{
+		{"/small", "gzip"},
+		{"/large", "identity"},
+		{"/large", "gzip;q=0"},
+	} {
+		rec := send(c.path, c.accept)
+		if rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s with Accept-Encoding %q compressed", c.path, c.accept)
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s with Accept-Encoding %q: Vary = %q", c.path, c.accept, rec.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestCompressSkipsEncodedBody(t *testing.T) {
+	l := newTestLLMSed("http://127.0.0.1:0")
+	l.compressMinBytes = 1
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Encoding", "br")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	l.writeBody(rec, req, http.StatusOK, []byte("already encoded"))
+
+	if got := rec.Header().Get("Content-Encoding"); got != "br" {
+		t.Errorf("Content-Encoding = %q, want br", got)
+	}
+	if rec.Body.String() != "already encoded" {
+		t.Errorf("body = %q, want it unchanged", rec.Body)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for value, want := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"br, GZIP;q=0.5":    true,
+		"*":                 true,
+		"gzip;q=0":          false,
+		"deflate, identity": false,
+	} {
+		h := http.Header{}
+		if value != "" {
+			h.Set("Accept-Encoding", value)
+		}
+		if got := acceptsGzip(h); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+// The client's Accept-Encoding is not passed upstream: the transport asks
+// for gzip itself and decodes it, so the post-transform gets plain JSON.
+func TestGzipUpstreamIsDecodedForTransforms(t *testing.T) {
+	var sentEncoding atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sentEncoding.Store(r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte(`{"answer":"plain"}`))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"answer":"gzipped"}`))
+		gz.Close()
+	}))
+	defer upstream.Close()
+	post, _ := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		p["checked"] = true
+		return p
+	})
+	proxy := httptest.NewServer(newTestLLMSed(upstream.URL, TransformRule{Tag: "post", Post: post.URL}).Handler())
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{}`))
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("code = %d: %s", resp.StatusCode, body)
+	}
+	if got := sentEncoding.Load(); got != "gzip" {
+		t.Errorf("upstream Accept-Encoding = %q, want the transport's gzip", got)
+	}
+	if got := resp.Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q, want none", got)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(body, &out); err != nil {
+		t.Fatalf("body %q: %v", body, err)
+	}
+	if out["answer"] != "gzipped" || out["checked"] != true {
+		t.Errorf("body = %s", body)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+)
+
+// connLimiter counts what each client IP has open against
+// -max-conns-per-ip. The zero value is ready to use.
+type connLimiter struct {
+	mu   sync.Mutex
+	open map[netip.Addr]int
+}
+
+// acquire takes one of addr's max slots, reporting false when it has none
+// left.
+func (c *connLimiter) acquire(addr netip.Addr, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open[addr] >= max {
+		return false
+	}
+	if c.open == nil {
+		c.open = map[netip.Addr]int{}
+	}
+	c.open[addr]++
+	return true
+}
+
+func (c *connLimiter) release(addr netip.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open[addr]--; c.open[addr] <= 0 {
+		delete(c.open, addr)
+	}
+}
+
+// limitConnsPerIP wraps ln so that a client IP can hold at most
+// -max-conns-per-ip connections open; further ones are closed as soon as
+// they are accepted. Connections from -trusted-proxies carry many clients
+// and are not counted here: limitClientRequests counts the clients behind
+// them instead.
+func (l *LLMSed) limitConnsPerIP(ln net.Listener) net.Listener {
+	if l.maxConnsPerIP <= 0 {
+		return ln
+	}
+	return &connLimitListener{Listener: ln, l: l}
+}
+
+type connLimitListener struct {
+	net.Listener
+	l *LLMSed
+}
+
+func (ln *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		addr, err := netip.ParseAddrPort(c.RemoteAddr().String())
+		peer := addr.Addr().Unmap()
+		if err != nil || containsAddr(ln.l.trustedProxies, peer) {
+			return c, nil
+		}
+		if !ln.l.conns.acquire(peer, ln.l.maxConnsPerIP) {
+			ln.l.metrics.connsRejected.Inc()
+			log.Printf("Rejected connection from %s: already %d open (-max-conns-per-ip)", peer, ln.l.maxConnsPerIP)
+			c.Close()
+			continue
+		}
+		return &limitedConn{Conn: c, release: func() { ln.l.conns.release(peer) }}, nil
+	}
+}
+
+// limitedConn gives its client's slot back when it is closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// limitClientRequests applies -max-conns-per-ip to clients behind
+// -trusted-proxies, whose connections are the proxy's: each client, as
+// clientIP resolves it, may have at most that many requests in progress,
+// and is answered 429 beyond it.
+func (l *LLMSed) limitClientRequests(next http.Handler) http.Handler {
+	if l.maxConnsPerIP <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := remoteAddr(r)
+		if !ok || !containsAddr(l.trustedProxies, peer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client, err := netip.ParseAddr(l.clientIP(r))
+		if err != nil || client == peer {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !l.conns.acquire(client, l.maxConnsPerIP) {
+			l.metrics.connsRejected.Inc()
+			l.logf(r.Context(), levelWarn, "Rejected request from %s: already %d in progress (-max-conns-per-ip)", client, l.maxConnsPerIP)
+			http.Error(w, fmt.Sprintf("too many concurrent requests from %s", client), http.StatusTooManyRequests)
+			return
+		}
+		defer l.conns.release(client)
+		next.ServeHTTP(w, r)
+	})
+}
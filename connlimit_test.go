@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaxConnsPerIPClosesExtraConnections(t *testing.T) {
+	l := newTestLLMSed(newEchoUpstream(t).URL, TransformRule{})
+	l.maxConnsPerIP = 2
+	srv := httptest.NewUnstartedServer(l.Handler())
+	srv.Listener = l.limitConnsPerIP(srv.Listener)
+	srv.Start()
+	defer srv.Close()
+
+	// request sends one keep-alive request on c and reports whether it was
+	// answered.
+	request := func(c net.Conn) bool {
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		req, _ := http.NewRequest(http.MethodGet, "http://llsed/healthz", nil)
+		if err := req.Write(c); err != nil {
+			return false
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	first, second := dial(), dial()
+	if !request(first) || !request(second) {
+		t.Fatal("connections within the limit were not served")
+	}
+	if request(dial()) {
+		t.Error("third connection from the same IP was served")
+	}
+	if got := testutil.ToFloat64(l.metrics.connsRejected); got != 1 {
+		t.Errorf("llsed_conns_rejected_total = %v, want 1", got)
+	}
+
+	// Closing a connection frees its slot.
+	first.Close()
+	waitFor(t, func() bool { return request(dial()) })
+}
+
+func TestMaxConnsPerIPBehindTrustedProxy(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	l := newTestLLMSed("http://127.0.0.1:0")
+	l.maxConnsPerIP = 1
+	l.trustedProxies, _ = parsePrefixes("192.0.2.0/24")
+	h := l.limitClientRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	send := func(client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`))
+		req.Header.Set("X-Forwarded-For", client)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	done := make(chan struct{})
+	go func() {
+		send("203.0.113.7")
+		close(done)
+	}()
+	<-started
+	if rec := send("203.0.113.7"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second request from the same client: %d, want 429", rec.Code)
+	}
+	// Another client behind the same proxy is not affected.
+	go send("203.0.113.8")
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Error("request from another client was not let through")
+	}
+	close(release)
+	<-done
+	if rec := send("203.0.113.7"); rec.Code != http.StatusOK {
+		t.Errorf("request after the first finished: %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"maps"
+	"slices"
+)
+
+// reservedParam is the params member in which llsed passes per-request
+// metadata to transform servers. It is removed from transform results, so it
+// never reaches the upstream or the client.
+const reservedParam = "_llsed"
+
+// headerCorrelationID carries the correlation ID to stream transforms,
+// whose body has no params to hold it, and to -debug-clients.
+const headerCorrelationID = "X-LLMSed-Correlation-ID"
+
+type correlationKey struct{}
+
+// withCorrelationID returns ctx carrying a new random correlation ID, or ctx
+// itself if it already has one. Every pre and post transform call made for
+// the request receives the same ID, so a stateful transform server can match
+// a post call to its pre call.
+func withCorrelationID(ctx context.Context) context.Context {
+	if correlationID(ctx) != "" {
+		return ctx
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return context.WithValue(ctx, correlationKey{}, hex.EncodeToString(b))
+}
+
+// correlationID returns the request's correlation ID, or "" outside a
+// proxied request.
+func correlationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// rpcParams returns the params for a transform call: a copy of payload with
+// the reserved member added when the request has a correlation ID. Positional
+// params carry it in their first element, the body.
+func rpcParams(ctx context.Context, payload interface{}) interface{} {
+	id := correlationID(ctx)
+	if id == "" {
+		return payload
+	}
+	switch p := payload.(type) {
+	case map[string]interface{}:
+		params := maps.Clone(p)
+		params[reservedParam] = map[string]interface{}{"correlation_id": id}
+		return params
+	case []interface{}:
+		if len(p) == 0 {
+			return payload
+		}
+		params := slices.Clone(p)
+		params[0] = rpcParams(ctx, p[0])
+		return params
+	}
+	return payload
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCorrelationIDSharedByPreAndPost(t *testing.T) {
+	var mu sync.Mutex
+	ids := map[string][]string{}
+	record := func(stage string) func(map[string]interface{}) map[string]interface{} {
+		return func(p map[string]interface{}) map[string]interface{} {
+			meta, _ := p[reservedParam].(map[string]interface{})
+			id, _ := meta["correlation_id"].(string)
+			mu.Lock()
+			ids[stage] = append(ids[stage], id)
+			mu.Unlock()
+			return p
+		}
+	}
+	pre, _ := newRPCServer(t, record("pre"))
+	post, _ := newRPCServer(t, record("post"))
+
+	var forwarded map[string]interface{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&forwarded)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(newTestLLMSed(upstream.URL, TransformRule{Tag: "stateful", Pre: pre.URL, Post: post.URL}).Handler())
+	defer proxy.Close()
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"m"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != `{"ok":true}` {
+			t.Errorf("client got %s, want the reserved field stripped", body)
+		}
+		if _, ok := forwarded[reservedParam]; ok {
+			t.Errorf("upstream got the reserved field: %v", forwarded)
+		}
+	}
+
+	if len(ids["pre"]) != 2 || len(ids["post"]) != 2 {
+		t.Fatalf("calls: %v", ids)
+	}
+	for i := range 2 {
+		if ids["pre"][i] == "" || ids["pre"][i] != ids["post"][i] {
+			t.Errorf("request %d: pre got %q, post got %q", i, ids["pre"][i], ids["post"][i])
+		}
+	}
+	if ids["pre"][0] == ids["pre"][1] {
+		t.Errorf("two requests shared correlation ID %q", ids["pre"][0])
+	}
+}
+
+func TestCorrelationIDInWrappedParams(t *testing.T) {
+	var mu sync.Mutex
+	var got []interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     int             `json:"id"`
+			Params json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var params interface{}
+		json.Unmarshal(req.Params, &params)
+		mu.Lock()
+		got = append(got, params)
+		mu.Unlock()
+
+		result := params
+		switch p := params.(type) {
+		case []interface{}:
+			result = p[0]
+		case map[string]interface{}:
+			if input, ok := p["input"]; ok {
+				result = map[string]interface{}{"output": input}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+	}))
+	defer srv.Close()
+
+	var forwarded map[string]interface{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&forwarded)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	for _, shape := range []string{wrapInput, wrapMessages, wrapPositional} {
+		got = nil
+		l := newTestLLMSed(upstream.URL, TransformRule{Tag: shape, Pre: srv.URL, PayloadWrap: shape})
+		rec := httptest.NewRecorder()
+		l.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[]}`)))
+		if rec.Code != http.StatusOK || len(got) != 1 {
+			t.Fatalf("%s: code %d, %d calls", shape, rec.Code, len(got))
+		}
+		holder, _ := got[0].(map[string]interface{})
+		if p, ok := got[0].([]interface{}); ok && len(p) == 1 {
+			holder, _ = p[0].(map[string]interface{})
+		}
+		meta, _ := holder[reservedParam].(map[string]interface{})
+		if id, _ := meta["correlation_id"].(string); id == "" {
+			t.Errorf("%s: params %v carry no correlation ID", shape, got[0])
+		}
+		if _, ok := forwarded[reservedParam]; ok {
+			t.Errorf("%s: upstream got the reserved field: %v", shape, forwarded)
+		}
+	}
+}
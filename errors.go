@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrConfig is wrapped by every error caused by missing, unreadable or
+// invalid configuration.
+var ErrConfig = errors.New("config error")
+
+// errSLAExceeded is returned when a request is not fully handled within the
+// configured SLA.
+var errSLAExceeded = errors.New("SLA exceeded")
+
+// errUnknownRule is returned when a request forces a rule tag that is not
+// configured.
+var errUnknownRule = errors.New("unknown rule")
+
+// errBadOverride is returned when a dev-mode transform override header does
+// not hold a usable URL.
+var errBadOverride = errors.New("invalid transform override")
+
+// errChainTooLong is returned when a rule's pre or post chain has more
+// steps than -max-chain-steps allows.
+var errChainTooLong = errors.New("transform chain too long")
+
+// TransformError reports a failed request or response transform.
+type TransformError struct {
+	// Stage is "pre" for transforms applied to the request and "post" for
+	// transforms applied to the upstream response.
+	Stage string
+	// Endpoint is the JSON-RPC endpoint called, or the type of the built-in
+	// transform that failed.
+	Endpoint string
+	// Index is the 1-based position of the failed transform in a chain of
+	// several, or 0 when the stage has a single transform.
+	Index int
+	Err   error
+}
+
+func (e *TransformError) Error() string {
+	if e.Index > 0 {
+		return fmt.Sprintf("%s-transform #%d %s failed: %v", e.Stage, e.Index, e.Endpoint, e.Err)
+	}
+	return fmt.Sprintf("%s-transform %s failed: %v", e.Stage, e.Endpoint, e.Err)
+}
+
+func (e *TransformError) Unwrap() error { return e.Err }
+
+// UpstreamError reports a failure talking to the upstream server.
+type UpstreamError struct {
+	// Status is the upstream's HTTP status code, or 0 if no response was
+	// received.
+	Status int
+	Err    error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Status == 0 {
+		return fmt.Sprintf("failed to forward request: %v", e.Err)
+	}
+	return fmt.Sprintf("upstream returned %d: %v", e.Status, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error { return e.Err }
+
+// RejectError is returned by a transform that refuses a request. The client
+// receives Status and Message.
+type RejectError struct {
+	Status  int
+	Message string
+}
+
+func (e *RejectError) Error() string { return e.Message }
+
+// errorStatus maps an error from the proxy pipeline to the HTTP status code
+// returned to the client.
+func errorStatus(err error) int {
+	var upstreamErr *UpstreamError
+	var rejectErr *RejectError
+	switch {
+	case errors.As(err, &rejectErr):
+		return rejectErr.Status
+	case errors.Is(err, errSLAExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, errRuleBusy), errors.Is(err, errBudgetExhausted):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errTransformsSaturated):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errUnknownRule), errors.Is(err, errBadOverride):
+		return http.StatusBadRequest
+	case errors.As(err, &upstreamErr) && upstreamErr.Status == http.StatusTooManyRequests:
+		return http.StatusTooManyRequests
+	case errors.As(err, &upstreamErr):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Error classes that config "errors" maps can rewrite for clients.
+const (
+	errorClassTransform = "transform"
+	errorClassUpstream  = "upstream"
+)
+
+// ErrorMapping replaces what clients are told about a class of failure, so
+// internal details such as transform hostnames stay in the server log.
+type ErrorMapping struct {
+	// Status replaces the response status. Zero keeps the usual one.
+	Status int `json:"status"`
+
+	// Message replaces the error text.
+	Message string `json:"message"`
+}
+
+func validateErrorMappings(mappings map[string]ErrorMapping) error {
+	for class, m := range mappings {
+		if class != errorClassTransform && class != errorClassUpstream {
+			return fmt.Errorf("unknown error class %q, want %q or %q", class, errorClassTransform, errorClassUpstream)
+		}
+		if m.Message == "" {
+			return fmt.Errorf("errors.%s: message is required", class)
+		}
+		if m.Status != 0 && (m.Status < 400 || m.Status > 599) {
+			return fmt.Errorf("errors.%s: status must be a 4xx or 5xx code, got %d", class, m.Status)
+		}
+	}
+	return nil
+}
+
+// sanitizedErrors are what clients outside -debug-clients are told about
+// failures that no error mapping covers, once -debug-clients is set.
+var sanitizedErrors = map[string]ErrorMapping{
+	errorClassTransform: {Message: "transform failed"},
+	errorClassUpstream:  {Message: "upstream request failed"},
+}
+
+// errorClass returns the class of err for error mappings, or "" for errors
+// that are already meant for the client, such as a transform's rejection.
+func errorClass(err error) string {
+	var rejectErr *RejectError
+	var transformErr *TransformError
+	var upstreamErr *UpstreamError
+	switch {
+	case errors.As(err, &rejectErr):
+		return ""
+	case errors.As(err, &transformErr):
+		return errorClassTransform
+	case errors.As(err, &upstreamErr):
+		return errorClassUpstream
+	}
+	return ""
+}
+
+// clientError applies the rule's error mapping for err's class, or else the
+// config-wide one, or else with -debug-clients set the sanitized message. A
+// mapped error is logged in full, since the client only gets the mapped
+// message.
+func (l *LLMSed) clientError(ctx context.Context, rule TransformRule, err error) error {
+	class := errorClass(err)
+	if class == "" {
+		return err
+	}
+	m, ok := rule.Errors[class]
+	if !ok {
+		m, ok = l.config.Load().Errors[class]
+	}
+	if !ok && len(l.debugClients) > 0 {
+		m, ok = sanitizedErrors[class], true
+	}
+	if !ok {
+		return err
+	}
+	l.logf(ctx, levelWarn, "Request failed (client told %q): %v", m.Message, err)
+	status := m.Status
+	if status == 0 {
+		status = errorStatus(err)
+	}
+	return &RejectError{Status: status, Message: m.Message}
+}
+
+// copyRateLimitHeaders copies Retry-After and the rate-limit headers
+// providers send, such as X-RateLimit-Remaining-Requests or
+// anthropic-ratelimit-tokens-reset, from src to dst.
+func copyRateLimitHeaders(dst, src http.Header) {
+	for name, values := range src {
+		if name == "Retry-After" || strings.Contains(strings.ToLower(name), "ratelimit") {
+			dst[name] = append([]string(nil), values...)
+		}
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) {
+		http.Error(w, rejectErr.Message, rejectErr.Status)
+		return
+	}
+	http.Error(w, err.Error(), errorStatus(err))
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewLLMSedReturnsConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	invalidJSON := filepath.Join(dir, "invalid.json")
+	os.WriteFile(invalidJSON, []byte("{"), 0o644)
+	unknownType := filepath.Join(dir, "unknown.json")
+	os.WriteFile(unknownType, []byte(`{"rules":[{"tag":"x","type":"nope"}]}`), 0o644)
+
+	for _, path := range []string{filepath.Join(dir, "missing.json"), invalidJSON, unknownType} {
+		_, err := NewLLMSed(path, "http://example.com")
+		if !errors.Is(err, ErrConfig) {
+			t.Errorf("%s: err = %v, want ErrConfig", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestTransformErrorIdentifiesStageAndEndpoint(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"boom"}}`)
+	}))
+	defer broken.Close()
+
+	l := newTestLLMSed("http://127.0.0.1:0")
+	_, err := l.transformRequest(t.Context(), TransformRule{Pre: broken.URL}, map[string]interface{}{})
+
+	var transformErr *TransformError
+	if !errors.As(err, &transformErr) {
+		t.Fatalf("err = %v, want *TransformError", err)
+	}
+	if transformErr.Stage != "pre" || transformErr.Endpoint != broken.URL {
+		t.Errorf("got stage %q endpoint %q", transformErr.Stage, transformErr.Endpoint)
+	}
+
+	_, err = l.transformResponse(t.Context(), TransformRule{Post: broken.URL}, http.StatusOK, map[string]interface{}{})
+	if !errors.As(err, &transformErr) || transformErr.Stage != "post" {
+		t.Fatalf("err = %v, want post-stage *TransformError", err)
+	}
+}
+
+func TestUpstreamErrorCarriesStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "not json")
+	}))
+	l := newTestLLMSed(upstream.URL)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	resp, err := l.forward(l.httpClient, req, TransformRule{}, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	_, _, err = readResponse(resp)
+	resp.Body.Close()
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) || upstreamErr.Status != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v, want *UpstreamError with status 503", err)
+	}
+
+	upstream.Close()
+	_, err = l.forward(l.httpClient, req, TransformRule{}, []byte(`{}`))
+	if !errors.As(err, &upstreamErr) || upstreamErr.Status != 0 {
+		t.Fatalf("err = %v, want *UpstreamError with no status", err)
+	}
+}
+
+func TestHandleProxyMapsErrorsToStatus(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"error":"boom"}`)
+	}))
+	defer broken.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	for _, tc := range []struct {
+		name string
+		l    *LLMSed
+		want int
+	}{
+		{"no rules", newTestLLMSed(down.URL), http.StatusInternalServerError},
+		{"transform", newTestLLMSed(down.URL, TransformRule{Pre: broken.URL}), http.StatusInternalServerError},
+		{"upstream", newTestLLMSed(down.URL, TransformRule{}), http.StatusBadGateway},
+	} {
+		rec := httptest.NewRecorder()
+		tc.l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+		if rec.Code != tc.want {
+			t.Errorf("%s: code = %d, want %d (%s)", tc.name, rec.Code, tc.want, rec.Body.String())
+		}
+	}
+}
+
+func TestUpstream429KeepsRateLimitHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "17")
+		w.Header().Set("X-RateLimit-Remaining-Requests", "0")
+		w.Header().Set("Anthropic-Ratelimit-Tokens-Reset", "2026-10-14T00:00:17Z")
+		w.WriteHeader(http.StatusTooManyRequests)
+		if r.URL.Path == "/text" {
+			fmt.Fprint(w, "slow down")
+			return
+		}
+		fmt.Fprint(w, `{"error":{"type":"rate_limit_error"}}`)
+	}))
+	defer upstream.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	for _, c := range []struct {
+		name, path string
+		rule       TransformRule
+	}{
+		{"passthrough", "/v1/chat/completions", TransformRule{Tag: "passthrough"}},
+		{"non-JSON body", "/text", TransformRule{Tag: "passthrough"}},
+		{"failing post-transform", "/v1/chat/completions", TransformRule{Tag: "post", Post: broken.URL}},
+	} {
+		rec := httptest.NewRecorder()
+		newTestLLMSed(upstream.URL, c.rule).Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, c.path, strings.NewReader(`{}`)))
+		if rec.Code != http.StatusTooManyRequests {
+			t.Errorf("%s: code = %d, want 429", c.name, rec.Code)
+		}
+		for name, want := range map[string]string{
+			"Retry-After":                      "17",
+			"X-Ratelimit-Remaining-Requests":   "0",
+			"Anthropic-Ratelimit-Tokens-Reset": "2026-10-14T00:00:17Z",
+		} {
+			if got := rec.Header().Get(name); got != want {
+				t.Errorf("%s: %s = %q, want %q", c.name, name, got, want)
+			}
+		}
+	}
+}
+
+func TestErrorMappingsSanitizeClientMessage(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"error":"db password rejected"}`)
+	}))
+	defer broken.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	logs := captureLog(t)
+
+	l := newLLMSed(Config{
+		Errors: map[string]ErrorMapping{
+			errorClassTransform: {Message: "request could not be processed", Status: http.StatusServiceUnavailable},
+			errorClassUpstream:  {Message: "model temporarily unavailable"},
+		},
+		Rules: []TransformRule{
+			{Tag: "transform", Pre: broken.URL},
+			{Tag: "upstream"},
+			{Tag: "own", Pre: broken.URL, Errors: map[string]ErrorMapping{errorClassTransform: {Message: "try again"}}},
+		},
+	}, down.URL)
+	l.ruleOverrideParam = "rule"
+
+	for _, tc := range []struct {
+		rule, wantBody string
+		wantCode       int
+	}{
+		{"transform", "request could not be processed", http.StatusServiceUnavailable},
+		{"upstream", "model temporarily unavailable", http.StatusBadGateway},
+		{"own", "try again", http.StatusInternalServerError},
+	} {
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions?rule="+tc.rule, strings.NewReader(`{}`)))
+		if rec.Code != tc.wantCode || strings.TrimSpace(rec.Body.String()) != tc.wantBody {
+			t.Errorf("%s: got %d %q, want %d %q", tc.rule, rec.Code, rec.Body.String(), tc.wantCode, tc.wantBody)
+		}
+	}
+	if !strings.Contains(logs.String(), "db password rejected") || !strings.Contains(logs.String(), "failed to forward request") {
+		t.Errorf("log lost the original errors:\n%s", logs)
+	}
+}
+
+func TestErrorMappingsKeepRejections(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	l := newLLMSed(Config{
+		Errors: map[string]ErrorMapping{errorClassTransform: {Message: "request could not be processed"}},
+		Rules:  []TransformRule{{Type: transformAllowModels, Params: map[string]interface{}{"models": []interface{}{"gpt-4o"}}}},
+	}, upstream.URL)
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"o1"}`)))
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), `"o1" is not allowed`) {
+		t.Errorf("rejection replaced: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestErrorMappingValidation(t *testing.T) {
+	for _, errs := range []map[string]ErrorMapping{
+		{"timeout": {Message: "slow"}},
+		{errorClassUpstream: {}},
+		{errorClassUpstream: {Message: "down", Status: 200}},
+	} {
+		if err := (Config{Errors: errs}).validate(); err == nil {
+			t.Errorf("%v: expected validation error", errs)
+		}
+		if err := (Config{Rules: []TransformRule{{Errors: errs}}}).validate(); err == nil {
+			t.Errorf("rule %v: expected validation error", errs)
+		}
+	}
+}
+
+func TestDebugClientsGetFullErrors(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"boom"}}`)
+	}))
+	defer broken.Close()
+
+	l := newTestLLMSed("http://127.0.0.1:0", TransformRule{Tag: "broken", Pre: broken.URL})
+	l.trustedProxies, _ = parsePrefixes("192.0.2.1")
+	l.debugClients, _ = parsePrefixes("10.0.0.0/8")
+	captureLog(t)
+
+	send := func(client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`))
+		req.Header.Set("X-Forwarded-For", client)
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, req)
+		return rec
+	}
+
+	debug := send("10.1.2.3")
+	if body := debug.Body.String(); !strings.Contains(body, broken.URL) || !strings.Contains(body, "boom") {
+		t.Errorf("debug client body = %q, want the full error", body)
+	}
+	if debug.Header().Get(headerRule) != "broken" || len(debug.Header().Get(headerCorrelationID)) != 32 {
+		t.Errorf("debug client headers = %v, want the rule and correlation ID", debug.Header())
+	}
+
+	other := send("203.0.113.9")
+	if body := strings.TrimSpace(other.Body.String()); body != "transform failed" || other.Code != http.StatusInternalServerError {
+		t.Errorf("other client got %d %q, want a sanitized 500", other.Code, body)
+	}
+	if other.Header().Get(headerRule) != "" || other.Header().Get(headerCorrelationID) != "" {
+		t.Errorf("other client headers = %v, want no debug headers", other.Header())
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// FanoutBackend is one of the upstreams a fanout rule sends each request to.
+type FanoutBackend struct {
+	// Name keys this backend's entry in the merged response.
+	Name string `json:"name"`
+
+	// URL is the backend's base URL; the request path is appended to it.
+	URL string `json:"url"`
+}
+
+func (b FanoutBackend) validate() error {
+	if b.Name == "" {
+		return fmt.Errorf("fanout backend %q needs a name", b.URL)
+	}
+	u, err := url.Parse(b.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("fanout backend %s: url must be an http(s) URL, got %q", b.Name, b.URL)
+	}
+	return nil
+}
+
+// validateFanout checks a rule's fanout backends, whose names must be
+// unique since they key the merged response.
+func validateFanout(backends []FanoutBackend) error {
+	seen := make(map[string]bool, len(backends))
+	for _, b := range backends {
+		if err := b.validate(); err != nil {
+			return err
+		}
+		if seen[b.Name] {
+			return fmt.Errorf("fanout backend %s listed twice", b.Name)
+		}
+		seen[b.Name] = true
+	}
+	return nil
+}
+
+// fanout sends the transformed request to every backend of the rule at
+// once and merges the answers into one object keyed by backend name. Each
+// entry holds the backend's "status" and JSON "body", or an "error" when the
+// backend could not be reached or did not answer with JSON. The status is
+// 200 when at least one backend answered with a 2xx, and 502 otherwise.
+func (l *LLMSed) fanout(r *http.Request, rule TransformRule, client *http.Client, body []byte) (int, map[string]interface{}) {
+	header := l.upstreamHeader(r, rule)
+	path := rule.upstreamPath(r.URL.Path)
+	method, body := rule.upstreamRequest(r.Method, body)
+	entries := make([]map[string]interface{}, len(rule.Fanout))
+
+	var wg sync.WaitGroup
+	for i, backend := range rule.Fanout {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entries[i] = l.fanoutOne(r, backend, client, method, path, header, body)
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusBadGateway
+	merged := make(map[string]interface{}, len(entries))
+	for i, backend := range rule.Fanout {
+		if code, ok := entries[i]["status"].(int); ok && code >= 200 && code < 300 {
+			status = http.StatusOK
+		}
+		merged[backend.Name] = entries[i]
+	}
+	return status, merged
+}
+
+func (l *LLMSed) fanoutOne(r *http.Request, backend FanoutBackend, client *http.Client, method, path string, header http.Header, body []byte) map[string]interface{} {
+	targetURL := strings.TrimSuffix(backend.URL, "/") + path
+	fail := func(err error) map[string]interface{} {
+		l.logf(r.Context(), levelWarn, "Fanout to %s (%s) failed: %v", backend.Name, targetURL, err)
+		return map[string]interface{}{"error": err.Error()}
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), method, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return fail(err)
+	}
+	req.Header = header.Clone()
+	resp, err := client.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+
+	_, payload, err := readResponse(resp)
+	if err != nil {
+		return fail(err)
+	}
+	return map[string]interface{}{"status": resp.StatusCode, "body": payload}
+}
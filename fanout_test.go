@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newModelUpstream answers every request with a completion from model,
+// after checking the forwarded body.
+func newModelUpstream(t *testing.T, model string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if string(b) != `{"messages":[{"content":"hi","role":"user"}]}` {
+			t.Errorf("%s got body %s", model, b)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"model":%q,"choices":[{"message":{"content":"from %s"}}]}`, model, model)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFanoutMergesResponses(t *testing.T) {
+	a := newModelUpstream(t, "model-a")
+	b := newModelUpstream(t, "model-b")
+
+	l := newTestLLMSed("http://127.0.0.1:1", TransformRule{Tag: "ensemble", Fanout: []FanoutBackend{
+		{Name: "a", URL: a.URL},
+		{Name: "b", URL: b.URL + "/"},
+	}})
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"hi"}]}`)))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code %d: %s", rec.Code, rec.Body.String())
+	}
+	assertJSON(t, decode(t, rec.Body.String()), `{
+		"a": {"status": 200, "body": {"model": "model-a", "choices": [{"message": {"content": "from model-a"}}]}},
+		"b": {"status": 200, "body": {"model": "model-b", "choices": [{"message": {"content": "from model-b"}}]}}
+	}`)
+}
+
+func TestFanoutPartialFailure(t *testing.T) {
+	ok := newModelUpstream(t, "model-a")
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	l := newTestLLMSed("", TransformRule{Fanout: []FanoutBackend{{Name: "ok", URL: ok.URL}, {Name: "down", URL: down.URL}}})
+	send := func() (int, map[string]map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"hi"}]}`)))
+		var merged map[string]map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &merged); err != nil {
+			t.Fatalf("merged response: %v", err)
+		}
+		return rec.Code, merged
+	}
+
+	code, merged := send()
+	if code != http.StatusOK || merged["ok"]["status"] != float64(200) {
+		t.Errorf("working backend: code %d, entry %v", code, merged["ok"])
+	}
+	if msg, _ := merged["down"]["error"].(string); msg == "" {
+		t.Errorf("failed backend entry %v has no error", merged["down"])
+	}
+
+	l.config.Store(&Config{Rules: []TransformRule{{Fanout: []FanoutBackend{{Name: "down", URL: down.URL}}}}})
+	if code, _ := send(); code != http.StatusBadGateway {
+		t.Errorf("all backends failed: code %d, want 502", code)
+	}
+}
+
+func TestFanoutValidation(t *testing.T) {
+	for _, backends := range [][]FanoutBackend{
+		{{URL: "http://a"}},
+		{{Name: "a", URL: "ftp://a"}},
+		{{Name: "a", URL: "http://a"}, {Name: "a", URL: "http://b"}},
+	} {
+		if err := (Config{Rules: []TransformRule{{Fanout: backends}}}).validate(); err == nil {
+			t.Errorf("%v: expected validation error", backends)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// grpcScheme marks transform endpoints served over gRPC rather than
+// JSON-RPC over HTTP, e.g. grpc://10.0.0.5:9001.
+const grpcScheme = "grpc://"
+
+// grpcTransformMethod is the RPC gRPC transform services implement. It
+// takes the params llsed would send over JSON-RPC, JSON-encoded in a
+// google.protobuf.BytesValue, and returns the JSON result the same way.
+const grpcTransformMethod = "/llsed.v1.Transformer/Transform"
+
+// grpcMessageOverhead is room for the BytesValue framing around a result
+// of -max-transform-bytes.
+const grpcMessageOverhead = 16
+
+func isGRPCEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, grpcScheme)
+}
+
+// grpcConns holds one connection per gRPC transform address, shared by
+// every call to it: gRPC multiplexes concurrent calls over one connection
+// and redials it when it drops. The zero value is ready to use.
+type grpcConns struct {
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func (c *grpcConns) get(target string) (*grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.conns[target]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	if c.conns == nil {
+		c.conns = map[string]*grpc.ClientConn{}
+	}
+	c.conns[target] = conn
+	return conn, nil
+}
+
+// callGRPC is callRPC for grpc:// endpoints. header is sent as request
+// metadata, and client's timeout bounds the call.
+func (l *LLMSed) callGRPC(ctx context.Context, client *http.Client, endpoint string, header http.Header, payload interface{}) (interface{}, error) {
+	conn, err := l.grpcConns.get(strings.TrimSuffix(strings.TrimPrefix(endpoint, grpcScheme), "/"))
+	if err != nil {
+		return nil, err
+	}
+	params, err := json.Marshal(rpcParams(ctx, payload))
+	if err != nil {
+		return nil, err
+	}
+
+	md := metadata.MD{}
+	for name, values := range header {
+		md.Append(strings.ToLower(name), values...)
+	}
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	if client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.Timeout)
+		defer cancel()
+	}
+	var opts []grpc.CallOption
+	if l.maxTransformBytes > 0 {
+		opts = append(opts, grpc.MaxCallRecvMsgSize(int(l.maxTransformBytes)+grpcMessageOverhead))
+	}
+
+	out := new(wrapperspb.BytesValue)
+	if err := conn.Invoke(ctx, grpcTransformMethod, wrapperspb.Bytes(params), out, opts...); err != nil {
+		if status.Code(err) == codes.ResourceExhausted {
+			return nil, fmt.Errorf("transform response from %s exceeds %d bytes: %w", endpoint, l.maxTransformBytes, err)
+		}
+		return nil, fmt.Errorf("grpc error: %w", err)
+	}
+	if l.maxTransformBytes > 0 && int64(len(out.GetValue())) > l.maxTransformBytes {
+		return nil, fmt.Errorf("transform response from %s exceeds %d bytes", endpoint, l.maxTransformBytes)
+	}
+
+	var result interface{}
+	if err := decodeJSON(out.GetValue(), &result); err != nil {
+		return nil, err
+	}
+	if object, ok := result.(map[string]interface{}); ok {
+		delete(object, reservedParam)
+	}
+	return result, nil
+}
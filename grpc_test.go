@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// newGRPCTransformServer serves grpcTransformMethod with fn and returns its
+// grpc:// endpoint and listener.
+func newGRPCTransformServer(t *testing.T, fn func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error)) (string, *countingListener) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingListener{Listener: ln}
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "llsed.v1.Transformer",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Transform",
+			Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(wrapperspb.BytesValue)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				var params map[string]interface{}
+				if err := json.Unmarshal(in.GetValue(), &params); err != nil {
+					return nil, status.Error(codes.InvalidArgument, err.Error())
+				}
+				result, err := fn(ctx, params)
+				if err != nil {
+					return nil, err
+				}
+				out, _ := json.Marshal(result)
+				return wrapperspb.Bytes(out), nil
+			},
+		}},
+	}, struct{}{})
+	go srv.Serve(counting)
+	t.Cleanup(srv.Stop)
+	return grpcScheme + ln.Addr().String(), counting
+}
+
+func TestGRPCTransformRoundTrip(t *testing.T) {
+	var calls atomic.Int32
+	var token atomic.Value
+	endpoint, ln := newGRPCTransformServer(t, func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		calls.Add(1)
+		md, _ := metadata.FromIncomingContext(ctx)
+		token.Store(strings.Join(md.Get("authorization"), ","))
+		if _, ok := params[reservedParam]; !ok {
+			return nil, status.Error(codes.InvalidArgument, "no correlation id")
+		}
+		params["model"] = "gpt-4o"
+		return params, nil
+	})
+
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		forwarded, _ = body["model"].(string)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	t.Setenv("TRANSFORM_TOKEN", "t0ken")
+	l := newTestLLMSed(upstream.URL, TransformRule{
+		Tag:        "grpc",
+		Pre:        endpoint,
+		PreHeaders: map[string]string{"Authorization": "Bearer ${TRANSFORM_TOKEN}"},
+	})
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"claude"}`)))
+		if rec.Code != http.StatusOK || forwarded != "gpt-4o" {
+			t.Fatalf("request %d: got %d %s, forwarded model %q", i, rec.Code, rec.Body.String(), forwarded)
+		}
+	}
+	if calls.Load() != 3 || token.Load() != "Bearer t0ken" {
+		t.Errorf("%d transform calls, authorization %q", calls.Load(), token.Load())
+	}
+	if n := ln.accepted.Load(); n != 1 {
+		t.Errorf("%d connections to the transform server, want 1 reused", n)
+	}
+}
+
+func TestGRPCTransformError(t *testing.T) {
+	endpoint, _ := newGRPCTransformServer(t, func(context.Context, map[string]interface{}) (map[string]interface{}, error) {
+		return nil, status.Error(codes.Unavailable, "model store offline")
+	})
+	l := newTestLLMSed(newEchoUpstream(t).URL, TransformRule{Tag: "grpc", Pre: endpoint})
+
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "model store offline") {
+		t.Errorf("got %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// languageDetector returns the ISO 639-1 code of the language text is
+// written in, such as "en" or "ja", or "" when it cannot tell.
+type languageDetector func(text string) string
+
+// identifyLanguage is the detector behind rules' languages and the
+// detect-language transform. A real language identification library would
+// be plugged in here.
+var identifyLanguage languageDetector = detectLanguageHeuristic
+
+// headerLanguage carries the detected language of the prompt to the
+// upstream and back to the client.
+const headerLanguage = "X-LLMSed-Language"
+
+// promptText returns the text whose language is detected: the latest user
+// message, or for completion-style bodies the prompt or input string.
+func promptText(payload map[string]interface{}) string {
+	messages, _ := payload["messages"].([]interface{})
+	for i := len(messages) - 1; i >= 0; i-- {
+		if m, ok := messages[i].(map[string]interface{}); ok && m["role"] == "user" {
+			if text := messageText(m); text != "" {
+				return text
+			}
+		}
+	}
+	for _, field := range []string{"prompt", "input"} {
+		if text, ok := payload[field].(string); ok {
+			return text
+		}
+	}
+	return ""
+}
+
+// scriptLanguages are the languages told apart by their writing system
+// alone. Kana comes before Han, since Japanese text mixes the two.
+var scriptLanguages = []struct {
+	script *unicode.RangeTable
+	lang   string
+}{
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Hangul, "ko"},
+	{unicode.Han, "zh"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Arabic, "ar"},
+	{unicode.Greek, "el"},
+	{unicode.Hebrew, "he"},
+	{unicode.Devanagari, "hi"},
+	{unicode.Thai, "th"},
+}
+
+// latinStopwords are frequent short words of languages written in Latin
+// script, used to tell them apart.
+var latinStopwords = map[string][]string{
+	"en": {"the", "a", "an", "and", "is", "are", "be", "of", "to", "in", "on", "that", "it", "i", "you", "do", "what", "how", "this", "with", "for", "please", "can", "my"},
+	"es": {"el", "la", "los", "las", "que", "y", "es", "en", "por", "para", "una", "un", "cómo", "qué", "con", "está", "mi", "del"},
+	"fr": {"le", "la", "les", "des", "est", "et", "que", "un", "une", "pour", "dans", "vous", "je", "pas", "ce", "avec", "comment", "du"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ich", "sie", "ein", "eine", "mit", "zu", "wie", "was", "für", "auf", "mein", "bitte"},
+	"it": {"il", "lo", "la", "che", "di", "e", "è", "un", "una", "per", "non", "sono", "come", "cosa", "con", "gli", "del", "mi"},
+	"pt": {"o", "a", "os", "as", "que", "é", "um", "uma", "para", "não", "com", "você", "como", "está", "do", "da", "em", "meu"},
+	"nl": {"de", "het", "een", "en", "is", "niet", "van", "ik", "je", "dat", "wat", "hoe", "met", "voor", "zijn", "mijn", "alsjeblieft"},
+}
+
+// detectLanguageHeuristic picks the language by writing system and, for
+// Latin script, by which language's common words the text uses most. It is
+// meant for routing, not for short or mixed-language text.
+func detectLanguageHeuristic(text string) string {
+	counts := map[string]int{}
+	latin := 0
+	for _, r := range text {
+		if unicode.In(r, unicode.Latin) {
+			latin++
+			continue
+		}
+		for _, s := range scriptLanguages {
+			if unicode.In(r, s.script) {
+				counts[s.lang]++
+				break
+			}
+		}
+	}
+	best, bestCount := "", 0
+	for _, s := range scriptLanguages {
+		if n := counts[s.lang]; n > bestCount {
+			best, bestCount = s.lang, n
+		}
+	}
+	if best == "zh" && counts["ja"] > 0 {
+		best = "ja"
+	}
+	if bestCount > latin {
+		return best
+	}
+
+	scores := map[string]int{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) {
+		for lang, words := range latinStopwords {
+			if slices.Contains(words, word) {
+				scores[lang]++
+			}
+		}
+	}
+	best, bestCount, tied := "", 0, false
+	for _, lang := range sortedLanguages() {
+		switch n := scores[lang]; {
+		case n > bestCount:
+			best, bestCount, tied = lang, n, false
+		case n == bestCount && n > 0:
+			tied = true
+		}
+	}
+	if tied {
+		return ""
+	}
+	return best
+}
+
+func sortedLanguages() []string {
+	langs := make([]string, 0, len(latinStopwords))
+	for lang := range latinStopwords {
+		langs = append(langs, lang)
+	}
+	slices.Sort(langs)
+	return langs
+}
+
+type languageKey struct{}
+
+// withLanguage returns ctx carrying the detected language of the request's
+// prompt, "" when none was detected.
+func withLanguage(ctx context.Context, lang string) context.Context {
+	return context.WithValue(ctx, languageKey{}, lang)
+}
+
+// languageFrom returns the language stored by withLanguage, and whether
+// detection ran for the request at all.
+func languageFrom(ctx context.Context) (string, bool) {
+	lang, ok := ctx.Value(languageKey{}).(string)
+	return lang, ok
+}
+
+// detectsLanguage reports whether any rule needs the prompt's language:
+// one that matches on it or runs the detect-language transform.
+func (c *Config) detectsLanguage() bool {
+	for _, rule := range c.Rules {
+		if len(rule.Languages) > 0 || rule.Type == transformDetectLanguage {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesLanguage reports whether the rule takes a request whose prompt is
+// in lang. Rules without languages take every request.
+func (r TransformRule) matchesLanguage(lang string) bool {
+	return len(r.Languages) == 0 || (lang != "" && slices.Contains(r.Languages, lang))
+}
+
+// detectLanguage writes the detected language of the prompt into the body
+// and can pick a model for it.
+//
+// Params:
+//   - field: path to set to the language code, e.g. "metadata.language"
+//   - models: language code -> model to use for prompts in that language
+//
+// At least one of them is required. A prompt in no known language is left
+// as it is.
+func detectLanguage(params map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, error) {
+	field, _ := params["field"].(string)
+	models, _ := params["models"].(map[string]interface{})
+	if field == "" && models == nil {
+		return nil, fmt.Errorf("%s: params.field or params.models is required", transformDetectLanguage)
+	}
+	lang := identifyLanguage(promptText(payload))
+	if lang == "" {
+		return payload, nil
+	}
+	if field != "" {
+		path, err := parsePath(field)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", transformDetectLanguage, err)
+		}
+		if err := setPath(payload, path, lang); err != nil {
+			return nil, fmt.Errorf("%s: %w", transformDetectLanguage, err)
+		}
+	}
+	if model, ok := models[lang]; ok {
+		name, ok := model.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: model for %q must be a string", transformDetectLanguage, lang)
+		}
+		payload["model"] = name
+	}
+	return payload, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDetectLanguageHeuristic(t *testing.T) {
+	for _, tc := range []struct {
+		text, want string
+	}{
+		{"What is the capital of France? Please answer in one word.", "en"},
+		{"Quelle est la capitale de la France ? Je voudrais une réponse courte.", "fr"},
+		{"¿Cuál es la capital de España? Por favor, responde con una palabra.", "es"},
+		{"Wie ist das Wetter heute in Berlin? Ich bin nicht sicher.", "de"},
+		{"日本の首都はどこですか？", "ja"},
+		{"中国的首都是哪里？", "zh"},
+		{"Какая столица России?", "ru"},
+		{"한국의 수도는 어디입니까?", "ko"},
+		{"12345", ""},
+		{"", ""},
+	} {
+		if got := detectLanguageHeuristic(tc.text); got != tc.want {
+			t.Errorf("detectLanguageHeuristic(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestLanguageRouting(t *testing.T) {
+	var english, other int32
+	var sentLanguage atomic.Value
+	count := func(n *int32) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(n, 1)
+			sentLanguage.Store(r.Header.Get(headerLanguage))
+			w.Write([]byte(`{}`))
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	englishUpstream, otherUpstream := count(&english), count(&other)
+
+	l := newTestLLMSed(englishUpstream.URL,
+		TransformRule{Tag: "english", Languages: []string{"en"}},
+		TransformRule{Tag: "other", Canary: &CanaryConfig{URL: otherUpstream.URL, Percent: 100}},
+	)
+	send := func(prompt string, header string) *httptest.ResponseRecorder {
+		body := `{"model":"m","messages":[{"role":"user","content":"` + prompt + `"}]}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		if header != "" {
+			req.Header.Set(headerLanguage, header)
+		}
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, req)
+		return rec
+	}
+
+	rec := send("How do I reverse a list in Python?", "")
+	if rec.Code != http.StatusOK || english != 1 || other != 0 {
+		t.Fatalf("english prompt: code %d, english %d, other %d", rec.Code, english, other)
+	}
+	if got := rec.Header().Get(headerLanguage); got != "en" {
+		t.Errorf("response %s = %q, want en", headerLanguage, got)
+	}
+	if got := sentLanguage.Load(); got != "en" {
+		t.Errorf("upstream %s = %q, want en", headerLanguage, got)
+	}
+
+	// A client's own header is replaced by what was detected.
+	rec = send("Comment est-ce que je peux inverser une liste avec Python ?", "en")
+	if rec.Code != http.StatusOK || english != 1 || other != 1 {
+		t.Fatalf("french prompt: code %d, english %d, other %d", rec.Code, english, other)
+	}
+	if got := sentLanguage.Load(); got != "fr" {
+		t.Errorf("upstream %s = %q, want fr", headerLanguage, got)
+	}
+
+	rec = send("12345", "en")
+	if rec.Code != http.StatusOK || other != 2 {
+		t.Fatalf("undetected prompt: code %d, other %d", rec.Code, other)
+	}
+	if got := rec.Header().Get(headerLanguage); got != "" {
+		t.Errorf("undetected prompt: response %s = %q, want none", headerLanguage, got)
+	}
+	if got := sentLanguage.Load(); got != "" {
+		t.Errorf("undetected prompt: upstream %s = %q, want none", headerLanguage, got)
+	}
+
+	only := newTestLLMSed(englishUpstream.URL, TransformRule{Tag: "english", Languages: []string{"en"}})
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	req = req.WithContext(withLanguage(req.Context(), "ja"))
+	if _, err := only.selectRule(req); !errors.Is(err, ErrConfig) {
+		t.Errorf("japanese prompt matched an english rule: err = %v", err)
+	}
+	bad := Config{Rules: []TransformRule{{Tag: "r", Languages: []string{"EN"}}}}
+	if err := bad.validate(); err == nil {
+		t.Error("uppercase language: expected a validation error")
+	}
+}
+
+func TestDetectLanguageTransform(t *testing.T) {
+	rule := TransformRule{Type: transformDetectLanguage, Params: map[string]interface{}{
+		"field":  "metadata.language",
+		"models": map[string]interface{}{"ja": "qwen"},
+	}}
+	out, err := applyRequestTransform("", rule, decode(t, `{"model":"llama","messages":[{"role":"user","content":"東京の天気はどうですか？"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"model":"qwen","metadata":{"language":"ja"},"messages":[{"role":"user","content":"東京の天気はどうですか？"}]}`)
+
+	out, err = applyRequestTransform("", rule, decode(t, `{"model":"llama","prompt":"What is the weather like in Tokyo?"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"model":"llama","metadata":{"language":"en"},"prompt":"What is the weather like in Tokyo?"}`)
+
+	if _, err := applyRequestTransform("", TransformRule{Type: transformDetectLanguage}, decode(t, `{}`)); err == nil {
+		t.Error("no field or models: expected an error")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errRuleBusy is returned when a rule in reject mode is already running its
+// maximum number of concurrent transforms.
+var errRuleBusy = errors.New("too many concurrent transforms for rule")
+
+// errTransformsSaturated is returned when a transform call waits longer than
+// the queue timeout for a -max-transform-concurrency slot.
+var errTransformsSaturated = errors.New("too many concurrent transforms")
+
+// defaultTransformQueueTimeout bounds the wait for a global transform slot.
+const defaultTransformQueueTimeout = 10 * time.Second
+
+// acquireTransformSlot takes one of the global transform slots and returns
+// the function that releases it. Without a global limit it returns at once.
+// Otherwise it waits for a free slot until the queue timeout passes or ctx
+// ends, and records the wait.
+func (l *LLMSed) acquireTransformSlot(ctx context.Context) (func(), error) {
+	if l.transformSlots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-l.transformSlots }
+	start := time.Now()
+	defer func() { l.metrics.transformQueueWait.Observe(time.Since(start).Seconds()) }()
+
+	select {
+	case l.transformSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	timeout := newTimer(l.transformQueueTimeout)
+	defer timeout.Stop()
+	select {
+	case l.transformSlots <- struct{}{}:
+		return release, nil
+	case <-timeout.C:
+		return nil, fmt.Errorf("%w: no slot free within %s", errTransformsSaturated, l.transformQueueTimeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ruleLimitKey identifies a rule's semaphore. The limit is part of the key so
+// changing max_concurrent in config yields a correctly sized semaphore.
+type ruleLimitKey struct {
+	tag string
+	max int
+}
+
+// ruleLimiter hands out one semaphore per rule, created on first use.
+type ruleLimiter struct {
+	mu   sync.Mutex
+	sems map[ruleLimitKey]chan struct{}
+}
+
+func (rl *ruleLimiter) semaphore(rule TransformRule) chan struct{} {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	key := ruleLimitKey{tag: rule.Tag, max: rule.MaxConcurrent}
+	sem, ok := rl.sems[key]
+	if !ok {
+		if rl.sems == nil {
+			rl.sems = make(map[ruleLimitKey]chan struct{})
+		}
+		sem = make(chan struct{}, rule.MaxConcurrent)
+		rl.sems[key] = sem
+	}
+	return sem
+}
+
+// acquire takes a transform slot for rule and returns the function that
+// releases it. Rules without MaxConcurrent are unlimited. In reject mode a
+// full rule fails immediately with errRuleBusy; otherwise the call waits for
+// a free slot or for ctx to end.
+func (rl *ruleLimiter) acquire(ctx context.Context, rule TransformRule) (func(), error) {
+	if rule.MaxConcurrent <= 0 {
+		return func() {}, nil
+	}
+
+	sem := rl.semaphore(rule)
+	release := func() { <-sem }
+
+	if rule.ConcurrencyMode == concurrencyReject {
+		select {
+		case sem <- struct{}{}:
+			return release, nil
+		default:
+			return nil, fmt.Errorf("rule %q: %w", rule.Tag, errRuleBusy)
+		}
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newBlockingRPCServer starts a transform server that echoes its params but
+// holds each call until release is closed. It records the peak number of
+// calls in flight.
+func newBlockingRPCServer(t *testing.T, release chan struct{}) (*httptest.Server, *int32, *int32) {
+	t.Helper()
+	var inFlight, peak int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		var req struct {
+			Params interface{} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		<-release
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": req.Params})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &inFlight, &peak
+}
+
+func newEchoUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ok":true}`)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRuleMaxConcurrentRejects(t *testing.T) {
+	release := make(chan struct{})
+	pre, inFlight, _ := newBlockingRPCServer(t, release)
+	upstream := newEchoUpstream(t)
+
+	l := newTestLLMSed(upstream.URL, TransformRule{
+		Tag:             "single",
+		Pre:             pre.URL,
+		MaxConcurrent:   1,
+		ConcurrencyMode: concurrencyReject,
+	})
+
+	first := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+		first <- rec.Code
+	}()
+	waitFor(t, func() bool { return atomic.LoadInt32(inFlight) == 1 })
+
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second request: code = %d, want 429", rec.Code)
+	}
+
+	close(release)
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("first request: code = %d, want 200", code)
+	}
+}
+
+func TestConcurrencyModeValidation(t *testing.T) {
+	for mode, ok := range map[string]bool{"": true, concurrencyQueue: true, concurrencyReject: true, "rejct": false} {
+		c := Config{Rules: []TransformRule{{Tag: "r", MaxConcurrent: 1, ConcurrencyMode: mode}}}
+		if err := c.validate(); (err == nil) != ok {
+			t.Errorf("concurrency_mode %q: err = %v", mode, err)
+		}
+	}
+}
+
+func TestRuleMaxConcurrentQueues(t *testing.T) {
+	release := make(chan struct{})
+	pre, inFlight, peak := newBlockingRPCServer(t, release)
+	upstream := newEchoUpstream(t)
+
+	l := newTestLLMSed(upstream.URL, TransformRule{
+		Tag:             "single",
+		Pre:             pre.URL,
+		MaxConcurrent:   1,
+		ConcurrencyMode: concurrencyQueue,
+	})
+
+	const requests = 3
+	var wg sync.WaitGroup
+	codes := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+			codes <- rec.Code
+		}()
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(inFlight) == 1 })
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("queued request: code = %d, want 200", code)
+		}
+	}
+	if p := atomic.LoadInt32(peak); p != 1 {
+		t.Errorf("peak concurrent transforms = %d, want 1", p)
+	}
+}
+
+func TestRuleQueueWaitHistogram(t *testing.T) {
+	release := make(chan struct{})
+	pre, inFlight, _ := newBlockingRPCServer(t, release)
+	upstream := newEchoUpstream(t)
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "single", Pre: pre.URL, MaxConcurrent: 1})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.handleProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+		}()
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(inFlight) == 1 })
+	const held = 50 * time.Millisecond
+	time.Sleep(held)
+	close(release)
+	wg.Wait()
+
+	var m dto.Metric
+	l.metrics.ruleQueueWait.WithLabelValues("single").(prometheus.Metric).Write(&m)
+	if n := m.GetHistogram().GetSampleCount(); n != 2 {
+		t.Errorf("queue wait observed %d times, want 2", n)
+	}
+	// The queued call waited at least as long as the slot was held.
+	if sum := m.GetHistogram().GetSampleSum(); sum < held.Seconds() {
+		t.Errorf("queue wait sum = %vs, want at least %v", sum, held)
+	}
+}
+
+func TestGlobalTransformConcurrencyQueues(t *testing.T) {
+	release := make(chan struct{})
+	pre, inFlight, peak := newBlockingRPCServer(t, release)
+	upstream := newEchoUpstream(t)
+
+	// Two rules, so only the global limit can hold them back.
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "a", Pre: pre.URL}, TransformRule{Tag: "b", Pre: pre.URL})
+	l.ruleOverrideParam = "rule"
+	l.transformSlots = make(chan struct{}, 2)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 4)
+	for _, tag := range []string{"a", "b", "a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions?rule="+tag, strings.NewReader(`{}`)))
+			codes <- rec.Code
+		}()
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(inFlight) == 2 })
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(inFlight); n != 2 {
+		t.Fatalf("%d transforms in flight, want 2", n)
+	}
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("queued request: code = %d, want 200", code)
+		}
+	}
+	if p := atomic.LoadInt32(peak); p != 2 {
+		t.Errorf("peak in flight = %d, want 2", p)
+	}
+	var m dto.Metric
+	l.metrics.transformQueueWait.Write(&m)
+	if n := m.GetHistogram().GetSampleCount(); n != 4 {
+		t.Errorf("queue wait observed %d times, want 4", n)
+	}
+}
+
+func TestGlobalTransformConcurrencyTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	pre, inFlight, _ := newBlockingRPCServer(t, release)
+	upstream := newEchoUpstream(t)
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "slow", Pre: pre.URL, OnError: onErrorSkip})
+	l.transformSlots = make(chan struct{}, 1)
+	l.transformQueueTimeout = 50 * time.Millisecond
+
+	go l.handleProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	waitFor(t, func() bool { return atomic.LoadInt32(inFlight) == 1 })
+
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("code = %d, want 503: %s", rec.Code, rec.Body)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("failed after %s, before the queue timeout", elapsed)
+	}
+	if !strings.Contains(rec.Body.String(), "too many concurrent transforms") {
+		t.Errorf("body = %q", rec.Body)
+	}
+}
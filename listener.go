@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes to a
+// socket-activated service.
+const sdListenFDsStart = 3
+
+// activatedListener returns the listener passed in by systemd socket
+// activation, or nil when the process was not socket-activated. Activation
+// is signalled by LISTEN_PID naming this process and LISTEN_FDS giving the
+// number of descriptors, starting at firstFD; llsed serves on the first.
+func activatedListener(lookup func(string) (string, bool), pid int, firstFD uintptr) (net.Listener, error) {
+	listenPID, ok := lookup("LISTEN_PID")
+	if !ok {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(listenPID); err != nil || p != pid {
+		return nil, nil
+	}
+	count, _ := lookup("LISTEN_FDS")
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("socket activation: invalid LISTEN_FDS %q", count)
+	}
+
+	f := os.NewFile(firstFD, "LISTEN_FD_"+strconv.Itoa(int(firstFD)))
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %w", err)
+	}
+	return ln, nil
+}
+
+// listen returns the socket-activated listener if there is one, and binds
+// addr otherwise.
+func listen(addr string) (net.Listener, error) {
+	ln, err := activatedListener(os.LookupEnv, os.Getpid(), sdListenFDsStart)
+	if err != nil || ln != nil {
+		// Keep the variables from leaking into child processes.
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		return ln, err
+	}
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,67 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestActivatedListenerServesOnPassedSocket(t *testing.T) {
+	bound, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bound.Close()
+	// Hand over a duplicate descriptor, as systemd would. activatedListener
+	// takes ownership of it.
+	f, err := bound.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{"LISTEN_PID": strconv.Itoa(4242), "LISTEN_FDS": "1"}
+	lookup := func(key string) (string, bool) { v, ok := env[key]; return v, ok }
+
+	ln, err := activatedListener(lookup, 4242, uintptr(fd))
+	if err != nil || ln == nil {
+		t.Fatalf("listener = %v, err = %v", ln, err)
+	}
+	if ln.Addr().String() != bound.Addr().String() {
+		t.Errorf("listening on %s, want the passed-in %s", ln.Addr(), bound.Addr())
+	}
+
+	srv := &http.Server{Handler: newTestLLMSed("http://127.0.0.1:0").Handler()}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + bound.Addr().String() + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("healthz via activated socket: %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestActivatedListenerIgnoresOtherProcesses(t *testing.T) {
+	env := map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}
+	lookup := func(key string) (string, bool) { v, ok := env[key]; return v, ok }
+	if ln, err := activatedListener(lookup, 4242, sdListenFDsStart); ln != nil || err != nil {
+		t.Errorf("listener = %v, err = %v, want none for another PID", ln, err)
+	}
+	if ln, err := activatedListener(func(string) (string, bool) { return "", false }, 4242, sdListenFDsStart); ln != nil || err != nil {
+		t.Errorf("listener = %v, err = %v, want none without activation", ln, err)
+	}
+}
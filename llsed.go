@@ -2,14 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 func usage() {
@@ -21,196 +34,1834 @@ func usage() {
 }
 
 type TransformRule struct {
-	Tag    string                 `json:"tag"`
-	From   string                 `json:"from"`
-	To     string                 `json:"to"`
-	Params map[string]interface{} `json:"params"`
-	Pre    string                 `json:"pre"`
-	Post   string                 `json:"post"`
+	Tag          string                 `json:"tag"`
+	From         string                 `json:"from"`
+	To           string                 `json:"to"`
+	Type         string                 `json:"type"`
+	Params       map[string]interface{} `json:"params"`
+	Pre          string                 `json:"pre"`
+	Post         string                 `json:"post"`
+	PostOnStatus []StatusRange          `json:"post_on_status"`
+
+	// PreChain and PostChain are further JSON-RPC transforms applied in
+	// order after Pre and Post, each receiving the previous one's output.
+	PreChain  []string `json:"pre_chain"`
+	PostChain []string `json:"post_chain"`
+
+	// Retry overrides -upstream-retries for this rule's upstream requests.
+	Retry *RetryPolicy `json:"retry"`
+
+	// PostIncludeRequest sends the post-transforms the client's original
+	// request beside the response, as {"request": ..., "response": ...}.
+	// Their result is still the new response.
+	PostIncludeRequest bool `json:"post_include_request"`
+
+	// PreHeaders and PostHeaders are sent with each call to the rule's
+	// request and response transforms, e.g. the transform server's own
+	// Authorization. ${VAR} in a value is replaced by that environment
+	// variable.
+	PreHeaders  map[string]string `json:"pre_headers"`
+	PostHeaders map[string]string `json:"post_headers"`
+
+	// PayloadWrap is the envelope the body travels in to and from the
+	// rule's JSON-RPC transforms: "raw" (the default), "input", "messages"
+	// or "positional".
+	PayloadWrap string `json:"payload_wrap"`
+
+	// OnError decides what a failed JSON-RPC transform does: "fail" (the
+	// default) fails the request, "skip" continues with the payload the
+	// transform was given.
+	OnError string `json:"on_error"`
+
+	// MaxConcurrent limits in-flight transform calls for this rule. Excess
+	// calls wait for a slot unless ConcurrencyMode is "reject", in which case
+	// the request fails with 429.
+	MaxConcurrent   int    `json:"max_concurrent"`
+	ConcurrencyMode string `json:"concurrency_mode"`
+
+	// Client overrides timeout, TLS and proxy settings for this rule's
+	// upstream and transform requests.
+	Client *ClientConfig `json:"client"`
+
+	// Shadow is a backend base URL that receives a copy of every forwarded
+	// request. Its responses are discarded.
+	Shadow string `json:"shadow"`
+
+	// ShadowCredentials sends the credential headers to the shadow too.
+	// By default they are dropped, so a shadow never holds upstream keys.
+	ShadowCredentials bool `json:"shadow_credentials"`
+
+	// VersionMap rewrites the API version segment of forwarded paths, e.g.
+	// {"v1": "v2"} sends /v1/chat/completions to /v2/chat/completions.
+	VersionMap map[string]string `json:"version_map"`
+
+	// UpstreamMethod replaces the client's HTTP method on forwarded
+	// requests, e.g. "PUT" for a gateway that does not accept POST.
+	UpstreamMethod string `json:"upstream_method"`
+
+	// Canary sends a percentage of the rule's requests to another backend.
+	Canary *CanaryConfig `json:"canary"`
+
+	// Fanout sends each request to all of these backends instead of the
+	// upstream and answers with their responses merged by backend name.
+	Fanout []FanoutBackend `json:"fanout"`
+
+	// DefaultHeaders are added to forwarded requests that do not already
+	// carry them.
+	DefaultHeaders map[string]string `json:"default_headers"`
+
+	// When gates the rule's transforms on the request body. The request is
+	// still forwarded under this rule when a condition fails, just without
+	// its transforms.
+	When []Condition `json:"when"`
+
+	// StreamTransform is an http(s) endpoint that a streamed response is
+	// piped through: it receives the upstream event stream as its request
+	// body and answers with the event stream the client gets.
+	StreamTransform string `json:"stream_transform"`
+
+	// StreamAggregate runs the post-transforms on the completion assembled from a streamed
+	// response once it has been relayed. The client's stream is unchanged.
+	StreamAggregate bool `json:"stream_aggregate"`
+
+	// StreamCollect reads a streamed response to the end and answers with
+	// the assembled completion as one JSON body, for clients that cannot
+	// read a stream.
+	StreamCollect bool `json:"stream_collect"`
+
+	// StatusMap overrides the status code of non-streamed responses based on
+	// the final response body, e.g. turning a 200 that carries an error
+	// field into a 400.
+	StatusMap []StatusOverride `json:"status_map"`
+
+	// LogLevel overrides the global log level while handling requests
+	// matched by this rule.
+	LogLevel string `json:"log_level"`
+
+	// CacheTTL caches successful GET responses for this long, keyed by
+	// path, query, rule and client credentials, and serves them without
+	// contacting the upstream.
+	CacheTTL Duration `json:"cache_ttl"`
+
+	// ForwardHeaders and DropHeaders replace the global -forward-headers
+	// allowlist and -drop-headers denylist for this rule.
+	ForwardHeaders []string `json:"forward_headers"`
+	DropHeaders    []string `json:"drop_headers"`
+
+	// ResponseForwardHeaders and ResponseDropHeaders replace the global
+	// -response-forward-headers allowlist and -response-drop-headers
+	// denylist for this rule.
+	ResponseForwardHeaders []string `json:"response_forward_headers"`
+	ResponseDropHeaders    []string `json:"response_drop_headers"`
+
+	// Sign adds an HMAC signature over the forwarded body.
+	Sign *SigningConfig `json:"sign"`
+
+	// Sample is run through the rule's transforms at startup by -selftest.
+	Sample *Sample `json:"sample"`
+
+	// RequestSchema is a JSON Schema, inline or as a file path, that the
+	// request body must match after the request transforms.
+	RequestSchema json.RawMessage `json:"request_schema"`
+
+	// Errors replaces the config-wide error mappings for this rule.
+	Errors map[string]ErrorMapping `json:"errors"`
+
+	// Enabled set to false keeps the rule in the config but never selects
+	// it. Unset means enabled.
+	Enabled *bool `json:"enabled"`
+
+	// ContentLength limits the rule to requests whose body size is in this
+	// range, e.g. to send large prompts to a bigger backend.
+	ContentLength *LengthRange `json:"content_length"`
+
+	// Languages limits the rule to requests whose prompt is detected to be
+	// in one of these languages, as ISO 639-1 codes.
+	Languages []string `json:"languages"`
+}
+
+const (
+	concurrencyQueue  = "queue"
+	concurrencyReject = "reject"
+)
+
+const (
+	onErrorFail = "fail"
+	onErrorSkip = "skip"
+)
+
+// transformHeader returns the headers configured for the rule's stage
+// transforms, with environment variables substituted. A variable that is
+// not set is a configuration error rather than an empty credential.
+func (r TransformRule) transformHeader(stage string) (http.Header, error) {
+	values := r.PostHeaders
+	if stage == "pre" {
+		values = r.PreHeaders
+	}
+	header := make(http.Header, len(values))
+	for name, value := range values {
+		var missing string
+		expanded := os.Expand(value, func(key string) string {
+			v, ok := os.LookupEnv(key)
+			if !ok && missing == "" {
+				missing = key
+			}
+			return v
+		})
+		if missing != "" {
+			return nil, fmt.Errorf("%w: %s header %s: $%s is not set", ErrConfig, stage, name, missing)
+		}
+		header.Set(name, expanded)
+	}
+	return header, nil
+}
+
+// upstreamPath returns path with its first segment that VersionMap names
+// replaced by the mapped version.
+func (r TransformRule) upstreamPath(path string) string {
+	if len(r.VersionMap) == 0 {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if version, ok := r.VersionMap[segment]; ok {
+			segments[i] = version
+			return strings.Join(segments, "/")
+		}
+	}
+	return path
+}
+
+// upstreamMethods are the methods upstream_method may name.
+var upstreamMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// upstreamRequest returns the method and body to forward a request made
+// with method and carrying body. Under UpstreamMethod GET or HEAD the body
+// is dropped, as those methods carry none.
+func (r TransformRule) upstreamRequest(method string, body []byte) (string, []byte) {
+	if r.UpstreamMethod == "" {
+		return method, body
+	}
+	if r.UpstreamMethod == http.MethodGet || r.UpstreamMethod == http.MethodHead {
+		return r.UpstreamMethod, nil
+	}
+	return r.UpstreamMethod, body
+}
+
+// enabled reports whether the rule may be selected.
+func (r TransformRule) enabled() bool {
+	return r.Enabled == nil || *r.Enabled
+}
+
+// preChain returns the rule's JSON-RPC request transforms in order.
+func (r TransformRule) preChain() []string {
+	return chain(r.Pre, r.PreChain)
+}
+
+// postChain returns the rule's JSON-RPC response transforms in order.
+func (r TransformRule) postChain() []string {
+	return chain(r.Post, r.PostChain)
+}
+
+func chain(single string, rest []string) []string {
+	if single == "" {
+		return rest
+	}
+	return append([]string{single}, rest...)
+}
+
+// postAppliesTo reports whether the rule's response transforms should run
+// for an upstream response with the given status code. An empty PostOnStatus
+// means they always run.
+func (r TransformRule) postAppliesTo(status int) bool {
+	if len(r.PostOnStatus) == 0 {
+		return true
+	}
+	for _, sr := range r.PostOnStatus {
+		if sr.Contains(status) {
+			return true
+		}
+	}
+	return false
+}
+
+// transformsRequest reports whether any transform applies to the request.
+func (r TransformRule) transformsRequest() bool {
+	return len(r.preChain()) > 0 || isRequestTransform(r.Type)
+}
+
+// transformsResponse reports whether any transform applies to an upstream
+// response with the given status code.
+func (r TransformRule) transformsResponse(status int) bool {
+	return r.postAppliesTo(status) && (len(r.postChain()) > 0 || isResponseTransform(r.Type))
+}
+
+// StatusRange is an inclusive range of HTTP status codes. In config it is
+// written as a single code (404), a class ("4xx") or a range ("500-504").
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+func (s StatusRange) Contains(status int) bool {
+	return status >= s.Min && status <= s.Max
+}
+
+func (s *StatusRange) UnmarshalJSON(data []byte) error {
+	var code int
+	if err := json.Unmarshal(data, &code); err == nil {
+		s.Min, s.Max = code, code
+		return nil
+	}
+
+	var spec string
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("status must be a number or string, got %s", data)
+	}
+	spec = strings.ToLower(strings.TrimSpace(spec))
+
+	if len(spec) == 3 && strings.HasSuffix(spec, "xx") && spec[0] >= '1' && spec[0] <= '5' {
+		class := int(spec[0]-'0') * 100
+		s.Min, s.Max = class, class+99
+		return nil
+	}
+
+	if lo, hi, ok := strings.Cut(spec, "-"); ok {
+		min, err1 := strconv.Atoi(strings.TrimSpace(lo))
+		max, err2 := strconv.Atoi(strings.TrimSpace(hi))
+		if err1 != nil || err2 != nil || min > max {
+			return fmt.Errorf("invalid status range %q", spec)
+		}
+		s.Min, s.Max = min, max
+		return nil
+	}
+
+	code, err := strconv.Atoi(spec)
+	if err != nil {
+		return fmt.Errorf("invalid status %q", spec)
+	}
+	s.Min, s.Max = code, code
+	return nil
+}
+
+// LengthRange is an inclusive range of request body sizes in bytes. A zero
+// Max leaves it unbounded above.
+type LengthRange struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+}
+
+func (b LengthRange) Contains(n int64) bool {
+	return n >= b.Min && (b.Max == 0 || n <= b.Max)
+}
+
+func (b LengthRange) validate() error {
+	if b.Min < 0 || b.Max < 0 {
+		return fmt.Errorf("content_length min and max must not be negative")
+	}
+	if b.Max != 0 && b.Max < b.Min {
+		return fmt.Errorf("content_length max %d is below min %d", b.Max, b.Min)
+	}
+	return nil
+}
+
+// defaultMaxChainSteps bounds the number of JSON-RPC transforms in one
+// rule's pre or post chain.
+const defaultMaxChainSteps = 32
+
+// checkChainSteps rejects a chain of more than max steps. Zero max allows
+// any length.
+func checkChainSteps(stage string, steps, max int) error {
+	if max > 0 && steps > max {
+		return fmt.Errorf("%w: %s chain has %d steps, more than -max-chain-steps %d", errChainTooLong, stage, steps, max)
+	}
+	return nil
+}
+
+// checkChains reports the first rule whose pre or post chain is longer than
+// max steps.
+func (c Config) checkChains(max int) error {
+	for i, rule := range c.Rules {
+		if err := checkChainSteps("pre", len(rule.preChain()), max); err != nil {
+			return fmt.Errorf("%w: rule %d (%s): %w", ErrConfig, i, rule.Tag, err)
+		}
+		if err := checkChainSteps("post", len(rule.postChain()), max); err != nil {
+			return fmt.Errorf("%w: rule %d (%s): %w", ErrConfig, i, rule.Tag, err)
+		}
+	}
+	return nil
+}
+
+type Config struct {
+	Rules []TransformRule `json:"rules"`
+
+	// Errors maps error classes to the message and status clients get,
+	// for rules without their own mapping of that class.
+	Errors map[string]ErrorMapping `json:"errors"`
+}
+
+func (c Config) validate() error {
+	if err := validateErrorMappings(c.Errors); err != nil {
+		return err
+	}
+	for i, rule := range c.Rules {
+		if err := checkTransformType(rule.Type, rule.Params); err != nil {
+			return fmt.Errorf("rule %d (%s): %w", i, rule.Tag, err)
+		}
+		if rule.Client != nil {
+			if err := rule.Client.validate(); err != nil {
+				return fmt.Errorf("rule %d (%s): %w", i, rule.Tag, err)
+			}
+		}
+		if err := validatePayloadWrap(rule.PayloadWrap); err != nil {
+			return fmt.Errorf("rule %d (%s): %w", i, rule.Tag, err)
+		}
+		if rule.OnError != "" && rule.OnError != onErrorFail && rule.OnError != onErrorSkip {
+			return fmt.Errorf("rule %d (%s): unknown on_error %q", i, rule.Tag, rule.OnError)
+		}
+		if rule.ConcurrencyMode != "" && rule.ConcurrencyMode != concurrencyQueue && rule.ConcurrencyMode != concurrencyReject {
+			return fmt.Errorf("rule %d (%s): unknown concurrency_mode %q, want %q or %q", i, rule.Tag, rule.ConcurrencyMode, concurrencyQueue, concurrencyReject)
+		}
+		if rule.StreamTransform != "" {
+			u, err := url.Parse(rule.StreamTransform)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("rule %d (%s): stream_transform must be an http(s) URL, got %q", i, rule.Tag, rule.StreamTransform)
+			}
+		}
+		if rule.StreamAggregate && rule.StreamCollect {
+			return fmt.Errorf("rule %d (%s): stream_aggregate and stream_collect cannot both be set", i, rule.Tag)
+		}
+		if rule.StreamAggregate && len(rule.postChain()) == 0 {
+			return fmt.Errorf("rule %d (%s): stream_aggregate requires post", i, rule.Tag)
+		}
+		for _, c := range rule.When {
+			if err := c.validate(); err != nil {
+				return fmt.Errorf("rule %d (%s): %w", i, rule.Tag, err)
+			}
+		}
+		if rule.LogLevel != "" {
+			if _, err := parseLogLevel(rule.LogLevel); err != nil {
+				return fmt.Errorf("rule %d (%s): %w", i, rule.Tag, err)
+			}
+		}
+		if rule.UpstreamMethod != "" && !slices.Contains(upstreamMethods, rule.UpstreamMethod) {
+			return fmt.Errorf("rule %d (%s): upstream_method must be one of %s, got %q", i, rule.Tag, strings.Join(upstreamMethods, ", "), rule.UpstreamMethod)
+		}
+		for from, to := range rule.VersionMap {
+			if from == "" || to == "" || strings.Contains(from, "/") || strings.Contains(to, "/") {
+				return fmt.Errorf("rule %d (%s): version_map entries must be single path segments, got %q: %q", i, rule.Tag, from, to)
+			}
+		}
+		for _, o := range rule.StatusMap {
+			if err := o.validate(); err != nil {
+				return fmt.Errorf("rule %d (%s): %w", i, rule.Tag, err)
+			}
+		}
+		if err := validateErrorMappings(rule.Errors); err != nil {
+			return fmt.Errorf("rule %d (%s): %w", i, rule.Tag, err)
+		}
+		if rule.Retry != nil {
+			if err := rule.Retry.validate(); err != nil {
+				return fmt.Errorf("rule %d (%s): %w", i, rule.Tag, err)
+			}
+		}
+		if rule.ContentLength != nil {
+			if err := rule.ContentLength.validate(); err != nil {
+				return fmt.Errorf("rule %d (%s): %w", i, rule.Tag, err)
+			}
+		}
+		for _, lang := range rule.Languages {
+			if lang == "" || lang != strings.ToLower(lang) {
+				return fmt.Errorf("rule %d (%s): languages: %q is not a lowercase ISO 639-1 code", i, rule.Tag, lang)
+			}
+		}
+		if rule.Canary != nil {
+			if err := rule.Canary.validate(); err != nil {
+				return fmt.Errorf("rule %d (%s): %w", i, rule.Tag, err)
+			}
+		}
+		if err := validateFanout(rule.Fanout); err != nil {
+			return fmt.Errorf("rule %d (%s): %w", i, rule.Tag, err)
+		}
+		if len(rule.RequestSchema) > 0 {
+			if _, err := compileRequestSchema(rule.RequestSchema); err != nil {
+				return fmt.Errorf("rule %d (%s): %w", i, rule.Tag, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks the config, returning a fatal error for a config llsed
+// cannot run, and otherwise warnings about settings that are likely
+// mistakes but do no harm, such as ones that have no effect.
+func (c Config) Validate() (warnings []string, err error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c.warnings(), nil
+}
+
+func (c Config) warnings() []string {
+	var warnings []string
+	warn := func(i int, rule TransformRule, format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf("rule %d (%s): ", i, rule.Tag)+fmt.Sprintf(format, args...))
+	}
+	firstWithTag := make(map[string]int)
+	for i, rule := range c.Rules {
+		if first, ok := firstWithTag[rule.Tag]; ok {
+			warn(i, rule, "tag is also used by rule %d, which forcing the tag always selects", first)
+		} else {
+			firstWithTag[rule.Tag] = i
+		}
+		respond := len(rule.postChain()) > 0 || isResponseTransform(rule.Type) || rule.StreamTransform != ""
+		if len(rule.PostOnStatus) > 0 && !respond {
+			warn(i, rule, "post_on_status has no effect without a response transform")
+		}
+		if len(rule.PreHeaders) > 0 && len(rule.preChain()) == 0 {
+			warn(i, rule, "pre_headers has no effect without pre or pre_chain")
+		}
+		if len(rule.PostHeaders) > 0 && len(rule.postChain()) == 0 && rule.StreamTransform == "" {
+			warn(i, rule, "post_headers has no effect without post, post_chain or stream_transform")
+		}
+		if rule.MaxConcurrent > 0 && len(rule.preChain())+len(rule.postChain()) == 0 {
+			warn(i, rule, "max_concurrent has no effect without JSON-RPC transforms")
+		}
+	}
+	return warnings
+}
+
+type JSONRPCRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+	ID      int         `json:"id"`
+}
+
+type JSONRPCResponse struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Result  interface{} `json:"result"`
+	Error   interface{} `json:"error"`
+	ID      int         `json:"id"`
+}
+
+// defaultMaxTransformBytes bounds how much of a transform server response is
+// read into memory.
+const defaultMaxTransformBytes = 10 << 20
+
+type LLMSed struct {
+	// config is swapped as a whole on reload; handlers load it once per
+	// request.
+	config            atomic.Pointer[Config]
+	configPath        string
+	serverURL         string
+	httpClient        *http.Client
+	maxTransformBytes int64
+	ruleLimits        ruleLimiter
+	clients           clientCache
+	grpcConns         grpcConns
+	cache             responseCache
+	metrics           *metrics
+	inFlight          atomic.Int64
+	// draining makes /readyz fail, so load balancers stop sending new
+	// requests, while requests are still served.
+	draining atomic.Bool
+
+	// ruleOverrideParam names a query parameter that forces a rule by tag.
+	// Empty disables overrides.
+	ruleOverrideParam string
+
+	// streamIdleTimeout and streamTimeout bound streamed responses; zero
+	// disables each.
+	streamIdleTimeout time.Duration
+	streamTimeout     time.Duration
+
+	// postStreamTimeout bounds the post-transforms run on an assembled
+	// stream; postStreams tracks them so shutdown can wait for them.
+	postStreamTimeout time.Duration
+	postStreams       sync.WaitGroup
+
+	// jsonOutput is the JSON output mode for forwarded and returned bodies.
+	jsonOutput string
+
+	// trustedProxies are peers whose forwarding headers identify the client.
+	trustedProxies []netip.Prefix
+
+	// maxConnsPerIP bounds the connections one client IP may hold open, or
+	// its requests in progress behind a trusted proxy. Zero disables it.
+	maxConnsPerIP int
+	conns         connLimiter
+
+	// debugClients are the client addresses that get full error messages
+	// and debug headers. Once set, every other client gets sanitized errors.
+	debugClients []netip.Prefix
+
+	// recordDir and replayDir hold cassettes: recorded request and
+	// response pairs, which are replayed instead of proxying. Responses
+	// larger than recordMaxBytes are not recorded.
+	recordDir      string
+	replayDir      string
+	recordMaxBytes int
+
+	// rootAction and rootTarget decide what a request to "/" gets; see
+	// rootHandler.
+	rootAction string
+	rootTarget string
+
+	// tokenBudget is how many tokens each client, told apart by its
+	// tokenBudgetHeader value, may use per period before its requests are
+	// refused with 429. Zero disables budgets.
+	tokenBudget       int64
+	tokenBudgetHeader string
+	budgets           tokenBudgets
+
+	// logUnrouted logs requests that no specific rule matched.
+	logUnrouted bool
+
+	// logSummary logs one summary line per proxied request.
+	logSummary bool
+
+	// echoPath, when set, runs the request transforms and returns
+	// diagnostics instead of forwarding.
+	echoPath string
+
+	// sla bounds the total handling time of a non-streamed request,
+	// transforms included. Zero disables it.
+	sla time.Duration
+
+	// upstreamRetries is how many more times a request is sent when the
+	// upstream cannot be reached or answers 502, 503 or 504.
+	upstreamRetries int
+
+	// maxBodyBytes bounds incoming request bodies, and the transformed
+	// bodies kept to resend on a retry. Zero disables it.
+	maxBodyBytes int64
+
+	shadowTimeout     time.Duration
+	maxShadowRequests int
+	shadowInFlight    atomic.Int64
+
+	// adminToken guards the /admin endpoints. Empty disables them.
+	adminToken string
+
+	// adminAddr, when set, moves the internal endpoints off the proxy
+	// listener onto their own.
+	adminAddr string
+
+	// forwardHeaders, when non-nil, is the allowlist of incoming headers
+	// sent upstream; dropHeaders are never sent. Rules may override both.
+	forwardHeaders []string
+	dropHeaders    []string
+
+	// apiKeyFile holds the upstream API key, re-read as it rotates.
+	// apiKey, once loaded, replaces the Authorization header of forwarded
+	// requests.
+	apiKeyFile string
+	apiKey     atomic.Pointer[string]
+
+	// responseForwardHeaders and responseDropHeaders do the same for
+	// upstream response headers sent to the client.
+	responseForwardHeaders []string
+	responseDropHeaders    []string
+	// singletonHeaders are the response headers sent with only their
+	// first value; every other header keeps all of its values.
+	singletonHeaders []string
+
+	// transformSlots, when non-nil, bounds transform calls in flight across
+	// all rules; a call waits up to transformQueueTimeout for a slot.
+	transformSlots        chan struct{}
+	transformQueueTimeout time.Duration
+
+	// maxChainSteps bounds the length of each pre and post chain; zero
+	// allows any length.
+	maxChainSteps int
+
+	// scriptDir is the -script-dir that script transforms load their
+	// Starlark files from.
+	scriptDir string
+
+	// timeouts are applied to the incoming server.
+	timeouts serverTimeouts
+	// writeDeadlineFailed logs, once, a response writer that cannot have
+	// its write deadline extended.
+	writeDeadlineFailed sync.Once
+
+	// tlsConfig, when set, makes the proxy listener serve HTTPS.
+	tlsConfig *tls.Config
+
+	// maxHeaderBytes bounds the size of incoming request headers.
+	maxHeaderBytes int
+
+	// compressMinBytes is the smallest final body gzipped for clients that
+	// accept it. Zero disables compression.
+	compressMinBytes int
+
+	// preserveTrailers copies upstream response trailers to the client.
+	preserveTrailers bool
+
+	// devMode honors the X-LLMSed-Pre/X-LLMSed-Post override headers.
+	devMode bool
+
+	// signingSecret is the HMAC secret for rules that sign requests without
+	// naming their own secret variable.
+	signingSecret string
+
+	// capture, when set, receives a trace line per proxied request.
+	capture *capture
+
+	// logLevel is the threshold for request log lines; a rule's LogLevel
+	// overrides it for the requests it matches.
+	logLevel logLevel
+}
+
+func NewLLMSed(configPath, serverURL string) (*LLMSed, error) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	l := newLLMSed(config, serverURL)
+	l.configPath = configPath
+	return l, nil
+}
+
+// configFetchTimeout bounds fetching a config served over HTTP.
+const configFetchTimeout = 10 * time.Second
+
+// loadConfig reads and validates the config at path, which is a file or an
+// http(s):// URL.
+func loadConfig(path string) (Config, error) {
+	data, err := readConfig(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("%w: failed to read config: %w", ErrConfig, err)
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("%w: failed to parse config: %w", ErrConfig, err)
+	}
+	warnings, err := config.Validate()
+	if err != nil {
+		return Config{}, fmt.Errorf("%w: %w", ErrConfig, err)
+	}
+	for _, w := range warnings {
+		log.Printf("Config warning: %s", w)
+	}
+	return config, nil
+}
+
+func readConfig(path string) ([]byte, error) {
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		return os.ReadFile(path)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), configFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func newLLMSed(config Config, serverURL string) *LLMSed {
+	l := &LLMSed{
+		serverURL:             serverURL,
+		httpClient:            &http.Client{Transport: newTransport(transportOptions{})},
+		maxTransformBytes:     defaultMaxTransformBytes,
+		streamIdleTimeout:     defaultStreamIdleTimeout,
+		postStreamTimeout:     defaultPostStreamTimeout,
+		jsonOutput:            jsonMinify,
+		shadowTimeout:         defaultShadowTimeout,
+		recordMaxBytes:        defaultRecordMaxBytes,
+		maxShadowRequests:     defaultMaxShadowRequests,
+		logLevel:              levelInfo,
+		maxHeaderBytes:        http.DefaultMaxHeaderBytes,
+		maxChainSteps:         defaultMaxChainSteps,
+		transformQueueTimeout: defaultTransformQueueTimeout,
+		tokenBudgetHeader:     defaultTokenBudgetHeader,
+		singletonHeaders:      headerList(defaultSingletonHeaders),
+		timeouts:              serverTimeouts{readHeader: defaultReadHeaderTimeout},
+		cache:                 responseCache{maxEntries: defaultCacheMaxEntries},
+	}
+	l.config.Store(&config)
+	l.metrics = newMetrics(l)
+	return l
+}
+
+func (l *LLMSed) callRPC(ctx context.Context, client *http.Client, endpoint string, header http.Header, payload interface{}) (interface{}, error) {
+	if isGRPCEndpoint(endpoint) {
+		return l.callGRPC(ctx, client, endpoint, header, payload)
+	}
+	rpcReq := JSONRPCRequest{
+		JSONRPC: "2.0",
+		Method:  "transform",
+		Params:  rpcParams(ctx, payload),
+		ID:      1,
+	}
+
+	body, err := json.Marshal(rpcReq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Read one byte past the limit so an oversized response can be told
+	// apart from one that is exactly at the limit.
+	var reader io.Reader = resp.Body
+	if l.maxTransformBytes > 0 {
+		reader = io.LimitReader(resp.Body, l.maxTransformBytes+1)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if l.maxTransformBytes > 0 && int64(len(data)) > l.maxTransformBytes {
+		return nil, fmt.Errorf("transform response from %s exceeds %d bytes", endpoint, l.maxTransformBytes)
+	}
+
+	var rpcResp JSONRPCResponse
+	if err := decodeJSON(data, &rpcResp); err != nil {
+		return nil, err
+	}
+
+	if rpcResp.Error != nil {
+		return nil, fmt.Errorf("rpc error: %v", rpcResp.Error)
+	}
+
+	if object, ok := rpcResp.Result.(map[string]interface{}); ok {
+		delete(object, reservedParam)
+	}
+	return rpcResp.Result, nil
+}
+
+// selectRule picks the rule that handles r. When rule overrides are enabled
+// and r names a rule in the override query parameter, that rule is used.
+func (l *LLMSed) selectRule(r *http.Request) (TransformRule, error) {
+	rules := l.config.Load().Rules
+	if l.ruleOverrideParam != "" {
+		if tag := r.URL.Query().Get(l.ruleOverrideParam); tag != "" {
+			for _, rule := range rules {
+				if rule.Tag == tag && rule.enabled() {
+					return rule, nil
+				}
+			}
+			return TransformRule{}, fmt.Errorf("%w: %q", errUnknownRule, tag)
+		}
+	}
+
+	// The first enabled rule that takes the request's size and language
+	// wins.
+	if len(rules) == 0 {
+		return TransformRule{}, fmt.Errorf("%w: no transformation rules configured", ErrConfig)
+	}
+	lang, detected := languageFrom(r.Context())
+	unmatched := false
+	for _, rule := range rules {
+		if !rule.enabled() {
+			continue
+		}
+		if rule.matchesLength(r.ContentLength) && rule.matchesLanguage(lang) {
+			return rule, nil
+		}
+		unmatched = true
+	}
+	if unmatched && detected {
+		return TransformRule{}, fmt.Errorf("%w: no transformation rule takes a %d-byte request in language %q", ErrConfig, r.ContentLength, lang)
+	}
+	if unmatched {
+		return TransformRule{}, fmt.Errorf("%w: no transformation rule takes a %d-byte request", ErrConfig, r.ContentLength)
+	}
+	return TransformRule{}, fmt.Errorf("%w: every transformation rule is disabled", ErrConfig)
+}
+
+// selective reports whether the rule only takes some requests, by their
+// size or language, so that selecting it is a match rather than a fall
+// through to the first enabled rule.
+func (r TransformRule) selective() bool {
+	return r.ContentLength != nil || len(r.Languages) > 0
+}
+
+// matchesLength reports whether the rule takes a request body of n bytes.
+// An unknown length (-1) only matches rules without content_length.
+func (r TransformRule) matchesLength(n int64) bool {
+	if r.ContentLength == nil {
+		return true
+	}
+	return n >= 0 && r.ContentLength.Contains(n)
+}
+
+// Reasons a request went unrouted, the "reason" label of
+// llsed_unrouted_requests_total.
+const (
+	// unroutedDefault: no rule was asked for or matched the request's size
+	// or language, so the first enabled rule took it.
+	unroutedDefault = "default"
+	// unroutedNone: no rule could take the request, or its rule's
+	// conditions did not hold, so it was not transformed.
+	unroutedNone = "none"
+)
+
+// ruleRequested reports whether r names its rule with the
+// -rule-override-param query parameter.
+func (l *LLMSed) ruleRequested(r *http.Request) bool {
+	return l.ruleOverrideParam != "" && r.URL.Query().Get(l.ruleOverrideParam) != ""
+}
+
+// noteUnrouted counts a request that no specific rule matched and, with
+// -log-unrouted, logs its path and model to help fill gaps in the config.
+func (l *LLMSed) noteUnrouted(r *http.Request, reason, rule string, payload map[string]interface{}) {
+	l.metrics.unrouted.WithLabelValues(reason).Inc()
+	if !l.logUnrouted {
+		return
+	}
+	model, _ := payload["model"].(string)
+	l.logf(r.Context(), levelInfo, "Unrouted request (%s, rule %q): %s %s model=%q", reason, rule, r.Method, r.URL.Path, model)
+}
+
+// Dev-mode headers that replace the matched rule's pre- and post-transform
+// endpoints for one request.
+const (
+	headerPreOverride  = "X-LLMSed-Pre"
+	headerPostOverride = "X-LLMSed-Post"
+)
+
+// applyOverrides replaces rule's Pre and Post with the endpoints named by the
+// override headers. Headers are ignored unless dev mode is on.
+func (l *LLMSed) applyOverrides(r *http.Request, rule TransformRule) (TransformRule, error) {
+	if !l.devMode {
+		return rule, nil
+	}
+	for _, o := range []struct {
+		header string
+		field  *string
+	}{{headerPreOverride, &rule.Pre}, {headerPostOverride, &rule.Post}} {
+		endpoint := r.Header.Get(o.header)
+		if endpoint == "" {
+			continue
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return TransformRule{}, fmt.Errorf("%w: %s must be an http(s) URL, got %q", errBadOverride, o.header, endpoint)
+		}
+		*o.field = endpoint
+	}
+	return rule, nil
+}
+
+// runChain applies the JSON-RPC transforms in endpoints in order, feeding
+// each the previous one's output. The payload stays decoded between steps:
+// it is only encoded for each JSON-RPC call, and once by the caller for the
+// client. A failure in a chain of several transforms records its 1-based
+// position; with OnError "skip" the failing transform is passed over
+// instead.
+func (l *LLMSed) runChain(ctx context.Context, rule TransformRule, stage string, endpoints []string, payload map[string]interface{}) (map[string]interface{}, error) {
+	if err := checkChainSteps(stage, len(endpoints), l.maxChainSteps); err != nil {
+		return nil, err
+	}
+	for i, endpoint := range endpoints {
+		out, err := traced(ctx, stage, endpoint, payload, func(p map[string]interface{}) (map[string]interface{}, error) {
+			return l.runTransform(ctx, rule, stage, endpoint, p)
+		})
+		if err != nil {
+			var transformErr *TransformError
+			if errors.As(err, &transformErr) && len(endpoints) > 1 {
+				transformErr.Index = i + 1
+			}
+			if rule.OnError == onErrorSkip && ctx.Err() == nil && !errors.Is(err, errRuleBusy) && !errors.Is(err, errTransformsSaturated) {
+				l.logf(ctx, levelWarn, "Skipping failed transform: %v", err)
+				continue
+			}
+			return nil, err
+		}
+		payload = out
+	}
+	return payload, nil
+}
+
+// runTransform calls a rule's transform endpoint, honoring the rule's
+// concurrency limit. The result must be a JSON object.
+func (l *LLMSed) runTransform(ctx context.Context, rule TransformRule, stage, endpoint string, payload map[string]interface{}) (map[string]interface{}, error) {
+	l.logf(ctx, levelInfo, "Calling %s-transform: %s", stage, endpoint)
+	client, err := l.clientFor(rule)
+	if err != nil {
+		return nil, &TransformError{Stage: stage, Endpoint: endpoint, Err: err}
+	}
+	start := time.Now()
+	release, err := l.ruleLimits.acquire(ctx, rule)
+	if rule.MaxConcurrent > 0 {
+		l.metrics.ruleQueueWait.WithLabelValues(rule.Tag).Observe(time.Since(start).Seconds())
+	}
+	if err != nil {
+		return nil, &TransformError{Stage: stage, Endpoint: endpoint, Err: err}
+	}
+	defer release()
+	releaseSlot, err := l.acquireTransformSlot(ctx)
+	if err != nil {
+		return nil, &TransformError{Stage: stage, Endpoint: endpoint, Err: err}
+	}
+	defer releaseSlot()
+
+	header, err := rule.transformHeader(stage)
+	if err != nil {
+		return nil, &TransformError{Stage: stage, Endpoint: endpoint, Err: err}
+	}
+	params := wrapPayload(rule.PayloadWrap, payload)
+	if stage == "post" {
+		params = postParams(ctx, rule, payload)
+	}
+	result, err := l.callRPC(ctx, client, endpoint, header, params)
+	if err != nil {
+		return nil, &TransformError{Stage: stage, Endpoint: endpoint, Err: err}
+	}
+	object, err := unwrapResult(rule.PayloadWrap, payload, result)
+	if err != nil {
+		return nil, &TransformError{Stage: stage, Endpoint: endpoint, Err: err}
+	}
+	return object, nil
+}
+
+// transformRequest applies the rule's built-in request transform and then its
+// pre-transform to the incoming request body.
+func (l *LLMSed) transformRequest(ctx context.Context, rule TransformRule, payload map[string]interface{}) (map[string]interface{}, error) {
+	if rule.Type == transformNoop {
+		l.logf(ctx, levelInfo, "noop transform ran for rule %q", rule.Tag)
+	}
+	if isRequestTransform(rule.Type) {
+		var err error
+		payload, err = traced(ctx, "pre", rule.Type, payload, func(p map[string]interface{}) (map[string]interface{}, error) {
+			return applyRequestTransform(l.scriptDir, rule, p)
+		})
+		if err != nil {
+			return nil, &TransformError{Stage: "pre", Endpoint: rule.Type, Err: err}
+		}
+	}
+
+	return l.runChain(ctx, rule, "pre", rule.preChain(), payload)
+}
+
+// transformResponse applies the rule's post-transform and then its built-in
+// response transform to the upstream response body when the upstream status
+// calls for it.
+func (l *LLMSed) transformResponse(ctx context.Context, rule TransformRule, status int, payload map[string]interface{}) (map[string]interface{}, error) {
+	if !rule.postAppliesTo(status) {
+		return payload, nil
+	}
+
+	payload, err := l.runChain(ctx, rule, "post", rule.postChain(), payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if isResponseTransform(rule.Type) {
+		payload, err = traced(ctx, "post", rule.Type, payload, func(p map[string]interface{}) (map[string]interface{}, error) {
+			return applyResponseTransform(l.scriptDir, rule, p)
+		})
+		if err != nil {
+			return nil, &TransformError{Stage: "post", Endpoint: rule.Type, Err: err}
+		}
+	}
+	return payload, nil
+}
+
+// upstreamHeader returns the headers to send upstream for r under rule.
+func (l *LLMSed) upstreamHeader(r *http.Request, rule TransformRule) http.Header {
+	header := r.Header.Clone()
+	// The body may be rewritten, so the transport sets its own framing.
+	removeHopHeaders(header)
+	header.Del("Content-Length")
+	// Left to the transport, which then asks for gzip and decodes it, so
+	// response transforms always see a plain body.
+	header.Del("Accept-Encoding")
+	header.Del(headerPreOverride)
+	header.Del(headerPostOverride)
+	if lang, ok := languageFrom(r.Context()); ok {
+		header.Del(headerLanguage)
+		if lang != "" {
+			header.Set(headerLanguage, lang)
+		}
+	}
+
+	allow, drop := l.forwardHeaders, l.dropHeaders
+	if rule.ForwardHeaders != nil {
+		allow = rule.ForwardHeaders
+	}
+	if rule.DropHeaders != nil {
+		drop = rule.DropHeaders
+	}
+	filterHeader(header, allow, drop)
+	if key := l.apiKey.Load(); key != nil {
+		header.Set("Authorization", "Bearer "+*key)
+	}
+	for key, value := range rule.DefaultHeaders {
+		if header.Get(key) == "" {
+			header.Set(key, value)
+		}
+	}
+	return header
+}
+
+// clientHeader returns the upstream response headers to send to the client
+// under rule.
+func (l *LLMSed) clientHeader(rule TransformRule, src http.Header) http.Header {
+	header := src.Clone()
+	removeHopHeaders(header)
+	allow, drop := l.responseForwardHeaders, l.responseDropHeaders
+	if rule.ResponseForwardHeaders != nil {
+		allow = rule.ResponseForwardHeaders
+	}
+	if rule.ResponseDropHeaders != nil {
+		drop = rule.ResponseDropHeaders
+	}
+	filterHeader(header, allow, drop)
+	return header
+}
+
+// filterHeader deletes from header every name not in allow, unless allow is
+// nil, and then every name in drop.
+func filterHeader(header http.Header, allow, drop []string) {
+	if allow != nil {
+		allowed := make(map[string]bool, len(allow))
+		for _, name := range allow {
+			allowed[http.CanonicalHeaderKey(name)] = true
+		}
+		for name := range header {
+			if !allowed[name] {
+				delete(header, name)
+			}
+		}
+	}
+	for _, name := range drop {
+		header.Del(name)
+	}
 }
 
-type Config struct {
-	Rules []TransformRule `json:"rules"`
-}
+// forward sends the transformed request body to the upstream server, using
+// the incoming request's method and path.
+func (l *LLMSed) forward(client *http.Client, r *http.Request, rule TransformRule, targetBody []byte) (*http.Response, error) {
+	targetURL := l.upstreamBase(r, rule) + rule.upstreamPath(r.URL.Path)
+	l.logf(r.Context(), levelInfo, "Forwarding %s to: %s", l.clientIP(r), targetURL)
 
-type JSONRPCRequest struct {
-	JSONRPC string      `json:"jsonrpc"`
-	Method  string      `json:"method"`
-	Params  interface{} `json:"params"`
-	ID      int         `json:"id"`
+	method, targetBody := rule.upstreamRequest(r.Method, targetBody)
+	targetReq, err := http.NewRequestWithContext(r.Context(), method, targetURL, bytes.NewReader(targetBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create target request: %w", err)
+	}
+
+	targetReq.Header = l.upstreamHeader(r, rule)
+	if rule.Sign != nil {
+		if err := l.sign(targetReq, rule.Sign, targetBody); err != nil {
+			return nil, err
+		}
+	}
+
+	policy := l.retryPolicy(rule)
+	if l.maxBodyBytes > 0 && int64(len(targetBody)) > l.maxBodyBytes {
+		// Transforms grew the body past the cap; it is sent only once.
+		policy.MaxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		targetResp, err := client.Do(targetReq)
+		if attempt >= policy.MaxAttempts || !policy.retryable(targetResp, err) || r.Context().Err() != nil {
+			if err != nil {
+				return nil, &UpstreamError{Err: err}
+			}
+			return targetResp, nil
+		}
+		if err != nil {
+			l.logf(r.Context(), levelWarn, "Upstream attempt %d failed, retrying: %v", attempt, err)
+		} else {
+			l.logf(r.Context(), levelWarn, "Upstream attempt %d answered %d, retrying", attempt, targetResp.StatusCode)
+			targetResp.Body.Close()
+		}
+		if !policy.wait(r.Context(), attempt) {
+			return nil, &UpstreamError{Err: r.Context().Err()}
+		}
+		// The body reader was consumed by the failed attempt.
+		if targetReq.Body, err = targetReq.GetBody(); err != nil {
+			return nil, fmt.Errorf("failed to replay request body: %w", err)
+		}
+	}
 }
 
-type JSONRPCResponse struct {
-	JSONRPC string      `json:"jsonrpc"`
-	Result  interface{} `json:"result"`
-	Error   interface{} `json:"error"`
-	ID      int         `json:"id"`
+// decodeJSON is json.Unmarshal with numbers decoded as json.Number, so
+// integers too large for a float64 survive being re-encoded.
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level JSON value")
+	}
+	return nil
 }
 
-type LLMSed struct {
-	config     Config
-	serverURL  string
-	httpClient *http.Client
+// hopHeaders apply to a single connection and are never relayed between the
+// client and the upstream.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
 }
 
-func NewLLMSed(configPath, serverURL string) (*LLMSed, error) {
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read config: %w", err)
+// removeHopHeaders deletes hop-by-hop headers from h, including any named by
+// its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, field := range h.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
 	}
+}
 
-	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %w", err)
+// copyTrailers sends the upstream response's trailers to the client when
+// -preserve-trailers is set. Trailer values are only known once the body
+// has been read to the end, so it is called once the body is consumed.
+func (l *LLMSed) copyTrailers(w http.ResponseWriter, resp *http.Response) {
+	if !l.preserveTrailers {
+		return
 	}
+	trailer := resp.Trailer.Clone()
+	removeHopHeaders(trailer)
+	trailer.Del("Content-Length")
+	for key, values := range trailer {
+		for _, value := range values {
+			w.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+}
 
-	return &LLMSed{
-		config:     config,
-		serverURL:  serverURL,
-		httpClient: &http.Client{},
-	}, nil
+// headerList splits a comma-separated list of header names. It returns nil
+// for an empty list.
+func headerList(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
 }
 
-func (l *LLMSed) callRPC(endpoint string, payload interface{}) (interface{}, error) {
-	rpcReq := JSONRPCRequest{
-		JSONRPC: "2.0",
-		Method:  "transform",
-		Params:  payload,
-		ID:      1,
+// defaultSingletonHeaders is the -singleton-headers default: response
+// headers that may only have one value.
+const defaultSingletonHeaders = "Content-Type,Content-Length,Content-Location,Content-Range,Location,Retry-After,ETag,Last-Modified,Date,Expires,Age"
+
+// copyHeader copies every end-to-end header in src to dst, adding to the
+// values dst already has. A header in singletons is instead set to its first
+// value in src, replacing dst's, so a client never sees two Content-Types.
+// Framing such as Transfer-Encoding is left to the server writing dst.
+func copyHeader(dst, src http.Header, singletons []string) {
+	src = src.Clone()
+	removeHopHeaders(src)
+	for key, values := range src {
+		if len(values) == 0 {
+			continue
+		}
+		if slices.Contains(singletons, http.CanonicalHeaderKey(key)) {
+			dst.Set(key, values[0])
+			continue
+		}
+		for _, value := range values {
+			dst.Add(key, value)
+		}
 	}
+}
 
-	body, err := json.Marshal(rpcReq)
+// readResponse reads the upstream's JSON response body, returning both the
+// raw bytes and the decoded object.
+func readResponse(resp *http.Response) ([]byte, map[string]interface{}, error) {
+	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, &UpstreamError{Status: resp.StatusCode, Err: fmt.Errorf("failed to read response: %w", err)}
 	}
 
-	resp, err := l.httpClient.Post(endpoint, "application/json", bytes.NewReader(body))
-	if err != nil {
-		return nil, err
+	if isEmptyBody(responseBody) {
+		return responseBody, nil, nil
 	}
-	defer resp.Body.Close()
+	var responsePayload map[string]interface{}
+	if err := decodeJSON(responseBody, &responsePayload); err != nil {
+		return nil, nil, &UpstreamError{Status: resp.StatusCode, Err: fmt.Errorf("invalid response from target: %w", err)}
+	}
+	return responseBody, responsePayload, nil
+}
 
-	var rpcResp JSONRPCResponse
-	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
-		return nil, err
+// isEmptyBody reports whether an upstream body has nothing to decode, as
+// with a 204 No Content.
+func isEmptyBody(body []byte) bool {
+	return len(bytes.TrimSpace(body)) == 0
+}
+
+// finishReason returns why a completion stopped, read from an OpenAI
+// (choices[0].finish_reason) or Anthropic (stop_reason) response body.
+func finishReason(payload map[string]interface{}) string {
+	if choices, ok := payload["choices"].([]interface{}); ok && len(choices) > 0 {
+		if choice, ok := choices[0].(map[string]interface{}); ok {
+			if reason, ok := choice["finish_reason"].(string); ok {
+				return reason
+			}
+		}
 	}
+	reason, _ := payload["stop_reason"].(string)
+	return reason
+}
 
-	if rpcResp.Error != nil {
-		return nil, fmt.Errorf("rpc error: %v", rpcResp.Error)
+// JSON output modes for re-encoding request and response bodies.
+const (
+	jsonMinify   = "minify"
+	jsonPretty   = "pretty"
+	jsonPreserve = "preserve"
+)
+
+func checkJSONOutput(mode string) error {
+	switch mode {
+	case jsonMinify, jsonPretty, jsonPreserve:
+		return nil
+	default:
+		return fmt.Errorf("unknown JSON output mode %q (want minify, pretty or preserve)", mode)
 	}
+}
 
-	return rpcResp.Result, nil
+// encodeBody re-encodes payload according to the JSON output mode. In
+// preserve mode a body no transform applied to is returned as original,
+// byte for byte.
+func (l *LLMSed) encodeBody(payload map[string]interface{}, original []byte, transformed bool) ([]byte, error) {
+	switch l.jsonOutput {
+	case jsonPretty:
+		return json.MarshalIndent(payload, "", "  ")
+	case jsonPreserve:
+		if !transformed {
+			return original, nil
+		}
+	}
+	return json.Marshal(payload)
 }
 
-func (l *LLMSed) handleProxy(w http.ResponseWriter, r *http.Request) {
-	// Read incoming request
+// readBody reads r's body, at most maxBodyBytes of it, and answers a 413 or
+// 400 itself when it cannot. Middleware that reads the body before the proxy
+// does uses it too, so the limit holds for every copy.
+func (l *LLMSed) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if l.maxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, l.maxBodyBytes)
+	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
 		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+func (l *LLMSed) handleProxy(w http.ResponseWriter, r *http.Request) {
+	// The SLA bounds everything from here to the final response, including
+	// transforms. It is lifted once a streamed response starts.
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	var sla *time.Timer
+	if l.sla > 0 {
+		sla = time.AfterFunc(l.sla, func() { cancel(errSLAExceeded) })
+		defer sla.Stop()
+	}
+	r = r.WithContext(withCorrelationID(ctx))
+	var summary *requestSummary
+	if l.logSummary {
+		// A capture may already be tracing the request; its trace serves.
+		t := traceFrom(r.Context())
+		if t == nil {
+			t = &requestTrace{}
+			r = r.WithContext(withTrace(r.Context(), t))
+		}
+		summary = &requestSummary{start: time.Now()}
+		defer logSummary(r, t, summary)
+	}
+	var rule TransformRule
+	fail := func(err error) {
+		if errors.Is(context.Cause(ctx), errSLAExceeded) {
+			err = fmt.Errorf("%w: no complete response within %s", errSLAExceeded, l.sla)
+		}
+		if l.debugClient(r) {
+			writeError(w, err)
+			return
+		}
+		writeError(w, l.clientError(r.Context(), rule, err))
+	}
+	if retryAfter, err := l.checkBudget(r); err != nil {
+		l.logf(r.Context(), levelInfo, "Refusing request: %v", err)
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		}
+		fail(err)
+		return
+	}
+
+	// Read incoming request
+	body, ok := l.readBody(w, r)
+	if !ok {
 		return
 	}
 	defer r.Body.Close()
+	// A chunked request declares no length; now that its body has been
+	// read, rules are matched on the size it turned out to be.
+	if r.ContentLength < 0 {
+		r.ContentLength = int64(len(body))
+	}
 
+	// Requests such as GET /v1/models carry no body and are forwarded
+	// without request transforms.
 	var payload map[string]interface{}
-	if err := json.Unmarshal(body, &payload); err != nil {
-		http.Error(w, "invalid json", http.StatusBadRequest)
+	if len(body) > 0 {
+		if err := decodeJSON(body, &payload); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+	}
+	if l.config.Load().detectsLanguage() {
+		lang := identifyLanguage(promptText(payload))
+		r = r.WithContext(withLanguage(r.Context(), lang))
+		if lang != "" {
+			w.Header().Set(headerLanguage, lang)
+		}
+	}
+
+	rule, err := l.selectRule(r)
+	if errors.Is(err, ErrConfig) {
+		l.noteUnrouted(r, unroutedNone, "", payload)
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	rule, err = l.applyOverrides(r, rule)
+	if err != nil {
+		fail(err)
 		return
 	}
+	if t := traceFrom(r.Context()); t != nil {
+		t.setRule(rule.Tag)
+	}
+	if l.debugClient(r) {
+		w.Header().Set(headerRule, rule.Tag)
+		w.Header().Set(headerCorrelationID, correlationID(r.Context()))
+	}
+	if rule.LogLevel != "" {
+		lv, _ := parseLogLevel(rule.LogLevel)
+		r = r.WithContext(withLogLevel(r.Context(), lv))
+	}
+	if rule.PostIncludeRequest && payload != nil {
+		// Decoded afresh, since request transforms may change payload in place.
+		var original map[string]interface{}
+		if err := decodeJSON(body, &original); err == nil {
+			r = r.WithContext(withOriginalRequest(r.Context(), original))
+		}
+	}
+	l.logf(r.Context(), levelDebug, "Rule %s matched %s %s (%d bytes)", rule.Tag, r.Method, r.URL.Path, len(body))
+	if !rule.transformsApply(payload) {
+		l.logf(r.Context(), levelDebug, "Rule %s conditions not met, skipping its transforms", rule.Tag)
+		l.noteUnrouted(r, unroutedNone, rule.Tag, payload)
+		rule = rule.withoutTransforms()
+	} else if !l.ruleRequested(r) && !rule.selective() {
+		l.noteUnrouted(r, unroutedDefault, rule.Tag, payload)
+	}
 
-	// Find matching rule (simple: just use first rule for now)
-	if len(l.config.Rules) == 0 {
-		http.Error(w, "no transformation rules configured", http.StatusInternalServerError)
+	if l.echoPath != "" && r.URL.Path == l.echoPath {
+		l.echo(w, r, rule, payload, len(body))
 		return
 	}
-	rule := l.config.Rules[0]
 
-	// Pre-transform
-	if rule.Pre != "" {
-		log.Printf("Calling pre-transform: %s", rule.Pre)
-		result, err := l.callRPC(rule.Pre, payload)
+	cacheKey, cacheable := l.cacheKey(r, rule)
+	if cacheable {
+		if l.serveCached(w, cacheKey) {
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	var targetBody []byte
+	if payload != nil {
+		payload, err = l.transformRequest(r.Context(), rule, payload)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("pre-transform failed: %v", err), http.StatusInternalServerError)
+			fail(err)
+			return
+		}
+		if err := validateRequestSchema(rule, payload); err != nil {
+			fail(err)
+			return
+		}
+
+		targetBody, err = l.encodeBody(payload, body, rule.transformsRequest())
+		if err != nil {
+			http.Error(w, "failed to marshal transformed request", http.StatusInternalServerError)
 			return
 		}
-		payload = result.(map[string]interface{})
 	}
 
-	// Forward to target server
-	targetBody, err := json.Marshal(payload)
+	client, err := l.clientFor(rule)
 	if err != nil {
-		http.Error(w, "failed to marshal transformed request", http.StatusInternalServerError)
+		fail(err)
 		return
 	}
 
-	targetURL := l.serverURL + r.URL.Path
-	log.Printf("Forwarding to: %s", targetURL)
-
-	targetReq, err := http.NewRequest(r.Method, targetURL, bytes.NewReader(targetBody))
-	if err != nil {
-		http.Error(w, "failed to create target request", http.StatusInternalServerError)
-		return
+	if rule.Shadow != "" {
+		l.mirror(r, rule, client, targetBody)
 	}
 
-	// Copy headers
-	for key, values := range r.Header {
-		for _, value := range values {
-			targetReq.Header.Add(key, value)
+	if len(rule.Fanout) > 0 {
+		status, merged := l.fanout(r, rule, client, targetBody)
+		merged, err = l.transformResponse(r.Context(), rule, status, merged)
+		if err != nil {
+			fail(err)
+			return
 		}
+		finalBody, err := l.encodeBody(merged, nil, true)
+		if err != nil {
+			http.Error(w, "failed to marshal final response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		l.writeBody(w, r, status, finalBody)
+		return
 	}
 
-	targetResp, err := l.httpClient.Do(targetReq)
+	targetResp, err := l.forward(client, r, rule, targetBody)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to forward request: %v", err), http.StatusBadGateway)
+		fail(err)
 		return
 	}
 	defer targetResp.Body.Close()
+	l.logf(r.Context(), levelDebug, "Upstream answered %d (%s)", targetResp.StatusCode, targetResp.Header.Get("Content-Type"))
+	if summary != nil {
+		summary.upstreamStatus = targetResp.StatusCode
+	}
+	header := l.clientHeader(rule, targetResp.Header)
+	// Once the upstream has answered, failures keep its rate-limit headers,
+	// and an upstream 429 stays a 429, so clients still back off as told.
+	failResponse := func(err error) {
+		copyRateLimitHeaders(w.Header(), header)
+		if targetResp.StatusCode == http.StatusTooManyRequests {
+			var upstreamErr *UpstreamError
+			if !errors.As(err, &upstreamErr) {
+				err = &UpstreamError{Status: targetResp.StatusCode, Err: err}
+			}
+		}
+		fail(err)
+	}
 
-	responseBody, err := io.ReadAll(targetResp.Body)
-	if err != nil {
-		http.Error(w, "failed to read response", http.StatusInternalServerError)
-		return
+	if isEventStream(targetResp) {
+		if sla != nil && !rule.StreamCollect && !sla.Stop() {
+			failResponse(errSLAExceeded)
+			return
+		}
+		if rule.StreamTransform != "" && rule.postAppliesTo(targetResp.StatusCode) {
+			transformed, err := l.streamTransform(r, rule, client, targetResp)
+			if err != nil {
+				failResponse(&TransformError{Stage: "post", Endpoint: rule.StreamTransform, Err: err})
+				return
+			}
+			defer transformed.Body.Close()
+			targetResp = transformed
+		}
+	}
+	// A collected stream continues as a non-streamed response, under -sla
+	// and through the response transforms.
+	if isEventStream(targetResp) && rule.StreamCollect {
+		collected, err := collectStream(targetResp)
+		if err != nil {
+			failResponse(err)
+			return
+		}
+		l.logf(r.Context(), levelDebug, "Collected streamed response into one %d-byte body", collected.ContentLength)
+		targetResp = collected
+		header = l.clientHeader(rule, targetResp.Header)
 	}
 
-	var responsePayload map[string]interface{}
-	if err := json.Unmarshal(responseBody, &responsePayload); err != nil {
-		http.Error(w, "invalid response from target", http.StatusBadGateway)
+	if isEventStream(targetResp) {
+		// Streams are assembled for the post-transforms, and to count the
+		// usage they report and charge it to the token budget.
+		aggregate := rule.StreamAggregate && rule.postAppliesTo(targetResp.StatusCode)
+		aggregator := newStreamAggregator()
+		relayed := l.streamResponse(w, r, targetResp, header, aggregator)
+		if relayed {
+			l.copyTrailers(w, targetResp)
+		}
+		// The usage is read before the post-transforms get the completion,
+		// since they run on after the handler returns and may change it.
+		completion := aggregator.completion()
+		l.metrics.recordUsage(rule.Tag, completion)
+		l.chargeBudget(r, completion)
+		summary.setUsage(completion)
+		if relayed && aggregate {
+			l.postStreamTransform(r.Context(), rule, completion)
+		}
 		return
 	}
 
-	// Post-transform
-	if rule.Post != "" {
-		log.Printf("Calling post-transform: %s", rule.Post)
-		result, err := l.callRPC(rule.Post, responsePayload)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("post-transform failed: %v", err), http.StatusInternalServerError)
+	// A chunked body that no transform will touch is relayed as it arrives
+	// rather than buffered.
+	if targetResp.ContentLength < 0 && !rule.transformsResponse(targetResp.StatusCode) && len(rule.StatusMap) == 0 && !cacheable {
+		if sla != nil && !sla.Stop() {
+			failResponse(errSLAExceeded)
 			return
 		}
-		responsePayload = result.(map[string]interface{})
+		l.relayResponse(w, targetResp, header)
+		return
+	}
+
+	responseBody, responsePayload, err := readResponse(targetResp)
+	if err != nil {
+		failResponse(err)
+		return
+	}
+	// An empty body, such as a 204's, is passed through as it is: there is
+	// nothing to parse or post-transform.
+	if isEmptyBody(responseBody) {
+		l.logf(r.Context(), levelDebug, "Upstream answered %d with an empty body, passing it through", targetResp.StatusCode)
+		copyHeader(w.Header(), header, l.singletonHeaders)
+		w.Header().Del("Content-Length")
+		l.copyTrailers(w, targetResp)
+		w.WriteHeader(targetResp.StatusCode)
+		w.Write(responseBody)
+		return
+	}
+	// Usage is counted as the upstream reported it, before post transforms
+	// reshape the body.
+	l.metrics.recordUsage(rule.Tag, responsePayload)
+	l.chargeBudget(r, responsePayload)
+	summary.setUsage(responsePayload)
+
+	responsePayload, err = l.transformResponse(r.Context(), rule, targetResp.StatusCode, responsePayload)
+	if err != nil {
+		failResponse(err)
+		return
 	}
 
 	// Send response back
-	finalBody, err := json.Marshal(responsePayload)
+	finalBody, err := l.encodeBody(responsePayload, responseBody, rule.transformsResponse(targetResp.StatusCode))
 	if err != nil {
 		http.Error(w, "failed to marshal final response", http.StatusInternalServerError)
 		return
 	}
 
-	// Copy response headers
-	for key, values := range targetResp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
+	copyHeader(w.Header(), header, l.singletonHeaders)
+	// The body may have been re-encoded; let the server set the length.
+	w.Header().Del("Content-Length")
+	if reason := finishReason(responsePayload); reason != "" {
+		w.Header().Set("X-LLMSed-Finish-Reason", reason)
+	}
+	status := rule.responseStatus(targetResp.StatusCode, responsePayload)
+	if cacheable {
+		l.cache.store(cacheKey, status, w.Header(), finalBody, time.Duration(rule.CacheTTL))
+	}
+	// The upstream body has been read to the end, so its trailers are known.
+	// Setting them before WriteHeader keeps the server from sending a
+	// Content-Length, which would leave no room for trailers.
+	l.copyTrailers(w, targetResp)
+	l.writeBody(w, r, status, finalBody)
+}
+
+// Startup upstream check modes for -check-upstream.
+const (
+	checkUpstreamFail = "fail"
+	checkUpstreamWarn = "warn"
+)
+
+// upstreamCheckTimeout bounds the startup upstream probe.
+const upstreamCheckTimeout = 5 * time.Second
+
+// checkUpstream probes the upstream server with a HEAD request. Any HTTP
+// response, whatever its status, shows the server is reachable.
+func (l *LLMSed) checkUpstream(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, upstreamCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, l.serverURL, nil)
+	if err != nil {
+		return fmt.Errorf("invalid upstream server %q: %w", l.serverURL, err)
+	}
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("upstream server %s is unreachable: %w", l.serverURL, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+// defaultWarmupPath is requested by the warmup pinger. Listing models is
+// cheap on every major provider.
+const defaultWarmupPath = "/v1/models"
+
+// runWarmup periodically sends a HEAD request to the upstream so pooled
+// connections stay open and the next real request skips the TLS handshake.
+// It returns once ctx is cancelled.
+func (l *LLMSed) runWarmup(ctx context.Context, interval time.Duration, path string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, l.serverURL+path, nil)
+			if err != nil {
+				log.Printf("Warmup request failed: %v", err)
+				continue
+			}
+			resp, err := l.httpClient.Do(req)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Warmup request failed: %v", err)
+				}
+				continue
+			}
+			// Drain the body so the connection returns to the pool.
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
 		}
 	}
+}
+
+// envFlags lists the flags that fall back to an environment variable when
+// not given on the command line.
+var envFlags = []struct{ flag, env string }{
+	{"host", "LLMSED_HOST"},
+	{"port", "LLMSED_PORT"},
+	{"server", "LLMSED_SERVER"},
+	{"map_file", "LLMSED_MAP_FILE"},
+	{"signing-secret", "LLMSED_SIGNING_SECRET"},
+}
 
-	w.WriteHeader(targetResp.StatusCode)
-	w.Write(finalBody)
+// applyEnv sets every flag in envFlags that was not passed explicitly from
+// its environment variable, as returned by lookup.
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for _, ef := range envFlags {
+		if explicit[ef.flag] {
+			continue
+		}
+		if value, ok := lookup(ef.env); ok {
+			if err := fs.Set(ef.flag, value); err != nil {
+				return fmt.Errorf("invalid %s: %w", ef.env, err)
+			}
+		}
+	}
+	return nil
 }
 
 func main() {
 	host := flag.String("host", "0.0.0.0", "Host to bind to")
 	port := flag.Int("port", 8080, "Port to listen on")
-	mapFile := flag.String("map_file", "config.json", "Path to mapping configuration file")
+	mapFile := flag.String("map_file", "config.json", "Path or http(s):// URL of the mapping configuration file")
+	configRefresh := flag.Duration("config-refresh", 0, "Interval between config reloads, e.g. from a config server (0 disables)")
 	server := flag.String("server", "https://api.openai.com", "Target server URL")
+	maxBodyBytes := flag.Int64("max-body-bytes", 0, "Maximum size in bytes of an incoming request body; larger requests get a 413 (0 for no limit)")
+	upstreamRetries := flag.Int("upstream-retries", 0, "Times to resend a request when the upstream is unreachable or answers 502, 503 or 504")
+	maxTransformBytes := flag.Int64("max-transform-bytes", defaultMaxTransformBytes, "Maximum size in bytes of a transform server response (0 for no limit)")
+	warmupInterval := flag.Duration("warmup-interval", 0, "Interval between upstream keepalive pings (0 disables)")
+	warmupPath := flag.String("warmup-path", defaultWarmupPath, "Upstream path requested by the keepalive pinger")
+	ruleOverrideParam := flag.String("rule-override-param", "", "Query parameter that forces a rule by tag, e.g. __rule (empty disables; for testing only)")
+	streamIdleTimeout := flag.Duration("stream-idle-timeout", defaultStreamIdleTimeout, "Maximum gap between chunks of a streamed response (0 disables)")
+	streamTimeout := flag.Duration("stream-timeout", 0, "Maximum total duration of a streamed response (0 disables)")
+	postStreamTimeout := flag.Duration("post-stream-timeout", defaultPostStreamTimeout, "Deadline for the post-transforms run on an assembled stream_aggregate stream")
+	jsonOutput := flag.String("json-output", jsonMinify, "How to re-encode JSON bodies: minify, pretty, or preserve (leave untransformed bodies as received)")
+	echoPath := flag.String("echo-path", "", "Path that runs the request transforms and returns diagnostics without contacting the upstream (empty disables)")
+	tokenBudget := flag.Int64("token-budget", 0, "Tokens each client may use per -token-budget-period, counted from response usage, before it gets 429s (0 disables)")
+	tokenBudgetHeader := flag.String("token-budget-header", defaultTokenBudgetHeader, "Request header whose value tells -token-budget clients apart, e.g. an API key or tenant header")
+	tokenBudgetPeriod := flag.Duration("token-budget-period", defaultTokenBudgetPeriod, "How often -token-budget allowances are reset (0 never resets them)")
+	sla := flag.Duration("sla", 0, "Answer 504 if a non-streamed request is not fully handled within this time, transforms included (0 disables)")
+	cacheMaxEntries := flag.Int("cache-max-entries", defaultCacheMaxEntries, "Maximum responses held by cache_ttl caches; when full, the entry closest to expiring is dropped (0 for no limit)")
+	shadowTimeout := flag.Duration("shadow-timeout", defaultShadowTimeout, "Deadline for each shadow (mirrored) request")
+	maxShadowRequests := flag.Int("max-shadow-requests", defaultMaxShadowRequests, "Maximum outstanding shadow requests; more are dropped")
+	disableHTTP2 := flag.Bool("disable-http2", false, "Use only HTTP/1.1 for upstream and transform connections")
+	egressProxy := flag.String("egress-proxy", "", "Proxy URL (http, https or socks5) for upstream and transform traffic, overriding HTTP_PROXY/HTTPS_PROXY")
+	forwardHeaders := flag.String("forward-headers", "", "Comma-separated allowlist of incoming headers forwarded upstream (empty forwards all)")
+	dropHeaders := flag.String("drop-headers", "", "Comma-separated incoming headers never forwarded upstream, e.g. Cookie")
+	responseForwardHeaders := flag.String("response-forward-headers", "", "Comma-separated allowlist of upstream response headers sent to the client (empty sends all)")
+	responseDropHeaders := flag.String("response-drop-headers", "", "Comma-separated upstream response headers never sent to the client, e.g. Set-Cookie")
+	singletonHeaders := flag.String("singleton-headers", defaultSingletonHeaders, "Comma-separated response headers sent once, with their first value; others keep every value the upstream gave")
+	maxTransformConcurrency := flag.Int("max-transform-concurrency", 0, "Maximum transform calls in flight across all rules (0 for no limit)")
+	transformQueueTimeout := flag.Duration("transform-queue-timeout", defaultTransformQueueTimeout, "Maximum wait for a -max-transform-concurrency slot before the request fails with 503 (0 waits indefinitely)")
+	maxChainSteps := flag.Int("max-chain-steps", defaultMaxChainSteps, "Maximum number of JSON-RPC transforms in a rule's pre or post chain (0 for no limit)")
+	tlsCert := flag.String("tls-cert", "", "Certificate file (PEM) to serve HTTPS with; requires -tls-key")
+	tlsKey := flag.String("tls-key", "", "Private key file (PEM) for -tls-cert")
+	tlsMinVersion := flag.String("tls-min-version", defaultTLSMinVersion, "Oldest TLS version accepted when serving HTTPS: 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers := flag.String("tls-ciphers", "", "Comma-separated TLS 1.2 cipher suites accepted when serving HTTPS, e.g. TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 (empty keeps Go's defaults)")
+	readHeaderTimeout := flag.Duration("read-header-timeout", defaultReadHeaderTimeout, "Maximum time for a client to send its request headers (0 disables)")
+	readTimeout := flag.Duration("read-timeout", 0, "Maximum time for a client to send its whole request, body included (0 disables)")
+	writeTimeout := flag.Duration("write-timeout", 0, "Maximum time to answer a request, upstream wait included; streamed responses get this long per chunk (0 disables)")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Maximum time a keep-alive connection waits for its next request (0 disables)")
+	maxHeaderBytes := flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size in bytes of incoming request headers; larger requests get a 431")
+	compressMinBytes := flag.Int("compress-min-bytes", 0, "Gzip non-streamed response bodies of at least this many bytes for clients that accept gzip (0 disables)")
+	preserveTrailers := flag.Bool("preserve-trailers", false, "Copy upstream response trailers to the client")
+	recordDir := flag.String("record-dir", "", "Record each request and its response to a file in this directory, named by a hash of the request")
+	recordMaxBytes := flag.Int("record-max-bytes", defaultRecordMaxBytes, "Largest response body -record-dir records; larger responses are proxied but not recorded (0 for no limit)")
+	replayDir := flag.String("replay-dir", "", "Answer requests recorded in this directory from their recording, without transforms or upstream; others get a 404 unless -record-dir is set")
+	rootAction := flag.String("root-action", rootForward, "What a request to / gets: forward proxies it as is, info answers a JSON hint, redirect sends a 307 to -root-target, rewrite proxies it as a request to -root-target")
+	rootTarget := flag.String("root-target", "", "Path that -root-action redirect or rewrite sends requests to / to, e.g. /v1/chat/completions")
+	scriptDirectory := flag.String("script-dir", "", "Directory of Starlark (.star) scripts for script and script-response transforms")
+	logSummary := flag.Bool("log-summary", false, "Log one line per request with its rule, transforms, upstream status, duration and token usage")
+	logUnrouted := flag.Bool("log-unrouted", false, "Log the path and model of requests that fell through to the default rule or matched no rule")
+	devMode := flag.Bool("dev-mode", false, "Honor X-LLMSed-Pre/X-LLMSed-Post headers that override a rule's transform endpoints per request (development only)")
+	apiKeyFile := flag.String("api-key-file", "", "File holding the upstream API key, sent as the bearer token of every forwarded request and re-read as it changes")
+	apiKeyPollInterval := flag.Duration("api-key-poll-interval", defaultAPIKeyPollInterval, "How often -api-key-file is re-read")
+	signingSecret := flag.String("signing-secret", "", "HMAC secret for rules that sign forwarded requests without their own secret_env")
+	captureFile := flag.String("capture-file", "", "Append a JSON trace line per request (bodies, transform outputs, response) to this file (empty disables)")
+	captureMaxBytes := flag.Int64("capture-max-bytes", defaultCaptureMaxBytes, "Rotate the capture file to <file>.1 when it reaches this size (0 disables rotation)")
+	captureBodyBytes := flag.Int("capture-body-bytes", defaultCaptureBodyBytes, "Largest body kept in a capture line; bigger ones are recorded by size only (0 for no limit)")
+	captureRedact := flag.String("capture-redact", defaultCaptureRedact, "Comma-separated body field names masked in captures")
+	selfTest := flag.Bool("selftest", false, "Run each rule's transforms on its configured sample at startup and refuse to start if any fail")
+	checkUpstream := flag.String("check-upstream", "", "Probe the upstream server at startup: fail refuses to start if it is unreachable, warn only logs (empty disables)")
+	logLevelName := flag.String("log-level", "info", "Request log level: debug, info, warn or error")
+	adminAddr := flag.String("admin-addr", "", "Serve /healthz, /metrics and /admin on this address instead of the proxy port, e.g. 127.0.0.1:9090 (empty serves them with the proxy)")
+	adminToken := flag.String("admin-token", "", "Bearer token for the /admin endpoints such as POST /admin/reload (empty disables them)")
+	debugClients := flag.String("debug-clients", "", "Comma-separated CIDRs of clients that get full error messages and X-LLMSed-Rule/X-LLMSed-Correlation-ID headers; all others get sanitized errors (empty sends everyone full errors)")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "Maximum open connections per client IP, or requests in progress for clients behind -trusted-proxies (0 for no limit)")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated CIDRs of proxies whose X-Forwarded-For/X-Real-IP headers are trusted")
 	flag.Parse()
 
 	if flag.NArg() > 0 {
@@ -218,6 +1869,36 @@ func main() {
 		return
 	}
 
+	if err := applyEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if err := checkJSONOutput(*jsonOutput); err != nil {
+		log.Fatalf("Invalid -json-output: %v", err)
+	}
+
+	if *checkUpstream != "" && *checkUpstream != checkUpstreamFail && *checkUpstream != checkUpstreamWarn {
+		log.Fatalf("Invalid -check-upstream: %q is not fail or warn", *checkUpstream)
+	}
+
+	if err := checkRootAction(*rootAction, *rootTarget); err != nil {
+		log.Fatalf("Invalid -root-action: %v", err)
+	}
+
+	logLevel, err := parseLogLevel(*logLevelName)
+	if err != nil {
+		log.Fatalf("Invalid -log-level: %v", err)
+	}
+
+	proxies, err := parsePrefixes(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	debugPrefixes, err := parsePrefixes(*debugClients)
+	if err != nil {
+		log.Fatalf("Invalid -debug-clients: %v", err)
+	}
+
 	// Trim trailing slash from server URL
 	*server = strings.TrimSuffix(*server, "/")
 
@@ -225,12 +1906,224 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to initialize llsed: %v", err)
 	}
+	llsed.maxTransformBytes = *maxTransformBytes
+	llsed.maxBodyBytes = *maxBodyBytes
+	llsed.upstreamRetries = *upstreamRetries
+	llsed.ruleOverrideParam = *ruleOverrideParam
+	llsed.streamIdleTimeout = *streamIdleTimeout
+	llsed.streamTimeout = *streamTimeout
+	llsed.jsonOutput = *jsonOutput
+	llsed.trustedProxies = proxies
+	llsed.maxConnsPerIP = *maxConnsPerIP
+	llsed.debugClients = debugPrefixes
+	llsed.echoPath = *echoPath
+	llsed.shadowTimeout = *shadowTimeout
+	llsed.postStreamTimeout = *postStreamTimeout
+	llsed.sla = *sla
+	llsed.cache.maxEntries = *cacheMaxEntries
+	llsed.tokenBudget = *tokenBudget
+	llsed.tokenBudgetHeader = *tokenBudgetHeader
+	llsed.maxShadowRequests = *maxShadowRequests
+	llsed.adminToken = *adminToken
+	llsed.adminAddr = *adminAddr
+	llsed.logLevel = logLevel
+	llsed.signingSecret = *signingSecret
+	llsed.devMode = *devMode
+	llsed.logUnrouted = *logUnrouted
+	llsed.logSummary = *logSummary
+	llsed.rootAction = *rootAction
+	llsed.recordDir = *recordDir
+	llsed.replayDir = *replayDir
+	llsed.recordMaxBytes = *recordMaxBytes
+	if *recordDir != "" {
+		if err := os.MkdirAll(*recordDir, 0o755); err != nil {
+			log.Fatalf("Invalid -record-dir: %v", err)
+		}
+	}
+	if *replayDir != "" {
+		if info, err := os.Stat(*replayDir); err != nil || !info.IsDir() {
+			log.Fatalf("Invalid -replay-dir: %s is not a directory", *replayDir)
+		}
+	}
+	llsed.rootTarget = *rootTarget
+	llsed.maxHeaderBytes = *maxHeaderBytes
+	llsed.timeouts = serverTimeouts{readHeader: *readHeaderTimeout, read: *readTimeout, write: *writeTimeout, idle: *idleTimeout}
+	llsed.maxChainSteps = *maxChainSteps
+	if *maxTransformConcurrency > 0 {
+		llsed.transformSlots = make(chan struct{}, *maxTransformConcurrency)
+	}
+	llsed.transformQueueTimeout = *transformQueueTimeout
+
+	tlsConfig, err := newServerTLSConfig(*tlsMinVersion, *tlsCiphers)
+	if err != nil {
+		log.Fatalf("Invalid TLS settings: %v", err)
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Failed to load -tls-cert/-tls-key: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+		llsed.tlsConfig = tlsConfig
+	} else if *tlsCiphers != "" || *tlsMinVersion != defaultTLSMinVersion {
+		log.Fatalf("-tls-min-version and -tls-ciphers require -tls-cert and -tls-key")
+	}
+	if err := llsed.config.Load().checkChains(llsed.maxChainSteps); err != nil {
+		log.Fatalf("Failed to initialize llsed: %v", err)
+	}
+	llsed.scriptDir = *scriptDirectory
+	if err := llsed.config.Load().checkScripts(llsed.scriptDir); err != nil {
+		log.Fatalf("Failed to initialize llsed: %v", err)
+	}
+	llsed.compressMinBytes = *compressMinBytes
+	llsed.preserveTrailers = *preserveTrailers
+	llsed.forwardHeaders = headerList(*forwardHeaders)
+	llsed.dropHeaders = headerList(*dropHeaders)
+	llsed.responseForwardHeaders = headerList(*responseForwardHeaders)
+	llsed.responseDropHeaders = headerList(*responseDropHeaders)
+	llsed.singletonHeaders = headerList(*singletonHeaders)
+	transport := transportOptions{disableHTTP2: *disableHTTP2}
+	if *egressProxy != "" {
+		transport.egressProxy, err = parseEgressProxy(*egressProxy)
+		if err != nil {
+			log.Fatalf("Invalid -egress-proxy: %v", err)
+		}
+	}
+	llsed.setTransportOptions(transport)
+	if *apiKeyFile != "" {
+		llsed.apiKeyFile = *apiKeyFile
+		if err := llsed.loadAPIKey(); err != nil {
+			log.Fatalf("Failed to read -api-key-file: %v", err)
+		}
+	}
+
+	if *captureFile != "" {
+		llsed.capture, err = openCapture(*captureFile, *captureMaxBytes, *captureBodyBytes, strings.Split(*captureRedact, ","))
+		if err != nil {
+			log.Fatalf("Failed to open -capture-file: %v", err)
+		}
+		defer llsed.capture.Close()
+	}
+
+	if *selfTest {
+		if err := llsed.selfTest(context.Background()); err != nil {
+			log.Fatalf("Refusing to start: self-test failed: %v", err)
+		}
+		log.Printf("Self-test passed")
+	}
+
+	if *checkUpstream != "" {
+		if err := llsed.checkUpstream(context.Background()); err != nil {
+			if *checkUpstream == checkUpstreamFail {
+				log.Fatalf("Refusing to start: %v", err)
+			}
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var background sync.WaitGroup
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		llsed.reloadOnSignal(ctx, hup)
+	}()
+	if *configRefresh > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			llsed.refreshConfig(ctx, *configRefresh)
+		}()
+	}
+	if llsed.apiKeyFile != "" && *apiKeyPollInterval > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			llsed.watchAPIKey(ctx, *apiKeyPollInterval)
+		}()
+	}
+	if llsed.tokenBudget > 0 && *tokenBudgetPeriod > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			llsed.runBudgetReset(ctx, *tokenBudgetPeriod)
+		}()
+	}
+	if *warmupInterval > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			llsed.runWarmup(ctx, *warmupInterval, *warmupPath)
+		}()
+	}
 
 	addr := fmt.Sprintf("%s:%d", *host, *port)
-	log.Printf("Starting llsed on %s, proxying to %s", addr, *server)
+	ln, err := listen(addr)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	ln = llsed.limitConnsPerIP(ln)
+	scheme := "http"
+	if llsed.tlsConfig != nil {
+		scheme = "https"
+	}
+	log.Printf("Starting llsed on %s://%s, proxying to %s", scheme, ln.Addr(), *server)
+
+	srv := llsed.newServer(addr)
+
+	serveErr := make(chan error, 2)
+	go func() {
+		if srv.TLSConfig != nil {
+			// The oversized-header log watches plain-text writes, so it
+			// cannot see through TLS.
+			serveErr <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		serveErr <- srv.Serve(logOversizedHeaders(ln, srv.MaxHeaderBytes))
+	}()
+
+	var adminSrv *http.Server
+	if llsed.adminAddr != "" {
+		adminLn, err := net.Listen("tcp", llsed.adminAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen on -admin-addr: %v", err)
+		}
+		log.Printf("Serving admin endpoints on %s", adminLn.Addr())
+		adminSrv = llsed.newAdminServer()
+		go func() {
+			serveErr <- adminSrv.Serve(logOversizedHeaders(adminLn, adminSrv.MaxHeaderBytes))
+		}()
+	}
 
-	http.HandleFunc("/", llsed.handleProxy)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	select {
+	case err := <-serveErr:
 		log.Fatalf("Server failed: %v", err)
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down")
+	llsed.draining.Store(true)
+	stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	go llsed.logDraining(shutdownCtx)
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown did not complete: %v", err)
+	}
+	if !llsed.waitPostStreams(shutdownCtx) {
+		log.Printf("Shutdown did not wait for post-transforms of assembled streams: %v", shutdownCtx.Err())
+	}
+	// The admin listener outlives the proxy so health checks and metrics
+	// stay available while requests drain.
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Admin shutdown did not complete: %v", err)
+		}
 	}
+	background.Wait()
 }
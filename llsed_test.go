@@ -0,0 +1,1334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallRPCResponseTooLarge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":"`)
+		chunk := strings.Repeat("a", 1024)
+		for i := 0; i < 64; i++ {
+			fmt.Fprint(w, chunk)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, `"}`)
+	}))
+	defer srv.Close()
+
+	l := &LLMSed{maxTransformBytes: 4096}
+	_, err := l.callRPC(t.Context(), srv.Client(), srv.URL, nil, map[string]interface{}{"model": "gpt-4"})
+	if err == nil {
+		t.Fatal("expected error for oversized transform response")
+	}
+	if !strings.Contains(err.Error(), "exceeds 4096 bytes") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCallRPCResponseWithinLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":{"model":"gpt-4o"}}`)
+	}))
+	defer srv.Close()
+
+	l := &LLMSed{maxTransformBytes: 4096}
+	result, err := l.callRPC(t.Context(), srv.Client(), srv.URL, nil, map[string]interface{}{"model": "gpt-4"})
+	if err != nil {
+		t.Fatalf("callRPC: %v", err)
+	}
+	if got := result.(map[string]interface{})["model"]; got != "gpt-4o" {
+		t.Fatalf("model = %v, want gpt-4o", got)
+	}
+}
+
+func TestTransformHeadersReachTransformServer(t *testing.T) {
+	t.Setenv("LLSED_TEST_TRANSFORM_TOKEN", "s3cret")
+	headers := make(chan http.Header, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":{}}`)
+	}))
+	defer srv.Close()
+	upstream := newEchoUpstream(t)
+
+	l := newTestLLMSed(upstream.URL, TransformRule{
+		Tag:         "authed",
+		Pre:         srv.URL,
+		Post:        srv.URL,
+		PreHeaders:  map[string]string{"Authorization": "Bearer ${LLSED_TEST_TRANSFORM_TOKEN}"},
+		PostHeaders: map[string]string{"X-Stage": "post", "Content-Type": "text/plain"},
+	})
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	pre, post := <-headers, <-headers
+	if got := pre.Get("Authorization"); got != "Bearer s3cret" {
+		t.Errorf("pre-transform Authorization = %q, want the substituted token", got)
+	}
+	if got := post.Get("X-Stage"); got != "post" || post.Get("Authorization") != "" {
+		t.Errorf("post-transform headers = %v, want only post_headers", post)
+	}
+	if got := post.Get("Content-Type"); got != "application/json" {
+		t.Errorf("post-transform Content-Type = %q, want application/json", got)
+	}
+}
+
+func TestTransformHeaderUnsetVariable(t *testing.T) {
+	pre, calls := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} { return p })
+	l := newTestLLMSed(newEchoUpstream(t).URL, TransformRule{
+		Tag:        "authed",
+		Pre:        pre.URL,
+		PreHeaders: map[string]string{"Authorization": "Bearer ${LLSED_TEST_UNSET_TOKEN}"},
+	})
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	if rec.Code == http.StatusOK || atomic.LoadInt32(calls) != 0 {
+		t.Errorf("status = %d after %d transform calls, want a failure before any call", rec.Code, atomic.LoadInt32(calls))
+	}
+}
+
+func TestEmptyUpstreamResponsePassesThrough(t *testing.T) {
+	for _, status := range []int{http.StatusNoContent, http.StatusOK} {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Upstream", "yes")
+			w.WriteHeader(status)
+		}))
+		defer upstream.Close()
+		post, calls := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} { return p })
+		proxy := httptest.NewServer(newTestLLMSed(upstream.URL, TransformRule{Tag: "empty", Post: post.URL}).Handler())
+		defer proxy.Close()
+
+		resp, err := http.Post(proxy.URL+"/v1/items/1", "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != status || len(body) != 0 || resp.Header.Get("X-Upstream") != "yes" {
+			t.Errorf("upstream %d: got %d with body %q and headers %v", status, resp.StatusCode, body, resp.Header)
+		}
+		if n := atomic.LoadInt32(calls); n != 0 {
+			t.Errorf("upstream %d: post-transform called %d times for an empty body", status, n)
+		}
+	}
+}
+
+// newTestLLMSed builds an LLMSed that forwards to upstream using rules.
+func newTestLLMSed(upstream string, rules ...TransformRule) *LLMSed {
+	return newLLMSed(Config{Rules: rules}, upstream)
+}
+
+// newRPCServer starts a JSON-RPC transform server that applies fn to the
+// params of every call and counts the calls it receives.
+func newRPCServer(t testing.TB, fn func(map[string]interface{}) map[string]interface{}) (*httptest.Server, *int32) {
+	t.Helper()
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		var req struct {
+			ID     int                    `json:"id"`
+			Params map[string]interface{} `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("transform server: bad request: %v", err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      req.ID,
+			"result":  fn(req.Params),
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestStatusRangeUnmarshal(t *testing.T) {
+	var ranges []StatusRange
+	if err := json.Unmarshal([]byte(`[404, "5xx", "420-429"]`), &ranges); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	want := []StatusRange{{404, 404}, {500, 599}, {420, 429}}
+	for i, sr := range want {
+		if ranges[i] != sr {
+			t.Errorf("ranges[%d] = %+v, want %+v", i, ranges[i], sr)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`["6xx"]`), &ranges); err == nil {
+		t.Error("expected error for invalid status class")
+	}
+}
+
+func TestPostOnStatusOnlyRunsForClientErrors(t *testing.T) {
+	post, calls := newRPCServer(t, func(params map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"error": map[string]interface{}{"message": "rewritten"}}
+	})
+
+	for _, tc := range []struct {
+		status    int
+		wantCalls int32
+		wantBody  string
+	}{
+		{http.StatusOK, 0, `{"ok":true}`},
+		{http.StatusBadRequest, 1, `{"error":{"message":"rewritten"}}`},
+	} {
+		atomic.StoreInt32(calls, 0)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			fmt.Fprint(w, `{"ok":true}`)
+		}))
+
+		l := newTestLLMSed(upstream.URL, TransformRule{
+			Tag:          "errors",
+			Post:         post.URL,
+			PostOnStatus: []StatusRange{{400, 499}},
+		})
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+		upstream.Close()
+
+		if rec.Code != tc.status {
+			t.Errorf("status %d: got code %d", tc.status, rec.Code)
+		}
+		if got := atomic.LoadInt32(calls); got != tc.wantCalls {
+			t.Errorf("status %d: post-transform called %d times, want %d", tc.status, got, tc.wantCalls)
+		}
+		if got := rec.Body.String(); got != tc.wantBody {
+			t.Errorf("status %d: body = %s, want %s", tc.status, got, tc.wantBody)
+		}
+	}
+}
+
+func TestWarmupPingsAtIntervalAndStops(t *testing.T) {
+	var pings int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/v1/models" {
+			t.Errorf("unexpected warmup request %s %s", r.Method, r.URL.Path)
+		}
+		atomic.AddInt32(&pings, 1)
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.runWarmup(ctx, 20*time.Millisecond, defaultWarmupPath)
+		close(done)
+	}()
+
+	time.Sleep(110 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("warmup pinger did not stop after cancel")
+	}
+
+	got := atomic.LoadInt32(&pings)
+	if got < 3 || got > 6 {
+		t.Fatalf("got %d pings in 110ms at a 20ms interval", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if after := atomic.LoadInt32(&pings); after != got {
+		t.Fatalf("pinger kept running after stop: %d pings, then %d", got, after)
+	}
+}
+
+func TestRuleOverrideParam(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	experimental, calls := newRPCServer(t, func(params map[string]interface{}) map[string]interface{} {
+		return params
+	})
+
+	l := newTestLLMSed(upstream.URL,
+		TransformRule{Tag: "default"},
+		TransformRule{Tag: "experimental", Pre: experimental.URL},
+	)
+
+	// Overrides are ignored until enabled.
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions?__rule=experimental", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusOK || atomic.LoadInt32(calls) != 0 {
+		t.Fatalf("disabled override: code %d, %d experimental calls", rec.Code, atomic.LoadInt32(calls))
+	}
+
+	l.ruleOverrideParam = "__rule"
+	rec = httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions?__rule=experimental", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusOK || atomic.LoadInt32(calls) != 1 {
+		t.Fatalf("forced rule: code %d, %d experimental calls", rec.Code, atomic.LoadInt32(calls))
+	}
+
+	rec = httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions?__rule=missing", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown rule: code = %d, want 400", rec.Code)
+	}
+}
+
+func TestJSONOutputModes(t *testing.T) {
+	const requestBody = `{ "model": "gpt-4",  "messages": [] }`
+	const upstreamBody = `{ "id": "x",  "choices": [ 1, 2 ] }`
+
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		forwarded = string(b)
+		w.Header().Set("Content-Length", fmt.Sprint(len(upstreamBody)))
+		fmt.Fprint(w, upstreamBody)
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		mode          string
+		wantForwarded string
+		wantReturned  string
+	}{
+		{jsonMinify, `{"messages":[],"model":"gpt-4"}`, `{"choices":[1,2],"id":"x"}`},
+		{jsonPretty, "{\n  \"messages\": [],\n  \"model\": \"gpt-4\"\n}", "{\n  \"choices\": [\n    1,\n    2\n  ],\n  \"id\": \"x\"\n}"},
+		{jsonPreserve, requestBody, upstreamBody},
+	} {
+		l := newTestLLMSed(upstream.URL, TransformRule{Tag: "passthrough"})
+		l.jsonOutput = tc.mode
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(requestBody)))
+
+		if forwarded != tc.wantForwarded {
+			t.Errorf("%s: forwarded %q, want %q", tc.mode, forwarded, tc.wantForwarded)
+		}
+		if got := rec.Body.String(); got != tc.wantReturned {
+			t.Errorf("%s: returned %q, want %q", tc.mode, got, tc.wantReturned)
+		}
+	}
+}
+
+func TestJSONOutputPreserveReencodesTransformedBodies(t *testing.T) {
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		forwarded = string(b)
+		fmt.Fprint(w, `{ "ok": true }`)
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{
+		Type:   transformSystemPrompt,
+		Params: map[string]interface{}{"prompt": "Be brief."},
+	})
+	l.jsonOutput = jsonPreserve
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{ "messages": [] }`)))
+
+	if want := `{"messages":[{"content":"Be brief.","role":"system"}]}`; forwarded != want {
+		t.Errorf("forwarded %q, want %q", forwarded, want)
+	}
+	if got := rec.Body.String(); got != `{ "ok": true }` {
+		t.Errorf("returned %q, want untransformed response preserved", got)
+	}
+}
+
+func TestFinishReasonHeader(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+		want string
+	}{
+		{`{"choices":[{"message":{"content":"Hel"},"finish_reason":"length"}]}`, "length"},
+		{`{"choices":[{"message":{"content":"Hello"},"finish_reason":"stop"}]}`, "stop"},
+		{`{"content":[{"type":"text","text":"Hel"}],"stop_reason":"max_tokens"}`, "max_tokens"},
+		{`{"data":[]}`, ""},
+	} {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, tc.body)
+		}))
+		l := newTestLLMSed(upstream.URL, TransformRule{Tag: "chat"})
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+		upstream.Close()
+
+		got, present := rec.Header()["X-Llmsed-Finish-Reason"]
+		if tc.want == "" {
+			if present {
+				t.Errorf("%s: unexpected header %q", tc.body, got)
+			}
+			continue
+		}
+		if rec.Header().Get("X-LLMSed-Finish-Reason") != tc.want {
+			t.Errorf("%s: header = %q, want %q", tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestApplyEnvOnlyFillsUnsetFlags(t *testing.T) {
+	fs := flag.NewFlagSet("llsed", flag.ContinueOnError)
+	host := fs.String("host", "0.0.0.0", "")
+	port := fs.Int("port", 8080, "")
+	server := fs.String("server", "https://api.openai.com", "")
+	mapFile := fs.String("map_file", "config.json", "")
+	if err := fs.Parse([]string{"--port", "9000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"LLMSED_HOST":   "127.0.0.1",
+		"LLMSED_PORT":   "7000",
+		"LLMSED_SERVER": "https://api.anthropic.com",
+	}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+	if err := applyEnv(fs, lookup); err != nil {
+		t.Fatal(err)
+	}
+
+	if *host != "127.0.0.1" {
+		t.Errorf("host = %q, want value from LLMSED_HOST", *host)
+	}
+	if *port != 9000 {
+		t.Errorf("port = %d, want explicit flag to win over LLMSED_PORT", *port)
+	}
+	if *server != "https://api.anthropic.com" {
+		t.Errorf("server = %q, want value from LLMSED_SERVER", *server)
+	}
+	if *mapFile != "config.json" {
+		t.Errorf("map_file = %q, want default when LLMSED_MAP_FILE is unset", *mapFile)
+	}
+}
+
+func TestApplyEnvRejectsInvalidValues(t *testing.T) {
+	fs := flag.NewFlagSet("llsed", flag.ContinueOnError)
+	fs.Int("port", 8080, "")
+	fs.Parse(nil)
+	lookup := func(key string) (string, bool) { return "not-a-port", key == "LLMSED_PORT" }
+	if err := applyEnv(fs, lookup); err == nil || !strings.Contains(err.Error(), "LLMSED_PORT") {
+		t.Fatalf("err = %v, want invalid LLMSED_PORT", err)
+	}
+}
+
+func TestDefaultHeadersApplyOnlyWhenAbsent(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL,
+		TransformRule{Tag: "assistants", DefaultHeaders: map[string]string{
+			"OpenAI-Beta":         "assistants=v2",
+			"OpenAI-Organization": "org-default",
+		}},
+		TransformRule{Tag: "plain"},
+	)
+	l.ruleOverrideParam = "rule"
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/threads?rule=assistants", strings.NewReader(`{}`))
+	req.Header.Set("OpenAI-Organization", "org-client")
+	l.handleProxy(httptest.NewRecorder(), req)
+
+	if v := got.Get("OpenAI-Beta"); v != "assistants=v2" {
+		t.Errorf("OpenAI-Beta = %q, want default applied", v)
+	}
+	if v := got.Values("OpenAI-Organization"); len(v) != 1 || v[0] != "org-client" {
+		t.Errorf("OpenAI-Organization = %q, want client value kept", v)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/threads?rule=plain", strings.NewReader(`{}`))
+	l.handleProxy(httptest.NewRecorder(), req)
+	if v := got.Get("OpenAI-Beta"); v != "" {
+		t.Errorf("OpenAI-Beta = %q on a rule without defaults", v)
+	}
+}
+
+func TestSLAReturnsGatewayTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "slow"})
+	l.sla = 100 * time.Millisecond
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	elapsed := time.Since(start)
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("code = %d, want 504 (%s)", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "no complete response within 100ms") {
+		t.Errorf("body = %q", rec.Body.String())
+	}
+	if elapsed < 100*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("answered after %s, want about 100ms", elapsed)
+	}
+}
+
+func TestSLAIncludesTransformTime(t *testing.T) {
+	pre := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer pre.Close()
+	upstream := newEchoUpstream(t)
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "slow-pre", Pre: pre.URL})
+	l.sla = 100 * time.Millisecond
+
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("code = %d, want 504 (%s)", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSLADoesNotCutStreams(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(60 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "stream"})
+	l.sla = 100 * time.Millisecond
+	proxy := httptest.NewServer(l.Handler())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if want := "data: 0\n\ndata: 1\n\ndata: 2\n\n"; string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestLargeIntegersSurviveTransformRoundTrip(t *testing.T) {
+	// A transform server that echoes params back without decoding them.
+	pre := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Params json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":%s}`, req.Params)
+	}))
+	defer pre.Close()
+
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		forwarded = string(b)
+		fmt.Fprint(w, `{"usage":{"total_tokens":9007199254740993}}`)
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "echo", Pre: pre.URL, Post: pre.URL})
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"seed":12345678901234567890,"max_tokens":100,"temperature":0.5}`)))
+
+	if want := `{"max_tokens":100,"seed":12345678901234567890,"temperature":0.5}`; forwarded != want {
+		t.Errorf("forwarded %s, want %s", forwarded, want)
+	}
+	if want := `{"usage":{"total_tokens":9007199254740993}}`; rec.Body.String() != want {
+		t.Errorf("returned %s, want %s", rec.Body.String(), want)
+	}
+}
+
+func TestDecodeJSONRejectsTrailingData(t *testing.T) {
+	var v map[string]interface{}
+	if err := decodeJSON([]byte(`{"a":1} {"b":2}`), &v); err == nil {
+		t.Fatal("expected error for trailing data")
+	}
+	if err := decodeJSON([]byte(" {\"a\":1}\n"), &v); err != nil {
+		t.Fatalf("surrounding whitespace: %v", err)
+	}
+}
+
+func TestPostChainAppliesInOrder(t *testing.T) {
+	step := func(name string) *httptest.Server {
+		srv, _ := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+			trail, _ := p["trail"].(string)
+			p["trail"] = trail + name
+			return p
+		})
+		return srv
+	}
+	first, second, third := step("a"), step("b"), step("c")
+
+	l := newTestLLMSed("http://127.0.0.1:0")
+	rule := TransformRule{Post: first.URL, PostChain: []string{second.URL, third.URL}}
+	out, err := l.transformResponse(t.Context(), rule, http.StatusOK, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"trail":"abc"}`)
+}
+
+func TestPostChainMidChainFailure(t *testing.T) {
+	ok, _ := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		p["seen"] = true
+		return p
+	})
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"boom"}}`)
+	}))
+	defer broken.Close()
+	last, lastCalls := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		p["last"] = true
+		return p
+	})
+
+	l := newTestLLMSed("http://127.0.0.1:0")
+	rule := TransformRule{PostChain: []string{ok.URL, broken.URL, last.URL}}
+	_, err := l.transformResponse(t.Context(), rule, http.StatusOK, map[string]interface{}{})
+	var transformErr *TransformError
+	if !errors.As(err, &transformErr) || transformErr.Index != 2 || transformErr.Endpoint != broken.URL {
+		t.Fatalf("err = %v, want failure at #2", err)
+	}
+	if !strings.Contains(err.Error(), "post-transform #2") {
+		t.Errorf("error %q does not name the failing index", err)
+	}
+	if atomic.LoadInt32(lastCalls) != 0 {
+		t.Error("chain continued past the failure")
+	}
+
+	rule.OnError = onErrorSkip
+	out, err := l.transformResponse(t.Context(), rule, http.StatusOK, map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("skip policy: %v", err)
+	}
+	assertJSON(t, out, `{"seen":true,"last":true}`)
+}
+
+func TestMaxChainSteps(t *testing.T) {
+	step, calls := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} { return p })
+	rule := TransformRule{Tag: "long", Pre: step.URL, PreChain: []string{step.URL, step.URL}}
+	l := newTestLLMSed("http://127.0.0.1:0", rule)
+	l.maxChainSteps = 2
+
+	_, err := l.transformRequest(t.Context(), rule, map[string]interface{}{})
+	if !errors.Is(err, errChainTooLong) || !strings.Contains(err.Error(), "pre chain has 3 steps, more than -max-chain-steps 2") {
+		t.Fatalf("err = %v, want chain length error", err)
+	}
+	if atomic.LoadInt32(calls) != 0 {
+		t.Error("transforms ran despite the chain being too long")
+	}
+
+	rec := httptest.NewRecorder()
+	l.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "max-chain-steps") {
+		t.Errorf("proxy: %d %q, want 500 naming the limit", rec.Code, rec.Body)
+	}
+
+	config := Config{Rules: []TransformRule{{Tag: "short", Pre: step.URL}, rule}}
+	if err := config.checkChains(2); !errors.Is(err, ErrConfig) || !strings.Contains(err.Error(), "rule 1 (long)") {
+		t.Errorf("checkChains(2) = %v, want config error for rule 1", err)
+	}
+	if err := config.checkChains(3); err != nil {
+		t.Errorf("checkChains(3) = %v", err)
+	}
+	if err := config.checkChains(0); err != nil {
+		t.Errorf("checkChains(0) = %v, want no limit", err)
+	}
+}
+
+func TestCheckUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+	if err := newTestLLMSed(upstream.URL).checkUpstream(t.Context()); err != nil {
+		t.Errorf("reachable upstream answering 404: %v", err)
+	}
+
+	// Nothing listens on a closed server's address.
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	err := newTestLLMSed(gone.URL).checkUpstream(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Errorf("err = %v, want unreachable error", err)
+	}
+}
+
+func TestCheckUpstreamFailsStartup(t *testing.T) {
+	if os.Getenv("LLSED_TEST_MAIN") == "1" {
+		os.Args = strings.Fields(os.Getenv("LLSED_TEST_ARGS"))
+		main()
+		return
+	}
+
+	config := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(config, []byte(`{"rules":[{"tag":"r"}]}`), 0o644)
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestCheckUpstreamFailsStartup$")
+	cmd.Env = append(os.Environ(), "LLSED_TEST_MAIN=1",
+		"LLSED_TEST_ARGS=llsed -port 0 -check-upstream fail -map_file "+config+" -server "+gone.URL)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("llsed started with an unreachable upstream:\n%s", out)
+	}
+	if !strings.Contains(string(out), "Refusing to start") || !strings.Contains(string(out), "unreachable") {
+		t.Errorf("output does not explain the failure:\n%s", out)
+	}
+}
+
+func TestForwardAndDropHeaders(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL,
+		TransformRule{Tag: "global"},
+		TransformRule{Tag: "own-list", ForwardHeaders: []string{"authorization"}, DropHeaders: []string{}},
+	)
+	l.ruleOverrideParam = "rule"
+	send := func(tag string) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?rule="+tag, strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer sk-test")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Cookie", "session=1")
+		req.Header.Set("X-Internal-Auth", "secret")
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "1")
+		l.handleProxy(httptest.NewRecorder(), req)
+	}
+
+	// Denylist: everything but the dropped and hop-by-hop headers.
+	l.dropHeaders = headerList("cookie, x-internal-auth")
+	send("global")
+	if got.Get("Cookie") != "" || got.Get("X-Internal-Auth") != "" || got.Get("X-Hop") != "" {
+		t.Errorf("denied headers forwarded: %v", got)
+	}
+	if got.Get("Authorization") == "" || got.Get("Content-Type") == "" {
+		t.Errorf("allowed headers missing: %v", got)
+	}
+
+	// Allowlist: only the listed headers.
+	l.dropHeaders = nil
+	l.forwardHeaders = headerList("Authorization,Content-Type")
+	send("global")
+	if got.Get("Cookie") != "" || got.Get("X-Internal-Auth") != "" || got.Get("Authorization") == "" || got.Get("Content-Type") == "" {
+		t.Errorf("allowlist not applied: %v", got)
+	}
+
+	// A rule's own lists replace the global ones.
+	send("own-list")
+	if got.Get("Authorization") == "" || got.Get("Content-Type") != "" {
+		t.Errorf("rule allowlist not applied: %v", got)
+	}
+}
+
+func TestResponseForwardAndDropHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=1")
+		w.Header().Set("X-Internal-Trace", "abc")
+		w.Header().Set("X-Request-Id", "req-1")
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL,
+		TransformRule{Tag: "global"},
+		TransformRule{Tag: "own-list", ResponseForwardHeaders: []string{"x-internal-trace"}, ResponseDropHeaders: []string{}},
+	)
+	l.ruleOverrideParam = "rule"
+	send := func(tag string) http.Header {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?rule="+tag, strings.NewReader(`{}`))
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, req)
+		return rec.Header()
+	}
+
+	// Denylist: everything but the dropped and hop-by-hop headers.
+	l.responseDropHeaders = headerList("set-cookie, x-internal-trace")
+	got := send("global")
+	if got.Get("Set-Cookie") != "" || got.Get("X-Internal-Trace") != "" || got.Get("X-Hop") != "" {
+		t.Errorf("denied headers sent to client: %v", got)
+	}
+	if got.Get("Content-Type") == "" || got.Get("X-Request-Id") == "" {
+		t.Errorf("allowed headers missing: %v", got)
+	}
+
+	// Allowlist: only the listed headers.
+	l.responseDropHeaders = nil
+	l.responseForwardHeaders = headerList("Content-Type,X-Request-Id")
+	got = send("global")
+	if got.Get("Set-Cookie") != "" || got.Get("X-Internal-Trace") != "" || got.Get("Content-Type") == "" || got.Get("X-Request-Id") == "" {
+		t.Errorf("allowlist not applied: %v", got)
+	}
+
+	// A rule's own lists replace the global ones.
+	got = send("own-list")
+	if got.Get("X-Internal-Trace") == "" || got.Get("X-Request-Id") != "" {
+		t.Errorf("rule allowlist not applied: %v", got)
+	}
+}
+
+func TestDuplicateResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = []string{"application/json", "application/json; charset=utf-8"}
+		w.Header()["Set-Cookie"] = []string{"session=1", "theme=dark"}
+		w.Header()["Vary"] = []string{"Accept", "Accept-Encoding"}
+		w.Header()["X-Shard"] = []string{"a", "b"}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer upstream.Close()
+	post, _ := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} { return p })
+
+	for _, rule := range []TransformRule{{Tag: "relayed"}, {Tag: "transformed", Post: post.URL}} {
+		l := newTestLLMSed(upstream.URL, rule)
+		l.singletonHeaders = append(l.singletonHeaders, "X-Shard")
+		proxy := httptest.NewServer(l.Handler())
+		resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		proxy.Close()
+
+		if got := resp.Header.Values("Content-Type"); len(got) != 1 || got[0] != "application/json" {
+			t.Errorf("%s: Content-Type = %q, want it once", rule.Tag, got)
+		}
+		if got := resp.Header.Values("Set-Cookie"); !reflect.DeepEqual(got, []string{"session=1", "theme=dark"}) {
+			t.Errorf("%s: Set-Cookie = %q, want both", rule.Tag, got)
+		}
+		// Headers outside the singleton list keep every value.
+		if got := resp.Header.Values("Vary"); !reflect.DeepEqual(got, []string{"Accept", "Accept-Encoding"}) {
+			t.Errorf("%s: Vary = %q, want both", rule.Tag, got)
+		}
+		if got := resp.Header.Values("X-Shard"); !reflect.DeepEqual(got, []string{"a"}) {
+			t.Errorf("%s: X-Shard = %q, want the first only", rule.Tag, got)
+		}
+	}
+}
+
+func TestDevModeTransformOverrideHeaders(t *testing.T) {
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+	configured, _ := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		p["by"] = "configured"
+		return p
+	})
+	alternate, _ := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		p["by"] = "alternate"
+		return p
+	})
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "dev", Post: configured.URL})
+	send := func(post string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`))
+		req.Header.Set("X-LLMSed-Post", post)
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, req)
+		return rec
+	}
+
+	// Without dev mode the header is ignored, and never forwarded.
+	if rec := send(alternate.URL); rec.Body.String() != `{"by":"configured"}` {
+		t.Errorf("dev mode off: body %s", rec.Body.String())
+	}
+	if upstreamHeader.Get("X-LLMSed-Post") != "" {
+		t.Error("override header forwarded upstream")
+	}
+
+	l.devMode = true
+	if rec := send(alternate.URL); rec.Body.String() != `{"by":"alternate"}` {
+		t.Errorf("dev mode on: body %s", rec.Body.String())
+	}
+	if rec := send("file:///etc/passwd"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid override URL: code %d", rec.Code)
+	}
+}
+
+// largeResponse builds a chat completion body of roughly n KiB.
+func largeResponse(n int) map[string]interface{} {
+	choices := make([]interface{}, n)
+	for i := range choices {
+		choices[i] = map[string]interface{}{
+			"index":   json.Number(fmt.Sprint(i)),
+			"message": map[string]interface{}{"role": "assistant", "content": strings.Repeat("token ", 160)},
+		}
+	}
+	return map[string]interface{}{"id": "chatcmpl-1", "object": "chat.completion", "choices": choices}
+}
+
+// postChainStep stands in for a post-transform: it tags the body in place.
+func postChainStep(name string) func(map[string]interface{}) (map[string]interface{}, error) {
+	return func(p map[string]interface{}) (map[string]interface{}, error) {
+		p[name] = true
+		return p, nil
+	}
+}
+
+var postChainSteps = []func(map[string]interface{}) (map[string]interface{}, error){
+	postChainStep("a"), postChainStep("b"), postChainStep("c"),
+}
+
+// chainDecoded runs the steps on one decoded body and encodes once, as the
+// post-chain does.
+func chainDecoded(payload map[string]interface{}) ([]byte, error) {
+	var err error
+	for _, step := range postChainSteps {
+		if payload, err = step(payload); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(payload)
+}
+
+// chainReencoded encodes and decodes the body around every step.
+func chainReencoded(payload map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range postChainSteps {
+		var p map[string]interface{}
+		if err := decodeJSON(data, &p); err != nil {
+			return nil, err
+		}
+		if p, err = step(p); err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(p); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func TestPostChainDecodedMatchesReencoded(t *testing.T) {
+	decoded, err := chainDecoded(largeResponse(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reencoded, err := chainReencoded(largeResponse(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != string(reencoded) {
+		t.Errorf("outputs differ:\n%s\n%s", decoded, reencoded)
+	}
+
+	// The real chain hands each transform the previous one's decoded output.
+	echo := func(p map[string]interface{}) map[string]interface{} { return p }
+	first, _ := newRPCServer(t, echo)
+	second, _ := newRPCServer(t, echo)
+	l := newTestLLMSed("http://127.0.0.1:0")
+	out, err := l.transformResponse(t.Context(), TransformRule{PostChain: []string{first.URL, second.URL}}, http.StatusOK, largeResponse(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(largeResponse(8))
+	if got, _ := json.Marshal(out); string(got) != string(want) {
+		t.Error("post-chain output differs from its input after identity transforms")
+	}
+}
+
+func BenchmarkPostChain(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		run  func(map[string]interface{}) ([]byte, error)
+	}{
+		{"decoded", chainDecoded},
+		{"reencoded", chainReencoded},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for b.Loop() {
+				b.StopTimer()
+				payload := largeResponse(1024)
+				b.StartTimer()
+				if _, err := bench.run(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	// The full path through three JSON-RPC post-transforms and the final
+	// encode. Each call still serializes the body for the wire.
+	b.Run("transformResponse", func(b *testing.B) {
+		echo := func(p map[string]interface{}) map[string]interface{} { return p }
+		var chain []string
+		for i := 0; i < 3; i++ {
+			srv, _ := newRPCServer(b, echo)
+			chain = append(chain, srv.URL)
+		}
+		l := newTestLLMSed("http://127.0.0.1:0")
+		rule := TransformRule{PostChain: chain}
+		for b.Loop() {
+			b.StopTimer()
+			payload := largeResponse(1024)
+			b.StartTimer()
+			out, err := l.transformResponse(context.Background(), rule, http.StatusOK, payload)
+			if err != nil {
+				b.Fatal(err)
+			}
+			l.encodeBody(out, nil, true)
+		}
+	})
+}
+
+func TestUpstreamRetryResendsTransformedBody(t *testing.T) {
+	var bodies []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer upstream.Close()
+	pre, _ := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		p["model"] = "rewritten"
+		return p
+	})
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Pre: pre.URL})
+	l.upstreamRetries = 1
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, req)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"ok":true}` {
+		t.Fatalf("got %d %s", rec.Code, rec.Body.String())
+	}
+	if len(bodies) != 2 || bodies[0] != `{"model":"rewritten"}` || bodies[1] != bodies[0] {
+		t.Errorf("attempts sent %q", bodies)
+	}
+}
+
+func TestUpstreamRetriesExhausted(t *testing.T) {
+	var attempts int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{})
+	l.upstreamRetries = 2
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+
+	if rec.Code != http.StatusBadGateway || atomic.LoadInt32(&attempts) != 3 {
+		t.Errorf("got %d after %d attempts, want 502 after 3", rec.Code, attempts)
+	}
+}
+
+func TestRuleRetryPolicies(t *testing.T) {
+	var attempts int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL,
+		TransformRule{Tag: "default"},
+		TransformRule{Tag: "patient", Retry: &RetryPolicy{
+			MaxAttempts: 3,
+			Statuses:    []StatusRange{{Min: 429, Max: 429}},
+			Backoff:     Duration(20 * time.Millisecond),
+		}},
+		TransformRule{Tag: "once", Retry: &RetryPolicy{MaxAttempts: 1, Statuses: []StatusRange{{Min: 400, Max: 499}}}},
+	)
+	l.ruleOverrideParam = "rule"
+	l.upstreamRetries = 4
+
+	for _, tc := range []struct {
+		rule     string
+		attempts int32
+		minTime  time.Duration
+	}{
+		// 429 is not retried by default, whatever -upstream-retries says.
+		{"default", 1, 0},
+		{"patient", 3, 60 * time.Millisecond},
+		{"once", 1, 0},
+	} {
+		atomic.StoreInt32(&attempts, 0)
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions?rule="+tc.rule, strings.NewReader(`{}`)))
+		elapsed := time.Since(start)
+
+		if rec.Code != http.StatusTooManyRequests || atomic.LoadInt32(&attempts) != tc.attempts {
+			t.Errorf("%s: got %d after %d attempts, want 429 after %d", tc.rule, rec.Code, attempts, tc.attempts)
+		}
+		if elapsed < tc.minTime {
+			t.Errorf("%s: took %s, want at least %s of backoff", tc.rule, elapsed, tc.minTime)
+		}
+	}
+}
+
+func TestRuleRetryPolicyValidation(t *testing.T) {
+	for _, policy := range []RetryPolicy{{MaxAttempts: -1}, {Backoff: Duration(-time.Second)}} {
+		cfg := Config{Rules: []TransformRule{{Tag: "r", Retry: &policy}}}
+		if err := cfg.validate(); err == nil {
+			t.Errorf("retry %+v: expected a validation error", policy)
+		}
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	l := newTestLLMSed(upstream.URL, TransformRule{})
+	l.maxBodyBytes = 16
+
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o-mini"}`)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: code %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"a":1}`)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("small body: code %d", rec.Code)
+	}
+}
+
+func TestDisabledRuleNeverMatches(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	disabled, calls := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		return p
+	})
+	off := false
+	l := newTestLLMSed(upstream.URL,
+		TransformRule{Tag: "off", Pre: disabled.URL, Enabled: &off},
+		TransformRule{Tag: "on"},
+	)
+	l.ruleOverrideParam = "rule"
+
+	rule, err := l.selectRule(httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil))
+	if err != nil || rule.Tag != "on" {
+		t.Errorf("selected %q (%v), want the first enabled rule", rule.Tag, err)
+	}
+
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions?rule=off", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusBadRequest || atomic.LoadInt32(calls) != 0 {
+		t.Errorf("forcing a disabled rule: code %d, %d transform calls", rec.Code, atomic.LoadInt32(calls))
+	}
+
+	l.config.Store(&Config{Rules: []TransformRule{{Tag: "off", Enabled: &off}}})
+	if _, err := l.selectRule(httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)); !errors.Is(err, ErrConfig) {
+		t.Errorf("all rules disabled: err = %v", err)
+	}
+}
+
+func TestContentLengthRouting(t *testing.T) {
+	var small, large int32
+	count := func(n *int32) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(n, 1)
+			w.Write([]byte(`{}`))
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	smallUpstream, largeUpstream := count(&small), count(&large)
+
+	l := newTestLLMSed(smallUpstream.URL,
+		TransformRule{Tag: "small", ContentLength: &LengthRange{Max: 63}},
+		TransformRule{Tag: "large", ContentLength: &LengthRange{Min: 64}, Canary: &CanaryConfig{URL: largeUpstream.URL, Percent: 100}},
+	)
+	send := func(body string, chunked bool) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1
+		}
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, req)
+		return rec.Code
+	}
+
+	longPrompt := `{"messages":[{"role":"user","content":"` + strings.Repeat("x", 100) + `"}]}`
+	if code := send(`{"model":"m"}`, false); code != http.StatusOK || small != 1 || large != 0 {
+		t.Errorf("small request: code %d, small %d, large %d", code, small, large)
+	}
+	if code := send(longPrompt, false); code != http.StatusOK || small != 1 || large != 1 {
+		t.Errorf("large request: code %d, small %d, large %d", code, small, large)
+	}
+	// Without a Content-Length the body's size as read decides.
+	if code := send(longPrompt, true); code != http.StatusOK || small != 1 || large != 2 {
+		t.Errorf("chunked large request: code %d, small %d, large %d", code, small, large)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	req.ContentLength = -1
+	if _, err := l.selectRule(req); !errors.Is(err, ErrConfig) {
+		t.Errorf("unknown length matched a sized rule: err = %v", err)
+	}
+	bad := Config{Rules: []TransformRule{{Tag: "r", ContentLength: &LengthRange{Min: 10, Max: 5}}}}
+	if err := bad.validate(); err == nil {
+		t.Error("max below min: expected a validation error")
+	}
+}
+
+func TestTransformParamsKeepIntegers(t *testing.T) {
+	var sent string
+	pre := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		sent = string(b)
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":{}}`)
+	}))
+	defer pre.Close()
+
+	// The cel transform runs first and hands the JSON-RPC transform its
+	// own decoding of the body.
+	for _, rule := range []TransformRule{
+		{Pre: pre.URL},
+		{Pre: pre.URL, Type: transformCEL, Params: map[string]interface{}{"expression": "body"}},
+	} {
+		l := newTestLLMSed(newEchoUpstream(t).URL, rule)
+		l.handleProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+			strings.NewReader(`{"max_tokens":100,"n":1,"temperature":1.0}`)))
+		if !strings.Contains(sent, `"max_tokens":100,`) || !strings.Contains(sent, `"n":1,`) {
+			t.Errorf("type %q: transform server got %s", rule.Type, sent)
+		}
+	}
+}
+
+func TestVersionMapRewritesPath(t *testing.T) {
+	var got string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RequestURI()
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{VersionMap: map[string]string{"v1": "v2"}})
+	for path, want := range map[string]string{
+		"/v1/chat/completions": "/v2/chat/completions",
+		"/openai/v1/models":    "/openai/v2/models",
+		"/v3/chat/completions": "/v3/chat/completions",
+		"/v1/files/v1/content": "/v2/files/v1/content",
+	} {
+		l.handleProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{}`)))
+		if got != want {
+			t.Errorf("%s forwarded to %s, want %s", path, got, want)
+		}
+	}
+
+	bad := Config{Rules: []TransformRule{{VersionMap: map[string]string{"v1": "v2/beta"}}}}
+	if err := bad.validate(); err == nil {
+		t.Error("expected error for a version spanning segments")
+	}
+}
+
+func TestUpstreamMethodOverride(t *testing.T) {
+	var method, body string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		method, body = r.Method, string(b)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct{ override, wantMethod, wantBody string }{
+		{"", http.MethodPost, `{"model":"m"}`},
+		{http.MethodPut, http.MethodPut, `{"model":"m"}`},
+		{http.MethodGet, http.MethodGet, ""},
+	} {
+		l := newTestLLMSed(upstream.URL, TransformRule{UpstreamMethod: tc.override})
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m"}`)))
+		if rec.Code != http.StatusOK || method != tc.wantMethod || body != tc.wantBody {
+			t.Errorf("upstream_method %q: code %d, upstream got %s %q", tc.override, rec.Code, method, body)
+		}
+	}
+
+	if err := (Config{Rules: []TransformRule{{UpstreamMethod: "put"}}}).validate(); err == nil {
+		t.Error("expected error for an unknown method")
+	}
+}
+
+func TestConfigValidateWarningsAndErrors(t *testing.T) {
+	warnOnly := Config{Rules: []TransformRule{
+		{Tag: "chat", PostOnStatus: []StatusRange{{Min: 200, Max: 299}}, PostHeaders: map[string]string{"X-Key": "k"}},
+		{Tag: "chat", Pre: "http://localhost:9001", MaxConcurrent: 2},
+	}}
+	warnings, err := warnOnly.Validate()
+	if err != nil {
+		t.Fatalf("warning-only config failed: %v", err)
+	}
+	want := []string{
+		"rule 0 (chat): post_on_status has no effect without a response transform",
+		"rule 0 (chat): post_headers has no effect without post, post_chain or stream_transform",
+		"rule 1 (chat): tag is also used by rule 0, which forcing the tag always selects",
+	}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+
+	fatal := Config{Rules: []TransformRule{{Tag: "chat", Type: "nope", PreHeaders: map[string]string{"X-Key": "k"}}}}
+	if warnings, err := fatal.Validate(); err == nil || warnings != nil {
+		t.Errorf("fatal config: warnings %q, err %v; want only an error", warnings, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"rules":[
+		{"tag":"chat","post_on_status":["2xx"],"post_headers":{"X-Key":"k"}},
+		{"tag":"chat","pre":"http://localhost:9001","max_concurrent":2}]}`), 0o644)
+	logs := captureLog(t)
+	if _, err := loadConfig(path); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if n := strings.Count(logs.String(), "Config warning: "); n != len(want) {
+		t.Errorf("logged %d warnings, want %d:\n%s", n, len(want), logs)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// logLevel orders request log lines from most to least verbose.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func (lv logLevel) String() string {
+	for name, v := range logLevelNames {
+		if v == lv {
+			return name
+		}
+	}
+	return fmt.Sprintf("level(%d)", int(lv))
+}
+
+// parseLogLevel parses "debug", "info", "warn" or "error".
+func parseLogLevel(s string) (logLevel, error) {
+	lv, ok := logLevelNames[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return lv, nil
+}
+
+type logLevelKey struct{}
+
+// withLogLevel overrides the log level for lines logged with ctx.
+func withLogLevel(ctx context.Context, lv logLevel) context.Context {
+	return context.WithValue(ctx, logLevelKey{}, lv)
+}
+
+// logf logs a request line at lv if lv is at or above the request's level:
+// the matched rule's log_level when set, the global level otherwise. Lines
+// other than info are prefixed with their level.
+func (l *LLMSed) logf(ctx context.Context, lv logLevel, format string, args ...interface{}) {
+	threshold := l.logLevel
+	if override, ok := ctx.Value(logLevelKey{}).(logLevel); ok {
+		threshold = override
+	}
+	if lv < threshold {
+		return
+	}
+	if lv != levelInfo {
+		format = lv.String() + ": " + format
+	}
+	log.Printf(format, args...)
+}
+
+// requestSummary collects what -log-summary reports about one request
+// beyond its trace.
+type requestSummary struct {
+	start          time.Time
+	upstreamStatus int
+	usage          map[string]int64
+}
+
+// setUsage records the token counts in a response body's usage object.
+func (s *requestSummary) setUsage(payload map[string]interface{}) {
+	if s != nil {
+		s.usage = usageByKind(payload)
+	}
+}
+
+// logSummary logs one line for the request: its rule, the transforms that
+// ran, the upstream status, the time taken and the tokens used.
+func logSummary(r *http.Request, t *requestTrace, s *requestSummary) {
+	var transforms []string
+	for _, step := range t.Steps() {
+		name := step.Stage + ":" + step.Transform
+		if step.Error != "" {
+			name += "(failed)"
+		}
+		transforms = append(transforms, name)
+	}
+	upstream := "-"
+	if s.upstreamStatus != 0 {
+		upstream = fmt.Sprint(s.upstreamStatus)
+	}
+	log.Printf("Request summary: id=%s %s %s rule=%q transforms=%q upstream_status=%s duration_ms=%.1f prompt_tokens=%d completion_tokens=%d",
+		correlationID(r.Context()), r.Method, r.URL.Path, t.Rule(), strings.Join(transforms, ","), upstream,
+		milliseconds(time.Since(s.start)), s.usage["prompt"], s.usage["completion"])
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// captureLog redirects the standard logger to a buffer for the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(prev) })
+	return &buf
+}
+
+func TestRuleLogLevelOverridesGlobal(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	l := newTestLLMSed(upstream.URL,
+		TransformRule{Tag: "debugging", LogLevel: "debug"},
+		TransformRule{Tag: "quiet"},
+	)
+	l.ruleOverrideParam = "rule"
+
+	logs := captureLog(t)
+	for _, tag := range []string{"debugging", "quiet"} {
+		l.handleProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions?rule="+tag, strings.NewReader(`{}`)))
+	}
+
+	out := logs.String()
+	if !strings.Contains(out, "debug: Rule debugging matched") {
+		t.Errorf("no debug lines for the debug rule:\n%s", out)
+	}
+	if strings.Contains(out, "Rule quiet matched") {
+		t.Errorf("debug lines logged for a rule at the info level:\n%s", out)
+	}
+	if strings.Count(out, "Forwarding") != 2 {
+		t.Errorf("info lines missing:\n%s", out)
+	}
+}
+
+func TestLogUnroutedRequests(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	l := newTestLLMSed(upstream.URL,
+		TransformRule{Tag: "fallback"},
+		TransformRule{Tag: "gpt", When: []Condition{{Path: "model", Equals: "gpt-4"}}},
+	)
+	l.ruleOverrideParam = "rule"
+	l.logUnrouted = true
+
+	logs := captureLog(t)
+	for _, req := range []struct{ query, model string }{
+		{"?rule=gpt", "gpt-4"},  // matched
+		{"", "llama"},           // fell through to the first rule
+		{"?rule=gpt", "claude"}, // conditions not met
+	} {
+		body := strings.NewReader(`{"model":"` + req.model + `"}`)
+		l.handleProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions"+req.query, body))
+	}
+
+	out := logs.String()
+	if strings.Contains(out, `model="gpt-4"`) {
+		t.Errorf("matched request logged as unrouted:\n%s", out)
+	}
+	if !strings.Contains(out, `Unrouted request (default, rule "fallback"): POST /v1/chat/completions model="llama"`) {
+		t.Errorf("fall-through request not logged:\n%s", out)
+	}
+	if !strings.Contains(out, `Unrouted request (none, rule "gpt"): POST /v1/chat/completions model="claude"`) {
+		t.Errorf("untransformed request not logged:\n%s", out)
+	}
+	for reason, want := range map[string]float64{unroutedDefault: 1, unroutedNone: 1} {
+		if got := testutil.ToFloat64(l.metrics.unrouted.WithLabelValues(reason)); got != want {
+			t.Errorf("unrouted{reason=%q} = %v, want %v", reason, got, want)
+		}
+	}
+}
+
+func TestMatchedRulesAreNotUnrouted(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	l := newTestLLMSed(upstream.URL,
+		TransformRule{Tag: "large", ContentLength: &LengthRange{Min: 64}},
+		TransformRule{Tag: "french", Languages: []string{"fr"}},
+		TransformRule{Tag: "fallback"},
+	)
+	for _, body := range []string{
+		`{"messages":[{"role":"user","content":"` + strings.Repeat("x", 100) + `"}]}`,
+		`{"messages":[{"role":"user","content":"Je voudrais une réponse"}]}`,
+	} {
+		l.handleProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+	}
+	if got := testutil.ToFloat64(l.metrics.unrouted.WithLabelValues(unroutedDefault)); got != 0 {
+		t.Errorf("matched requests counted as unrouted: %v", got)
+	}
+	l.handleProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	if got := testutil.ToFloat64(l.metrics.unrouted.WithLabelValues(unroutedDefault)); got != 1 {
+		t.Errorf("fall-through request: unrouted = %v, want 1", got)
+	}
+}
+
+func TestLogfHonorsGlobalLevel(t *testing.T) {
+	l := newTestLLMSed("http://127.0.0.1:0")
+	l.logLevel = levelWarn
+
+	logs := captureLog(t)
+	l.logf(context.Background(), levelInfo, "hidden")
+	l.logf(context.Background(), levelWarn, "shown")
+	if out := logs.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "warn: shown") {
+		t.Errorf("log output = %q", out)
+	}
+}
+
+func TestConfigRejectsUnknownLogLevel(t *testing.T) {
+	if err := (Config{Rules: []TransformRule{{Tag: "r", LogLevel: "loud"}}}).validate(); err == nil {
+		t.Error("expected error for unknown log level")
+	}
+}
+
+func TestLogSummary(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"usage":{"prompt_tokens":12,"completion_tokens":5}}`))
+	}))
+	defer upstream.Close()
+	pre, _ := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} { return p })
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "chat", Type: transformNoop, Pre: pre.URL})
+	l.logSummary = true
+	l.logLevel = levelError
+	logs := captureLog(t)
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body.String())
+	}
+
+	line := regexp.MustCompile(`Request summary: id=\S+ POST /v1/chat/completions rule="chat" transforms="pre:noop,pre:(\S+)" upstream_status=200 duration_ms=[0-9.]+ prompt_tokens=12 completion_tokens=5`)
+	m := line.FindStringSubmatch(logs.String())
+	if m == nil || m[1] != pre.URL {
+		t.Errorf("no summary line in %q", logs.String())
+	}
+
+	// Without the flag there is no summary.
+	logs.Reset()
+	l.logSummary = false
+	l.handleProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	if strings.Contains(logs.String(), "Request summary") {
+		t.Errorf("summary logged without -log-summary: %q", logs.String())
+	}
+}
+
+// Streamed usage is summarised from the same assembled completion the
+// post-transforms receive, without racing them. Run with -race.
+func TestLogSummaryWithStreamAggregate(t *testing.T) {
+	upstream := newSSEUpstream(t, []string{
+		`{"choices":[{"index":0,"delta":{"content":"Hi"}}]}`,
+		`{"choices":[],"usage":{"prompt_tokens":8,"completion_tokens":3}}`,
+		"[DONE]",
+	}, nil)
+	post, calls := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} { return p })
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "chat", Post: post.URL, StreamAggregate: true})
+	l.logSummary = true
+	l.logLevel = levelError
+	logs := captureLog(t)
+
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"stream":true}`)))
+	summary := logs.String()
+	waitFor(t, func() bool { return atomic.LoadInt32(calls) == 1 })
+	if !strings.Contains(summary, "prompt_tokens=8 completion_tokens=3") {
+		t.Errorf("streamed usage missing from summary: %q", summary)
+	}
+}
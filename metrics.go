@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds llsed's Prometheus collectors. Each LLMSed has its own
+// registry so several instances can coexist in one process.
+type metrics struct {
+	registry      *prometheus.Registry
+	shadowDropped prometheus.Counter
+
+	// transformQueueWait observes how long transform calls waited for a
+	// -max-transform-concurrency slot.
+	transformQueueWait prometheus.Histogram
+
+	// ruleQueueWait observes, by rule, how long transform calls waited for
+	// one of the rule's max_concurrent slots.
+	ruleQueueWait *prometheus.HistogramVec
+
+	// upstreamRequests counts forwarded requests by rule and by whether
+	// they went to the primary upstream or the rule's canary.
+	upstreamRequests *prometheus.CounterVec
+
+	// unrouted counts requests no specific rule matched, by reason
+	// (default or none).
+	unrouted *prometheus.CounterVec
+
+	// connsRejected counts connections and requests refused by
+	// -max-conns-per-ip.
+	connsRejected prometheus.Counter
+
+	// panics counts requests whose handler panicked.
+	panics prometheus.Counter
+
+	// tokens counts the tokens upstream responses report using, by rule,
+	// model and kind (prompt or completion).
+	tokens *prometheus.CounterVec
+}
+
+func newMetrics(l *LLMSed) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		shadowDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "llsed_shadow_dropped_total",
+			Help: "Shadow requests dropped because too many were outstanding.",
+		}),
+		transformQueueWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "llsed_transform_queue_wait_seconds",
+			Help:    "Time transform calls waited for a global concurrency slot.",
+			Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10},
+		}),
+		ruleQueueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "llsed_rule_queue_wait_seconds",
+			Help:    "Time transform calls waited for a slot of their rule's max_concurrent limit, by rule.",
+			Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10},
+		}, []string{"rule"}),
+		upstreamRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "llsed_upstream_requests_total",
+			Help: "Requests forwarded upstream, by rule and target (primary or canary).",
+		}, []string{"rule", "target"}),
+		unrouted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "llsed_unrouted_requests_total",
+			Help: "Requests that fell through to the default rule (default) or were not transformed by any rule (none).",
+		}, []string{"reason"}),
+		connsRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "llsed_conns_rejected_total",
+			Help: "Connections, or requests behind a trusted proxy, refused because their client IP was at -max-conns-per-ip.",
+		}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "llsed_panics_total",
+			Help: "Requests whose handler panicked and were answered with a 500.",
+		}),
+		tokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "llsed_tokens_total",
+			Help: "Tokens reported in the usage of upstream responses, by rule, model and kind (prompt or completion).",
+		}, []string{"rule", "model", "kind"}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "llsed_requests_in_flight",
+			Help: "Number of proxied requests currently being handled.",
+		}, func() float64 { return float64(l.inFlight.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "llsed_shadow_requests_in_flight",
+			Help: "Number of shadow requests currently outstanding.",
+		}, func() float64 { return float64(l.shadowInFlight.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "llsed_transforms_in_flight",
+			Help: "Number of transform calls holding a global concurrency slot.",
+		}, func() float64 { return float64(len(l.transformSlots)) }),
+		m.shadowDropped,
+		m.transformQueueWait,
+		m.ruleQueueWait,
+		m.upstreamRequests,
+		m.unrouted,
+		m.connsRejected,
+		m.panics,
+		m.tokens,
+	)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// usageFields are the usage members counted by recordUsage, in the OpenAI
+// and the Anthropic spelling.
+var usageFields = []struct{ field, kind string }{
+	{"prompt_tokens", "prompt"},
+	{"completion_tokens", "completion"},
+	{"input_tokens", "prompt"},
+	{"output_tokens", "completion"},
+}
+
+// usageByKind returns the token counts in a response body's usage object
+// by kind (prompt or completion), nil for bodies without usage.
+func usageByKind(payload map[string]interface{}) map[string]int64 {
+	usage, ok := payload["usage"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	counts := map[string]int64{}
+	for _, f := range usageFields {
+		if n, ok := usage[f.field].(json.Number); ok {
+			if count, err := n.Int64(); err == nil && count > 0 {
+				counts[f.kind] += count
+			}
+		}
+	}
+	return counts
+}
+
+// usageTokens returns the total of the token counts in a response body's
+// usage object, zero for bodies without usage.
+func usageTokens(payload map[string]interface{}) int64 {
+	var total int64
+	for _, count := range usageByKind(payload) {
+		total += count
+	}
+	return total
+}
+
+// recordUsage adds the token counts in a response body's usage object to
+// the tokens counter. Bodies without usage are ignored.
+func (m *metrics) recordUsage(rule string, payload map[string]interface{}) {
+	usage, ok := payload["usage"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	model, _ := payload["model"].(string)
+	for _, f := range usageFields {
+		n, ok := usage[f.field].(json.Number)
+		if !ok {
+			continue
+		}
+		if count, err := n.Float64(); err == nil && count > 0 {
+			m.tokens.WithLabelValues(rule, model, f.kind).Add(count)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInFlightGaugeTracksConcurrentRequests(t *testing.T) {
+	release := make(chan struct{})
+	var arrived sync.WaitGroup
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		<-release
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "passthrough"})
+	h := l.Handler()
+
+	const requests = 3
+	arrived.Add(requests)
+	var done sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+		}()
+	}
+	arrived.Wait()
+
+	expected := `
+# HELP llsed_requests_in_flight Number of proxied requests currently being handled.
+# TYPE llsed_requests_in_flight gauge
+llsed_requests_in_flight 3
+`
+	if err := testutil.GatherAndCompare(l.metrics.registry, strings.NewReader(expected), "llsed_requests_in_flight"); err != nil {
+		t.Error(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	var health struct {
+		InFlight int64 `json:"in_flight"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatalf("decode /healthz: %v", err)
+	}
+	if health.InFlight != requests {
+		t.Errorf("/healthz in_flight = %d, want %d", health.InFlight, requests)
+	}
+
+	close(release)
+	done.Wait()
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "llsed_requests_in_flight 0") {
+		t.Errorf("/metrics after completion:\n%s", rec.Body.String())
+	}
+}
+
+func TestTokenUsageCounters(t *testing.T) {
+	bodies := []string{
+		`{"model":"gpt-4o","usage":{"prompt_tokens":12,"completion_tokens":30,"total_tokens":42}}`,
+		`{"model":"gpt-4o","usage":{"prompt_tokens":8,"completion_tokens":5}}`,
+		`{"model":"claude-3-5-sonnet","usage":{"input_tokens":100,"output_tokens":7}}`,
+		`{"model":"gpt-4o"}`,
+	}
+	var i int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(bodies[i]))
+		i++
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "chat"})
+	for range bodies {
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+		if i == 1 {
+			assertJSON(t, decode(t, rec.Body.String()), bodies[0])
+		}
+	}
+
+	for _, tc := range []struct {
+		model, kind string
+		want        float64
+	}{
+		{"gpt-4o", "prompt", 20},
+		{"gpt-4o", "completion", 35},
+		{"claude-3-5-sonnet", "prompt", 100},
+		{"claude-3-5-sonnet", "completion", 7},
+	} {
+		if got := testutil.ToFloat64(l.metrics.tokens.WithLabelValues("chat", tc.model, tc.kind)); got != tc.want {
+			t.Errorf("%s %s tokens = %v, want %v", tc.model, tc.kind, got, tc.want)
+		}
+	}
+}
+
+// Streamed usage is counted from the assembled completion, with no
+// stream_aggregate or post transform on the rule.
+func TestTokenUsageCountersForStreams(t *testing.T) {
+	upstream := newSSEUpstream(t, []string{
+		`{"id":"c1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":"stop"}]}`,
+		`{"id":"c1","choices":[],"usage":{"prompt_tokens":9,"completion_tokens":4}}`,
+		"[DONE]",
+	}, nil)
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "chat"})
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"stream":true}`)))
+	if rec.Code != http.StatusOK || !strings.HasSuffix(rec.Body.String(), "data: [DONE]\n\n") {
+		t.Fatalf("stream = %d %q", rec.Code, rec.Body)
+	}
+
+	for kind, want := range map[string]float64{"prompt": 9, "completion": 4} {
+		if got := testutil.ToFloat64(l.metrics.tokens.WithLabelValues("chat", "gpt-4o", kind)); got != want {
+			t.Errorf("%s tokens = %v, want %v", kind, got, want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parsePath splits a field path into its segments. Paths are written with
+// dots ("choices.0.message.content") or in JSONPath style
+// ("$.choices[0].message.content"). Numeric segments index arrays.
+func parsePath(path string) ([]string, error) {
+	p := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	p = strings.ReplaceAll(strings.ReplaceAll(p, "[", "."), "]", "")
+
+	segments := strings.Split(p, ".")
+	for _, seg := range segments {
+		if seg == "" {
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+	}
+	return segments, nil
+}
+
+// getPath returns the value at path within v.
+func getPath(v interface{}, path []string) (interface{}, bool) {
+	for _, seg := range path {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[seg]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// setPath stores value at path within root, creating intermediate objects
+// and arrays as needed. An array index may be at most the array's length,
+// which appends.
+func setPath(root map[string]interface{}, path []string, value interface{}) error {
+	if len(path) == 0 {
+		return fmt.Errorf("empty path")
+	}
+	if _, err := setIn(root, path, value); err != nil {
+		return fmt.Errorf("set %s: %w", strings.Join(path, "."), err)
+	}
+	return nil
+}
+
+// setIn sets value at path below node and returns the updated node, which
+// differs from node when an array grew or a container had to be created.
+func setIn(node interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	seg := path[0]
+
+	if node == nil {
+		if _, err := strconv.Atoi(seg); err == nil {
+			node = []interface{}{}
+		} else {
+			node = map[string]interface{}{}
+		}
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, err := setIn(n[seg], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n[seg] = child
+		return n, nil
+	case []interface{}:
+		i, err := strconv.Atoi(seg)
+		if err != nil || i < 0 || i > len(n) {
+			return nil, fmt.Errorf("index %q out of range", seg)
+		}
+		if i == len(n) {
+			n = append(n, nil)
+		}
+		child, err := setIn(n[i], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = child
+		return n, nil
+	default:
+		return nil, fmt.Errorf("%q is not an object or array", seg)
+	}
+}
+
+// deletePath removes the value at path within root. It reports whether a
+// value was removed.
+func deletePath(root map[string]interface{}, path []string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	parentPath, last := path[:len(path)-1], path[len(path)-1]
+	parent, ok := getPath(root, parentPath)
+	if !ok {
+		return false
+	}
+
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := p[last]; !ok {
+			return false
+		}
+		delete(p, last)
+		return true
+	case []interface{}:
+		i, err := strconv.Atoi(last)
+		if err != nil || i < 0 || i >= len(p) {
+			return false
+		}
+		shorter := append(p[:i:i], p[i+1:]...)
+		return setPath(root, parentPath, shorter) == nil
+	}
+	return false
+}
+
+// expandPath resolves the "*" segments of path against v, one concrete path
+// per array element or object key matched, in order. Segments after the last
+// wildcard need not exist yet, so the results can be passed to setPath.
+func expandPath(v interface{}, path []string) [][]string {
+	wild := -1
+	for i, seg := range path {
+		if seg == "*" {
+			wild = i
+		}
+	}
+	if wild < 0 {
+		return [][]string{path}
+	}
+	var out [][]string
+	var walk func(node interface{}, prefix []string, rest []string)
+	walk = func(node interface{}, prefix []string, rest []string) {
+		if len(prefix) > wild {
+			out = append(out, append(append([]string(nil), prefix...), rest...))
+			return
+		}
+		seg := rest[0]
+		if seg != "*" {
+			if next, ok := getPath(node, []string{seg}); ok {
+				walk(next, append(prefix, seg), rest[1:])
+			}
+			return
+		}
+		switch n := node.(type) {
+		case map[string]interface{}:
+			for _, k := range sortedKeys(n) {
+				walk(n[k], append(prefix, k), rest[1:])
+			}
+		case []interface{}:
+			for i, e := range n {
+				walk(e, append(prefix, strconv.Itoa(i)), rest[1:])
+			}
+		}
+	}
+	walk(v, nil, path)
+	return out
+}
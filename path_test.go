@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	for path, want := range map[string][]string{
+		"model":                        {"model"},
+		"choices.0.message.content":    {"choices", "0", "message", "content"},
+		"$.choices[0].message.content": {"choices", "0", "message", "content"},
+		"$.data[1][2]":                 {"data", "1", "2"},
+	} {
+		got, err := parsePath(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+
+	for _, path := range []string{"", "$", "a..b", "a."} {
+		if _, err := parsePath(path); err == nil {
+			t.Errorf("%q: expected error", path)
+		}
+	}
+}
+
+func TestSetGetDeletePath(t *testing.T) {
+	root := map[string]interface{}{}
+	for _, p := range []string{"choices.0.message.content", "choices.0.finish_reason", "choices.1.message.content"} {
+		path, _ := parsePath(p)
+		if err := setPath(root, path, p); err != nil {
+			t.Fatalf("set %s: %v", p, err)
+		}
+	}
+	assertJSON(t, root, `{"choices":[
+		{"message":{"content":"choices.0.message.content"},"finish_reason":"choices.0.finish_reason"},
+		{"message":{"content":"choices.1.message.content"}}
+	]}`)
+
+	path, _ := parsePath("choices.3.x")
+	if err := setPath(root, path, 1); err == nil {
+		t.Error("expected error setting past the end of an array")
+	}
+
+	path, _ = parsePath("choices.0.finish_reason")
+	if v, ok := getPath(root, path); !ok || v != "choices.0.finish_reason" {
+		t.Errorf("get = %v, %v", v, ok)
+	}
+
+	path, _ = parsePath("choices.0")
+	if !deletePath(root, path) {
+		t.Fatal("delete choices.0 failed")
+	}
+	assertJSON(t, root, `{"choices":[{"message":{"content":"choices.1.message.content"}}]}`)
+
+	path, _ = parsePath("missing.field")
+	if deletePath(root, path) {
+		t.Error("deleting a missing path reported success")
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	body := map[string]interface{}{
+		"choices": []interface{}{
+			map[string]interface{}{"n": 1},
+			map[string]interface{}{"n": 2},
+		},
+		"scores": map[string]interface{}{"b": 2, "a": 1},
+	}
+	for path, want := range map[string][]string{
+		"model":         {"model"},
+		"choices.*.n":   {"choices.0.n", "choices.1.n"},
+		"choices.*.x.y": {"choices.0.x.y", "choices.1.x.y"},
+		"scores.*":      {"scores.a", "scores.b"},
+		"missing.*.n":   nil,
+		"choices.*.n.*": nil,
+	} {
+		segments, _ := parsePath(path)
+		var got []string
+		for _, p := range expandPath(body, segments) {
+			got = append(got, strings.Join(p, "."))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expandPath(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Transform stages. A transformer runs either on the incoming request body
+// before it is forwarded or on the upstream response body.
+const (
+	stagePre  = "pre"
+	stagePost = "post"
+)
+
+// transformer is an in-process transform, selected by a rule's "type" and
+// configured through its "params". The registry holds llsed's built-in
+// transforms; being in package main it cannot be reached from other
+// modules, so a new transform is added to the init below.
+type transformer interface {
+	// Stage is stagePre or stagePost.
+	Stage() string
+
+	// Transform returns the transformed body. It may modify payload in
+	// place. A *RejectError refuses the request with its status.
+	Transform(params, payload map[string]interface{}) (map[string]interface{}, error)
+}
+
+// paramsValidator is implemented by transformers that can check a rule's
+// params when the config is loaded, rather than failing at request time.
+type paramsValidator interface {
+	ValidateParams(params map[string]interface{}) error
+}
+
+// transformFunc is the function form of transformer.Transform.
+type transformFunc func(params, payload map[string]interface{}) (map[string]interface{}, error)
+
+// newTransformer returns a transformer that runs fn at stage.
+func newTransformer(stage string, fn transformFunc) transformer {
+	return funcTransformer{stage: stage, fn: fn}
+}
+
+type funcTransformer struct {
+	stage string
+	fn    transformFunc
+}
+
+func (t funcTransformer) Stage() string { return t.stage }
+
+func (t funcTransformer) Transform(params, payload map[string]interface{}) (map[string]interface{}, error) {
+	return t.fn(params, payload)
+}
+
+var transformers = struct {
+	sync.RWMutex
+	byName map[string]transformer
+}{byName: map[string]transformer{}}
+
+// registerTransformer makes t available to rules as "type": name. Built-in
+// transforms are registered at init, and tests register their own. It
+// panics if name is empty or already registered, or t is nil or has an
+// unknown stage.
+func registerTransformer(name string, t transformer) {
+	if name == "" || t == nil {
+		panic("llsed: registerTransformer needs a name and a transformer")
+	}
+	if stage := t.Stage(); stage != stagePre && stage != stagePost {
+		panic(fmt.Sprintf("llsed: transformer %q has unknown stage %q", name, stage))
+	}
+	transformers.Lock()
+	defer transformers.Unlock()
+	if _, dup := transformers.byName[name]; dup {
+		panic(fmt.Sprintf("llsed: transformer %q registered twice", name))
+	}
+	transformers.byName[name] = t
+}
+
+// lookupTransformer returns the transformer registered as name.
+func lookupTransformer(name string) (transformer, bool) {
+	transformers.RLock()
+	defer transformers.RUnlock()
+	t, ok := transformers.byName[name]
+	return t, ok
+}
+
+// transformerNames returns the registered transformer names, sorted.
+func transformerNames() []string {
+	transformers.RLock()
+	defer transformers.RUnlock()
+	names := make([]string, 0, len(transformers.byName))
+	for name := range transformers.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// celTransformer compiles its expression when the config is loaded.
+type celTransformer struct {
+	name  string
+	stage string
+}
+
+func (t celTransformer) Stage() string { return t.stage }
+
+func (t celTransformer) Transform(params, payload map[string]interface{}) (map[string]interface{}, error) {
+	return celTransform(t.name, params, payload)
+}
+
+func (t celTransformer) ValidateParams(params map[string]interface{}) error {
+	_, err := celProgram(t.name, params)
+	return err
+}
+
+func init() {
+	for name, fn := range map[string]transformFunc{
+		transformSystemPrompt:   systemPrompt,
+		transformTokenLimit:     tokenLimit,
+		transformModelAlias:     modelAlias,
+		transformTemplate:       renderTemplate,
+		transformAllowModels:    allowModels,
+		transformDedupMessages:  dedupMessages,
+		transformNormalizeSpace: normalizeWhitespace,
+		transformLimitMessages:  limitMessages,
+		transformNoop:           noop,
+		transformDetectLanguage: detectLanguage,
+		transformRename: func(params, payload map[string]interface{}) (map[string]interface{}, error) {
+			return renameFields(transformRename, params, payload)
+		},
+	} {
+		registerTransformer(name, newTransformer(stagePre, fn))
+	}
+	for name, fn := range map[string]transformFunc{
+		transformNormalizeResponse: normalizeResponse,
+		transformJSONPath:          jsonPathOperations,
+		transformRenameResponse: func(params, payload map[string]interface{}) (map[string]interface{}, error) {
+			return renameFields(transformRenameResponse, params, payload)
+		},
+	} {
+		registerTransformer(name, newTransformer(stagePost, fn))
+	}
+	registerTransformer(transformCEL, celTransformer{name: transformCEL, stage: stagePre})
+	registerTransformer(transformCELResponse, celTransformer{name: transformCELResponse, stage: stagePost})
+	registerTransformer(transformScript, scriptTransformer{name: transformScript, stage: stagePre})
+	registerTransformer(transformScriptResponse, scriptTransformer{name: transformScriptResponse, stage: stagePost})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// upperModel is a transformer registered the way the built-ins are.
+type upperModel struct{}
+
+func (upperModel) Stage() string { return stagePre }
+
+func (upperModel) Transform(params, payload map[string]interface{}) (map[string]interface{}, error) {
+	model, _ := payload["model"].(string)
+	payload["model"] = strings.ToUpper(model) + params["suffix"].(string)
+	return payload, nil
+}
+
+func (upperModel) ValidateParams(params map[string]interface{}) error {
+	if _, ok := params["suffix"].(string); !ok {
+		return errNoSuffix
+	}
+	return nil
+}
+
+var errNoSuffix = errors.New("params.suffix must be a string")
+
+func init() {
+	registerTransformer("test-upper-model", upperModel{})
+	registerTransformer("test-tag-response", newTransformer(stagePost, func(params, payload map[string]interface{}) (map[string]interface{}, error) {
+		payload["tagged"] = true
+		return payload, nil
+	}))
+}
+
+func TestCustomTransformerViaRule(t *testing.T) {
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		forwarded = string(body)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer upstream.Close()
+
+	config := Config{Rules: []TransformRule{{Tag: "custom", Type: "test-upper-model", Params: map[string]interface{}{"suffix": "-x"}}}}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	newLLMSed(config, upstream.URL).Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d: %s", rec.Code, rec.Body)
+	}
+	if forwarded != `{"model":"GPT-4O-x"}` {
+		t.Errorf("forwarded %s", forwarded)
+	}
+
+	rule := TransformRule{Type: "test-tag-response"}
+	if isRequestTransform(rule.Type) || !isResponseTransform(rule.Type) {
+		t.Error("response transformer registered for the wrong stage")
+	}
+	out, err := applyResponseTransform("", rule, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"tagged":true}`)
+}
+
+func TestTransformerParamsValidatedAtLoad(t *testing.T) {
+	config := Config{Rules: []TransformRule{{Tag: "custom", Type: "test-upper-model"}}}
+	if err := config.validate(); !errors.Is(err, errNoSuffix) {
+		t.Errorf("err = %v, want params error", err)
+	}
+
+	config = Config{Rules: []TransformRule{{Tag: "typo", Type: "test-upper-modle"}}}
+	err := config.validate()
+	if err == nil || !strings.Contains(err.Error(), `unknown transform type "test-upper-modle"`) || !strings.Contains(err.Error(), "test-upper-model") {
+		t.Errorf("err = %v, want unknown type listing registered types", err)
+	}
+}
+
+func TestRegisterTransformerPanicsOnDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a built-in name twice did not panic")
+		}
+	}()
+	registerTransformer(transformRename, upperModel{})
+}
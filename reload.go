@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// reload re-reads the config file and swaps it in if it is valid. On error
+// the running config is left untouched. It returns the number of rules
+// loaded.
+func (l *LLMSed) reload() (int, error) {
+	if l.configPath == "" {
+		return 0, fmt.Errorf("%w: no config file to reload", ErrConfig)
+	}
+	config, err := loadConfig(l.configPath)
+	if err != nil {
+		return 0, err
+	}
+	if err := config.checkChains(l.maxChainSteps); err != nil {
+		return 0, err
+	}
+	if err := config.checkScripts(l.scriptDir); err != nil {
+		return 0, err
+	}
+	l.config.Store(&config)
+	return len(config.Rules), nil
+}
+
+// refreshConfig reloads the config every interval until ctx ends. A failed
+// reload keeps the last good config.
+func (l *LLMSed) refreshConfig(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := l.reload(); err != nil {
+				log.Printf("Config refresh failed, keeping current config: %v", err)
+			}
+		}
+	}
+}
+
+// reloadOnSignal reloads the config each time a signal arrives, until ctx
+// ends.
+func (l *LLMSed) reloadOnSignal(ctx context.Context, signals <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			if n, err := l.reload(); err != nil {
+				log.Printf("Config reload failed, keeping current config: %v", err)
+			} else {
+				log.Printf("Reloaded config from %s: %d rules", l.configPath, n)
+			}
+		}
+	}
+}
+
+// requireAdmin rejects requests that do not carry the admin token as a
+// bearer token.
+func (l *LLMSed) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(l.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (l *LLMSed) handleReload(w http.ResponseWriter, r *http.Request) {
+	n, err := l.reload()
+	if err != nil {
+		log.Printf("Config reload failed, keeping current config: %v", err)
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	log.Printf("Reloaded config from %s: %d rules", l.configPath, n)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"rules": n})
+}
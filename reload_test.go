@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newReloadableLLMSed writes config to a temp file and loads it.
+func newReloadableLLMSed(t *testing.T, config string) (*LLMSed, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLLMSed(path, "http://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.adminToken = "s3cret"
+	return l, path
+}
+
+func postReload(h http.Handler, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminReloadSwapsConfig(t *testing.T) {
+	l, path := newReloadableLLMSed(t, `{"rules":[{"tag":"old"}]}`)
+	h := l.Handler()
+
+	os.WriteFile(path, []byte(`{"rules":[{"tag":"new"},{"tag":"other"}]}`), 0o644)
+	rec := postReload(h, "s3cret")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"rules":2}` {
+		t.Fatalf("code %d body %s", rec.Code, rec.Body.String())
+	}
+	if rule, _ := l.selectRule(httptest.NewRequest(http.MethodPost, "/", nil)); rule.Tag != "new" {
+		t.Errorf("rule after reload = %q, want new", rule.Tag)
+	}
+
+	// An invalid config is reported and the running one kept.
+	os.WriteFile(path, []byte(`{"rules":[{"tag":"bad","type":"nope"}]}`), 0o644)
+	rec = postReload(h, "s3cret")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `unknown transform type \"nope\"`) {
+		t.Fatalf("code %d body %s", rec.Code, rec.Body.String())
+	}
+	if rule, _ := l.selectRule(httptest.NewRequest(http.MethodPost, "/", nil)); rule.Tag != "new" {
+		t.Errorf("rule after failed reload = %q, want new", rule.Tag)
+	}
+}
+
+func TestAdminReloadRequiresToken(t *testing.T) {
+	l, path := newReloadableLLMSed(t, `{"rules":[{"tag":"old"}]}`)
+	h := l.Handler()
+	os.WriteFile(path, []byte(`{"rules":[{"tag":"new"}]}`), 0o644)
+
+	for _, token := range []string{"", "wrong"} {
+		if rec := postReload(h, token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: code = %d, want 401", token, rec.Code)
+		}
+	}
+	if rule, _ := l.selectRule(httptest.NewRequest(http.MethodPost, "/", nil)); rule.Tag != "old" {
+		t.Errorf("rule = %q, config reloaded without auth", rule.Tag)
+	}
+
+	// Without -admin-token the endpoint is not served at all.
+	l.adminToken = ""
+	if rec := postReload(l.Handler(), ""); rec.Code == http.StatusOK || rec.Code == http.StatusUnauthorized {
+		t.Errorf("disabled admin endpoint answered %d", rec.Code)
+	}
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	l, path := newReloadableLLMSed(t, `{"rules":[{"tag":"old"}]}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal)
+	go l.reloadOnSignal(ctx, signals)
+
+	os.WriteFile(path, []byte(`{"rules":[{"tag":"new"}]}`), 0o644)
+	signals <- syscall.SIGHUP
+	waitFor(t, func() bool { return l.config.Load().Rules[0].Tag == "new" })
+}
+
+func TestConfigFetchedFromURLAndRefreshed(t *testing.T) {
+	var mu sync.Mutex
+	config, status := `{"rules":[{"tag":"remote"}]}`, http.StatusOK
+	configServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(config))
+	}))
+	defer configServer.Close()
+	upstream := newEchoUpstream(t)
+
+	l, err := NewLLMSed(configServer.URL+"/llsed.json", upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag := l.config.Load().Rules[0].Tag; tag != "remote" {
+		t.Fatalf("rule = %q, want remote", tag)
+	}
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d", rec.Code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.refreshConfig(ctx, 10*time.Millisecond)
+
+	mu.Lock()
+	config = `{"rules":[{"tag":"refreshed"}]}`
+	mu.Unlock()
+	waitFor(t, func() bool { return l.config.Load().Rules[0].Tag == "refreshed" })
+
+	// A failing config server leaves the last good config in place.
+	mu.Lock()
+	status = http.StatusInternalServerError
+	mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	if tag := l.config.Load().Rules[0].Tag; tag != "refreshed" {
+		t.Errorf("rule after failed refresh = %q, want refreshed", tag)
+	}
+}
+
+func TestNewLLMSedReportsConfigServerErrors(t *testing.T) {
+	configServer := httptest.NewServer(http.NotFoundHandler())
+	defer configServer.Close()
+
+	if _, err := NewLLMSed(configServer.URL, "http://127.0.0.1:0"); !errors.Is(err, ErrConfig) || !strings.Contains(err.Error(), "404") {
+		t.Errorf("err = %v, want config error naming the 404", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy overrides -upstream-retries for one rule's upstream
+// requests.
+type RetryPolicy struct {
+	// MaxAttempts is the most times a request is sent, the first attempt
+	// included, so 1 never retries. Zero keeps -upstream-retries.
+	MaxAttempts int `json:"max_attempts"`
+
+	// Statuses are the upstream statuses worth retrying, by default 502,
+	// 503 and 504. Requests that get no response are always retried.
+	Statuses []StatusRange `json:"statuses"`
+
+	// Backoff is the wait before the first retry, doubled before each one
+	// after it. Zero retries at once.
+	Backoff Duration `json:"backoff"`
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("retry max_attempts must not be negative, got %d", p.MaxAttempts)
+	}
+	if p.Backoff < 0 {
+		return fmt.Errorf("retry backoff must not be negative, got %s", time.Duration(p.Backoff))
+	}
+	return nil
+}
+
+// defaultRetryStatuses are the upstream statuses retried unless a rule's
+// retry policy lists its own.
+var defaultRetryStatuses = []StatusRange{
+	{Min: http.StatusBadGateway, Max: http.StatusGatewayTimeout},
+}
+
+// retryPolicy returns the retry policy for rule's upstream requests: its
+// own, with -upstream-retries and the default statuses filling what it
+// leaves unset.
+func (l *LLMSed) retryPolicy(rule TransformRule) RetryPolicy {
+	policy := RetryPolicy{MaxAttempts: l.upstreamRetries + 1}
+	if rule.Retry != nil {
+		policy.Statuses, policy.Backoff = rule.Retry.Statuses, rule.Retry.Backoff
+		if rule.Retry.MaxAttempts > 0 {
+			policy.MaxAttempts = rule.Retry.MaxAttempts
+		}
+	}
+	if len(policy.Statuses) == 0 {
+		policy.Statuses = defaultRetryStatuses
+	}
+	return policy
+}
+
+// retryable reports whether an upstream attempt failed in a way that is
+// worth sending the request again.
+func (p RetryPolicy) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	for _, s := range p.Statuses {
+		if s.Contains(resp.StatusCode) {
+			return true
+		}
+	}
+	return false
+}
+
+// wait sleeps before the retry that follows the given attempt, returning
+// false if ctx ends first.
+func (p RetryPolicy) wait(ctx context.Context, attempt int) bool {
+	if p.Backoff <= 0 {
+		return true
+	}
+	timer := time.NewTimer(time.Duration(p.Backoff) << (attempt - 1))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
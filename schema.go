@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// requestSchemas caches compiled request_schema values by their raw JSON,
+// either an inline schema or a quoted file path. Loading the config
+// compiles them again, so a reload picks up an edited schema file.
+var requestSchemas sync.Map
+
+// compileRequestSchema compiles a rule's request_schema and caches it.
+func compileRequestSchema(raw json.RawMessage) (*jsonschema.Schema, error) {
+	c := jsonschema.NewCompiler()
+	var location string
+	if err := json.Unmarshal(raw, &location); err != nil {
+		doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("request_schema: %w", err)
+		}
+		location = "request_schema.json"
+		if err := c.AddResource(location, doc); err != nil {
+			return nil, fmt.Errorf("request_schema: %w", err)
+		}
+	} else if location == "" {
+		return nil, fmt.Errorf("request_schema: file path is empty")
+	}
+	schema, err := c.Compile(location)
+	if err != nil {
+		return nil, fmt.Errorf("request_schema: %w", err)
+	}
+	requestSchemas.Store(string(raw), schema)
+	return schema, nil
+}
+
+// requestSchema returns the compiled schema for raw.
+func requestSchema(raw json.RawMessage) (*jsonschema.Schema, error) {
+	if schema, ok := requestSchemas.Load(string(raw)); ok {
+		return schema.(*jsonschema.Schema), nil
+	}
+	return compileRequestSchema(raw)
+}
+
+// validateRequestSchema checks the request body against the rule's
+// request_schema, if any. A body that does not match is refused with a 400
+// listing every violation.
+func validateRequestSchema(rule TransformRule, payload map[string]interface{}) error {
+	if len(rule.RequestSchema) == 0 {
+		return nil
+	}
+	schema, err := requestSchema(rule.RequestSchema)
+	if err != nil {
+		return err
+	}
+	err = schema.Validate(payload)
+	if err == nil {
+		return nil
+	}
+	verr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return err
+	}
+	var problems []string
+	collectSchemaErrors(verr.DetailedOutput(), &problems)
+	return &RejectError{
+		Status:  http.StatusBadRequest,
+		Message: "request body does not match request_schema: " + strings.Join(problems, "; "),
+	}
+}
+
+// collectSchemaErrors appends the leaf errors of out, each prefixed with the
+// JSON pointer of the offending value.
+func collectSchemaErrors(out *jsonschema.OutputUnit, problems *[]string) {
+	if len(out.Errors) == 0 {
+		if out.Error != nil {
+			location := out.InstanceLocation
+			if location == "" {
+				location = "/"
+			}
+			*problems = append(*problems, fmt.Sprintf("%s: %s", location, out.Error))
+		}
+		return
+	}
+	for i := range out.Errors {
+		collectSchemaErrors(&out.Errors[i], problems)
+	}
+}
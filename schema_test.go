@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const chatSchema = `{
+	"type": "object",
+	"required": ["model", "messages"],
+	"properties": {
+		"model": {"type": "string"},
+		"max_tokens": {"type": "integer", "minimum": 1},
+		"messages": {
+			"type": "array",
+			"minItems": 1,
+			"items": {"type": "object", "required": ["role", "content"]}
+		}
+	}
+}`
+
+func TestRequestSchema(t *testing.T) {
+	var forwarded int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&forwarded, 1)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "chat.schema.json")
+	if err := os.WriteFile(path, []byte(chatSchema), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fromFile, _ := json.Marshal(path)
+
+	for name, schema := range map[string]json.RawMessage{"inline": json.RawMessage(chatSchema), "file": fromFile} {
+		atomic.StoreInt32(&forwarded, 0)
+		cfg := Config{Rules: []TransformRule{{RequestSchema: schema}}}
+		if err := cfg.validate(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		l := newTestLLMSed(upstream.URL, cfg.Rules...)
+		send := func(body string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+			return rec
+		}
+
+		if rec := send(`{"model":"gpt-4o","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`); rec.Code != http.StatusOK {
+			t.Errorf("%s: valid body: code %d: %s", name, rec.Code, rec.Body.String())
+		}
+		rec := send(`{"model":"gpt-4o","max_tokens":0,"messages":[{"content":"hi"}]}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: invalid body: code %d", name, rec.Code)
+		}
+		for _, want := range []string{"/max_tokens:", "/messages/0: missing property 'role'"} {
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("%s: error %q does not mention %q", name, rec.Body.String(), want)
+			}
+		}
+		if n := atomic.LoadInt32(&forwarded); n != 1 {
+			t.Errorf("%s: %d requests forwarded, want only the valid one", name, n)
+		}
+	}
+}
+
+func TestRequestSchemaRunsAfterPreTransforms(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	rule := TransformRule{
+		Type:          transformModelAlias,
+		Params:        map[string]interface{}{"fast": "gpt-4o-mini"},
+		RequestSchema: json.RawMessage(`{"properties": {"model": {"enum": ["gpt-4o-mini"]}}}`),
+	}
+	l := newTestLLMSed(upstream.URL, rule)
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"fast"}`)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("aliased model rejected: code %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestInvalidRequestSchemaFailsLoad(t *testing.T) {
+	for _, schema := range []string{`{"type": 7}`, `"/nonexistent/schema.json"`, `""`} {
+		cfg := Config{Rules: []TransformRule{{Tag: "bad", RequestSchema: json.RawMessage(schema)}}}
+		if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "request_schema") {
+			t.Errorf("%s: err = %v", schema, err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+)
+
+// scriptMaxSteps bounds the Starlark steps one script call may take, so a
+// runaway loop fails the transform rather than hanging the request.
+const scriptMaxSteps = 10_000_000
+
+// scriptExt is the file extension of transform scripts.
+const scriptExt = ".star"
+
+// compiledScript is a loaded script's transform function, with the file
+// state it was loaded from so edits are picked up.
+type compiledScript struct {
+	modTime time.Time
+	size    int64
+	fn      starlark.Callable
+}
+
+// scripts caches compiled scripts by path.
+var scripts sync.Map
+
+// scriptName returns the file name the "script" param names.
+func scriptName(name string, params map[string]interface{}) (string, error) {
+	script, _ := params["script"].(string)
+	if script == "" {
+		return "", fmt.Errorf("%s: params.script is required", name)
+	}
+	if script != filepath.Base(script) || strings.HasPrefix(script, ".") {
+		return "", fmt.Errorf("%s: params.script must be a file name in -script-dir, got %q", name, script)
+	}
+	if filepath.Ext(script) == "" {
+		script += scriptExt
+	}
+	return script, nil
+}
+
+// scriptPath returns the file the "script" param names within dir, the
+// -script-dir.
+func scriptPath(dir, name string, params map[string]interface{}) (string, error) {
+	script, err := scriptName(name, params)
+	if err != nil {
+		return "", err
+	}
+	if dir == "" {
+		return "", fmt.Errorf("%s: no -script-dir to load %s from", name, script)
+	}
+	return filepath.Join(dir, script), nil
+}
+
+// loadScript returns the transform function of the script at path,
+// compiling it on first use and again whenever the file changes.
+func loadScript(path string) (starlark.Callable, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := scripts.Load(path); ok {
+		if c := cached.(compiledScript); c.modTime.Equal(info.ModTime()) && c.size == info.Size() {
+			return c.fn, nil
+		}
+	}
+
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	thread := &starlark.Thread{Name: path}
+	thread.SetMaxExecutionSteps(scriptMaxSteps)
+	globals, err := starlark.ExecFile(thread, filepath.Base(path), src, starlark.StringDict{"json": starlarkjson.Module})
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := globals["transform"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s defines no transform(payload, params) function", filepath.Base(path))
+	}
+	scripts.Store(path, compiledScript{modTime: info.ModTime(), size: info.Size(), fn: fn})
+	return fn, nil
+}
+
+// scriptTransform runs a Starlark script from dir, the -script-dir, on the
+// body. The script defines transform(payload, params), which gets the body
+// and the rule's params as dicts and returns the new body. Values cross as
+// JSON, so integers keep every digit.
+//
+// Params:
+//   - script: the file name in -script-dir, ".star" being optional
+//     (required). All params, script included, are passed to the script.
+func scriptTransform(dir, name string, params, payload map[string]interface{}) (map[string]interface{}, error) {
+	path, err := scriptPath(dir, name, params)
+	if err != nil {
+		return nil, err
+	}
+	fn, err := loadScript(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	payloadValue, err := toStarlark(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	paramsValue, err := toStarlark(params)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	thread := &starlark.Thread{Name: path}
+	thread.SetMaxExecutionSteps(scriptMaxSteps)
+	result, err := starlark.Call(thread, fn, starlark.Tuple{payloadValue, paramsValue}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", name, filepath.Base(path), err)
+	}
+	if _, ok := result.(*starlark.Dict); !ok {
+		return nil, fmt.Errorf("%s: %s: transform returned %s, not a dict", name, filepath.Base(path), result.Type())
+	}
+	return fromStarlark(result)
+}
+
+// toStarlark and fromStarlark convert bodies through Starlark's json module.
+func toStarlark(v interface{}) (starlark.Value, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decode := starlarkjson.Module.Members["decode"]
+	return starlark.Call(&starlark.Thread{}, decode, starlark.Tuple{starlark.String(data)}, nil)
+}
+
+func fromStarlark(v starlark.Value) (map[string]interface{}, error) {
+	encode := starlarkjson.Module.Members["encode"]
+	data, err := starlark.Call(&starlark.Thread{}, encode, starlark.Tuple{v}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	if err := decodeJSON([]byte(data.(starlark.String)), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// scriptTransformer runs scripts from dir. It is registered without one;
+// withScriptDir gives it the -script-dir of the LLMSed running it.
+type scriptTransformer struct {
+	name  string
+	stage string
+	dir   string
+}
+
+func (t scriptTransformer) Stage() string { return t.stage }
+
+func (t scriptTransformer) Transform(params, payload map[string]interface{}) (map[string]interface{}, error) {
+	return scriptTransform(t.dir, t.name, params, payload)
+}
+
+// ValidateParams checks the script's name; checkScripts loads it.
+func (t scriptTransformer) ValidateParams(params map[string]interface{}) error {
+	_, err := scriptName(t.name, params)
+	return err
+}
+
+// withScriptDir returns t to run scripts from dir, if t is a script
+// transformer.
+func withScriptDir(t transformer, dir string) transformer {
+	if s, ok := t.(scriptTransformer); ok {
+		s.dir = dir
+		return s
+	}
+	return t
+}
+
+// checkScripts reports the first rule whose script does not load from dir,
+// the -script-dir, so a broken script fails the config load rather than
+// its requests.
+func (c Config) checkScripts(dir string) error {
+	for i, rule := range c.Rules {
+		if rule.Type != transformScript && rule.Type != transformScriptResponse {
+			continue
+		}
+		path, err := scriptPath(dir, rule.Type, rule.Params)
+		if err == nil {
+			_, err = loadScript(path)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: rule %d (%s): %s: %w", ErrConfig, i, rule.Tag, rule.Type, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useScripts returns a temporary -script-dir holding scripts.
+func useScripts(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestScriptTransformMutatesBody(t *testing.T) {
+	dir := useScripts(t, map[string]string{"model.star": `
+def transform(payload, params):
+    payload["model"] = params["model"]
+    payload["max_tokens"] = payload["max_tokens"] + 1
+    return payload
+`})
+	rule := TransformRule{Type: transformScript, Params: map[string]interface{}{"script": "model", "model": "gpt-4o"}}
+	config := Config{Rules: []TransformRule{rule}}
+	if _, err := config.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if err := config.checkScripts(dir); err != nil {
+		t.Fatalf("checkScripts: %v", err)
+	}
+	var payload map[string]interface{}
+	decodeJSON([]byte(`{"model":"gpt-4","max_tokens":9007199254740993}`), &payload)
+	out, err := applyRequestTransform(dir, rule, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out["model"] != "gpt-4o" || out["max_tokens"] != json.Number("9007199254740994") {
+		t.Errorf("got %v, want the new model and max_tokens with every digit kept", out)
+	}
+}
+
+func TestScriptTransformErrors(t *testing.T) {
+	dir := useScripts(t, map[string]string{
+		"reject.star": `
+def transform(payload, params):
+    fail("no model in " + json.encode(payload))
+`,
+		"broken.star":  "def transform(payload, params) return payload\n",
+		"nothing.star": "x = 1\n",
+	})
+	rule := TransformRule{Type: transformScriptResponse, Params: map[string]interface{}{"script": "reject.star"}}
+	_, err := applyResponseTransform(dir, rule, decode(t, `{"id":"x"}`))
+	if err == nil || !strings.Contains(err.Error(), `no model in {"id":"x"}`) {
+		t.Errorf("err = %v, want the script's failure", err)
+	}
+
+	for _, script := range []string{"broken", "nothing", "missing", "../reject.star"} {
+		bad := TransformRule{Type: transformScript, Params: map[string]interface{}{"script": script}}
+		config := Config{Rules: []TransformRule{bad}}
+		if _, err := config.Validate(); err == nil {
+			if err := config.checkScripts(dir); !errors.Is(err, ErrConfig) {
+				t.Errorf("script %q: expected a config error, got %v", script, err)
+			}
+		}
+	}
+	if err := (Config{Rules: []TransformRule{rule}}).checkScripts(""); err == nil || !strings.Contains(err.Error(), "no -script-dir") {
+		t.Errorf("no -script-dir: err = %v", err)
+	}
+}
+
+func TestScriptDirIsPerInstance(t *testing.T) {
+	script := func(model string) map[string]string {
+		return map[string]string{"model.star": "def transform(payload, params):\n    payload[\"model\"] = \"" + model + "\"\n    return payload\n"}
+	}
+	var forwarded map[string]interface{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&forwarded)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	rule := TransformRule{Type: transformScript, Params: map[string]interface{}{"script": "model"}}
+	for _, model := range []string{"a", "b"} {
+		l := newTestLLMSed(upstream.URL, rule)
+		l.scriptDir = useScripts(t, script(model))
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+		if rec.Code != http.StatusOK || forwarded["model"] != model {
+			t.Errorf("script dir %s: code %d, forwarded %v", model, rec.Code, forwarded)
+		}
+	}
+}
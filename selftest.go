@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Sample holds example bodies that -selftest runs a rule's transforms on.
+type Sample struct {
+	Request  map[string]interface{} `json:"request"`
+	Response map[string]interface{} `json:"response"`
+}
+
+// selfTest runs each rule's request transforms on its sample request and its
+// response transforms on its sample response, logging each result. Rules
+// without a sample are skipped. Every failure is reported, and a failed
+// transform counts even when the rule's on_error is "skip".
+func (l *LLMSed) selfTest(ctx context.Context) error {
+	var errs []error
+	for i, rule := range l.config.Load().Rules {
+		if rule.Sample == nil {
+			continue
+		}
+		rule.OnError = onErrorFail
+		rule.PostOnStatus = nil
+
+		if rule.Sample.Request != nil {
+			out, err := l.transformRequest(ctx, rule, rule.Sample.Request)
+			errs = append(errs, logSelfTest(i, rule, "request", out, err))
+		}
+		if rule.Sample.Response != nil {
+			out, err := l.transformResponse(withOriginalRequest(ctx, rule.Sample.Request), rule, http.StatusOK, rule.Sample.Response)
+			errs = append(errs, logSelfTest(i, rule, "response", out, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func logSelfTest(i int, rule TransformRule, sample string, out map[string]interface{}, err error) error {
+	if err != nil {
+		log.Printf("Self-test rule %d (%s) %s: FAILED: %v", i, rule.Tag, sample, err)
+		return fmt.Errorf("rule %d (%s) %s: %w", i, rule.Tag, sample, err)
+	}
+	result, _ := json.Marshal(out)
+	log.Printf("Self-test rule %d (%s) %s: %s", i, rule.Tag, sample, result)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSelfTestRunsSamples(t *testing.T) {
+	pre, _ := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		p["model"] = "gpt-4o"
+		return p
+	})
+	post, postCalls := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} { return p })
+	l := newTestLLMSed("http://127.0.0.1:0",
+		TransformRule{Tag: "upgrade", Pre: pre.URL, Post: post.URL, Type: transformRenameResponse,
+			Params: map[string]interface{}{"fields": map[string]interface{}{"text": "content"}},
+			Sample: &Sample{
+				Request:  map[string]interface{}{"model": "gpt-4"},
+				Response: map[string]interface{}{"text": "hi"},
+			}},
+		TransformRule{Tag: "unsampled", Pre: "http://127.0.0.1:1"},
+	)
+
+	logs := captureLog(t)
+	if err := l.selfTest(context.Background()); err != nil {
+		t.Fatalf("self-test failed: %v", err)
+	}
+	for _, want := range []string{
+		`Self-test rule 0 (upgrade) request: {"model":"gpt-4o"}`,
+		`Self-test rule 0 (upgrade) response: {"content":"hi"}`,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log missing %q:\n%s", want, logs)
+		}
+	}
+	if *postCalls != 1 {
+		t.Errorf("post-transform called %d times, want 1", *postCalls)
+	}
+}
+
+func TestSelfTestFailsBrokenRule(t *testing.T) {
+	l := newTestLLMSed("http://127.0.0.1:0",
+		TransformRule{Tag: "ok", Type: transformModelAlias, Params: map[string]interface{}{"a": "b"},
+			Sample: &Sample{Request: map[string]interface{}{"model": "a"}}},
+		TransformRule{Tag: "broken", Pre: "http://127.0.0.1:1", OnError: onErrorSkip,
+			Sample: &Sample{Request: map[string]interface{}{"model": "a"}}},
+		TransformRule{Tag: "bad-params", Type: transformTemplate,
+			Sample: &Sample{Request: map[string]interface{}{}}},
+	)
+
+	captureLog(t)
+	err := l.selfTest(context.Background())
+	if err == nil {
+		t.Fatal("self-test passed with broken rules")
+	}
+	for _, want := range []string{"rule 1 (broken) request:", "rule 2 (bad-params) request:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "(ok)") {
+		t.Errorf("error reports the passing rule: %v", err)
+	}
+}
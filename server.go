@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// internalRoute is an endpoint served by llsed itself instead of being
+// proxied upstream.
+type internalRoute struct {
+	methods []string
+	handler http.HandlerFunc
+}
+
+// internalRoutes is the central table of llsed's own endpoints and the
+// methods each one accepts.
+func (l *LLMSed) internalRoutes() map[string]internalRoute {
+	routes := map[string]internalRoute{
+		"/healthz": {methods: []string{http.MethodGet, http.MethodHead}, handler: l.handleHealth},
+		"/readyz":  {methods: []string{http.MethodGet, http.MethodHead}, handler: l.handleReady},
+		"/metrics": {methods: []string{http.MethodGet, http.MethodHead}, handler: l.metrics.handler().ServeHTTP},
+	}
+	if l.adminToken != "" {
+		routes["/admin/reload"] = internalRoute{methods: []string{http.MethodPost}, handler: l.requireAdmin(l.handleReload)}
+		routes["/admin/drain"] = internalRoute{methods: []string{http.MethodPost, http.MethodDelete}, handler: l.requireAdmin(l.handleDrain)}
+	}
+	return routes
+}
+
+// Handler returns the root HTTP handler. Internal routes are guarded by their
+// method allowlist; every other path is proxied with any method. With a
+// separate admin address the internal routes are left to AdminHandler and
+// every other path is proxied, except under internalPrefixes, which are
+// still not found.
+func (l *LLMSed) Handler() http.Handler {
+	mux := http.NewServeMux()
+	if l.adminAddr == "" {
+		l.handleInternalRoutes(mux)
+	} else {
+		handleInternalPrefixes(mux)
+	}
+	proxy := l.limitClientRequests(l.trackInFlight(l.recoverPanics(l.cassettes(l.captured(http.HandlerFunc(l.handleProxy))))))
+	mux.Handle("/", proxy)
+	if l.rootAction != "" && l.rootAction != rootForward {
+		mux.Handle("/{$}", l.rootHandler(proxy))
+	}
+	return mux
+}
+
+// Actions for requests to the bare root path, chosen with -root-action.
+const (
+	rootForward  = "forward"
+	rootInfo     = "info"
+	rootRedirect = "redirect"
+	rootRewrite  = "rewrite"
+)
+
+// checkRootAction reports whether action is a -root-action, with the
+// -root-target path that redirect and rewrite need.
+func checkRootAction(action, target string) error {
+	switch action {
+	case "", rootForward, rootInfo:
+		return nil
+	case rootRedirect, rootRewrite:
+		if !strings.HasPrefix(target, "/") || target == "/" {
+			return fmt.Errorf("%s needs a -root-target path such as /v1/chat/completions, got %q", action, target)
+		}
+		return nil
+	}
+	return fmt.Errorf("%q is not %s, %s, %s or %s", action, rootForward, rootInfo, rootRedirect, rootRewrite)
+}
+
+// rootHandler answers requests to "/", which LLM APIs rarely serve, as
+// -root-action says: with a JSON hint, a redirect to -root-target, or by
+// proxying them as requests to -root-target.
+func (l *LLMSed) rootHandler(proxy http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch l.rootAction {
+		case rootInfo:
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{
+				"error": map[string]interface{}{
+					"message": "llsed proxies API paths such as /v1/chat/completions to the upstream; / is not one of them",
+					"type":    "llsed_error",
+				},
+			})
+		case rootRedirect:
+			target := l.rootTarget
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			// 307 keeps the method and body, so a POST is retried as a POST.
+			http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+		case rootRewrite:
+			r = r.Clone(r.Context())
+			r.URL.Path, r.URL.RawPath = l.rootTarget, ""
+			proxy.ServeHTTP(w, r)
+		default:
+			proxy.ServeHTTP(w, r)
+		}
+	})
+}
+
+// AdminHandler serves only the internal routes, for the -admin-addr
+// listener. Other paths are not found.
+func (l *LLMSed) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	l.handleInternalRoutes(mux)
+	mux.HandleFunc("/", internalNotFound)
+	return mux
+}
+
+// internalPrefixes are path namespaces that belong to llsed. Paths under
+// them that match no internal route are not found rather than proxied, so
+// a typo such as /admin/relaod does not reach the upstream.
+var internalPrefixes = []string{"/admin/"}
+
+func (l *LLMSed) handleInternalRoutes(mux *http.ServeMux) {
+	for path, route := range l.internalRoutes() {
+		mux.Handle(path, allowMethods(route.handler, route.methods...))
+	}
+	handleInternalPrefixes(mux)
+}
+
+func handleInternalPrefixes(mux *http.ServeMux) {
+	for _, prefix := range internalPrefixes {
+		mux.HandleFunc(prefix, internalNotFound)
+	}
+}
+
+// internalNotFound answers with a JSON 404 in the OpenAI error shape.
+func internalNotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusNotFound, map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": fmt.Sprintf("no llsed endpoint at %s", r.URL.Path),
+			"type":    "llsed_error",
+		},
+	})
+}
+
+// serverTimeouts bound how long a client connection may take over each
+// part of a request. Zero disables each one.
+type serverTimeouts struct {
+	// readHeader bounds reading the request headers.
+	readHeader time.Duration
+
+	// read bounds reading the whole request, body included.
+	read time.Duration
+
+	// write bounds the time from the end of the request headers to the end
+	// of the response, which includes waiting for the upstream. Streamed
+	// responses instead get this long for each chunk.
+	write time.Duration
+
+	// idle bounds how long a keep-alive connection waits for its next
+	// request.
+	idle time.Duration
+}
+
+// defaultReadHeaderTimeout keeps clients that trickle in headers from
+// holding connections open.
+const defaultReadHeaderTimeout = 10 * time.Second
+
+// newServer returns the HTTP server for addr. Requests whose headers exceed
+// maxHeaderBytes are rejected by net/http with a 431 before reaching Handler.
+func (l *LLMSed) newServer(addr string) *http.Server {
+	srv := l.httpServer(addr, l.Handler())
+	srv.TLSConfig = l.tlsConfig
+	return srv
+}
+
+// newAdminServer returns the HTTP server for the -admin-addr listener.
+func (l *LLMSed) newAdminServer() *http.Server {
+	return l.httpServer(l.adminAddr, l.AdminHandler())
+}
+
+func (l *LLMSed) httpServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		MaxHeaderBytes:    l.maxHeaderBytes,
+		ReadHeaderTimeout: l.timeouts.readHeader,
+		ReadTimeout:       l.timeouts.read,
+		WriteTimeout:      l.timeouts.write,
+		IdleTimeout:       l.timeouts.idle,
+	}
+}
+
+// extendWriteDeadline gives a streamed response another write timeout.
+// Without it, -write-timeout would cut off every stream that runs longer,
+// however active it is.
+func (l *LLMSed) extendWriteDeadline(rc *http.ResponseController) {
+	if l.timeouts.write <= 0 {
+		return
+	}
+	if err := rc.SetWriteDeadline(time.Now().Add(l.timeouts.write)); err != nil {
+		l.writeDeadlineFailed.Do(func() {
+			log.Printf("Cannot extend the write deadline of streamed responses, so -write-timeout will cut them off: %v", err)
+		})
+	}
+}
+
+// headerTooLarge starts the response net/http writes straight to the
+// connection when a request's headers exceed MaxHeaderBytes.
+var headerTooLarge = []byte("HTTP/1.1 431 ")
+
+// logOversizedHeaders wraps ln so that each 431 the server sends for
+// oversized headers is logged. net/http rejects such requests without
+// calling the handler or logging anything itself.
+func logOversizedHeaders(ln net.Listener, limit int) net.Listener {
+	return &headerLimitListener{Listener: ln, limit: limit}
+}
+
+type headerLimitListener struct {
+	net.Listener
+	limit int
+}
+
+func (ln *headerLimitListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &headerLimitConn{Conn: c, limit: ln.limit}, nil
+}
+
+type headerLimitConn struct {
+	net.Conn
+	limit int
+}
+
+func (c *headerLimitConn) Write(p []byte) (int, error) {
+	if bytes.HasPrefix(p, headerTooLarge) {
+		log.Printf("Rejected request from %s: headers larger than -max-header-bytes (%d bytes)", c.RemoteAddr(), c.limit)
+	}
+	return c.Conn.Write(p)
+}
+
+// trackInFlight counts the requests currently inside next.
+func (l *LLMSed) trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.inFlight.Add(1)
+		defer l.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recoverPanics answers a request whose handler panics with a 500 and logs
+// the panic with the request's correlation ID and stack, so one bad request
+// cannot take the whole server down. The correlation ID is assigned here so
+// the log line can name it.
+func (l *LLMSed) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(withCorrelationID(r.Context()))
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// net/http's own signal to drop the connection.
+				panic(p)
+			}
+			l.metrics.panics.Inc()
+			log.Printf("Panic handling %s %s (request %s): %v\n%s", r.Method, r.URL.Path, correlationID(r.Context()), p, debug.Stack())
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logDraining logs the number of in-flight requests each time it drops while
+// the server shuts down, until none remain or ctx ends.
+func (l *LLMSed) logDraining(ctx context.Context) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	last := l.inFlight.Load()
+	if last > 0 {
+		log.Printf("Draining %d in-flight requests", last)
+	}
+	for last > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n := l.inFlight.Load(); n < last {
+				last = n
+				log.Printf("Draining %d in-flight requests", last)
+			}
+		}
+	}
+}
+
+// allowMethods rejects requests whose method is not in methods with a 405.
+func allowMethods(next http.HandlerFunc, methods ...string) http.Handler {
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				next(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	})
+}
+
+func (l *LLMSed) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "ok",
+		"in_flight": l.inFlight.Load(),
+	})
+}
+
+// handleReady answers 503 while draining, so load balancers move new
+// traffic elsewhere, and 200 otherwise.
+func (l *LLMSed) handleReady(w http.ResponseWriter, r *http.Request) {
+	if l.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"status":    "draining",
+			"in_flight": l.inFlight.Load(),
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ready"})
+}
+
+// handleDrain starts draining on POST and ends it on DELETE. Requests keep
+// being served either way; only /readyz changes.
+func (l *LLMSed) handleDrain(w http.ResponseWriter, r *http.Request) {
+	draining := r.Method == http.MethodPost
+	if l.draining.Swap(draining) != draining {
+		if draining {
+			log.Printf("Draining: /readyz now answers 503, %d requests in flight", l.inFlight.Load())
+		} else {
+			log.Printf("Drain cancelled: /readyz answers 200 again")
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"draining":  draining,
+		"in_flight": l.inFlight.Load(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
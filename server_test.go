@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInternalRoutesRejectWrongMethods(t *testing.T) {
+	l := newTestLLMSed("http://127.0.0.1:0")
+	h := l.Handler()
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/healthz", nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s /healthz: code = %d, want 405", method, rec.Code)
+		}
+		if allow := rec.Header().Get("Allow"); allow != "GET, HEAD" {
+			t.Errorf("%s /healthz: Allow = %q", method, allow)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /healthz: code = %d, want 200", rec.Code)
+	}
+}
+
+func TestProxyPathsAcceptAnyMethod(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"method":%q}`, r.Method)
+	}))
+	defer upstream.Close()
+
+	h := newTestLLMSed(upstream.URL, TransformRule{Tag: "passthrough"}).Handler()
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/v1/chat/completions", strings.NewReader(`{}`)))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: code = %d, want 200", method, rec.Code)
+		}
+		if want := fmt.Sprintf(`{"method":%q}`, method); rec.Body.String() != want {
+			t.Errorf("%s: body = %s, want %s", method, rec.Body.String(), want)
+		}
+	}
+}
+
+func TestUnknownInternalPathNotProxied(t *testing.T) {
+	var proxied int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "passthrough"})
+	l.adminToken = "secret"
+	h := l.Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/relaod", nil))
+	if rec.Code != http.StatusNotFound || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("/admin/relaod: code %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), `"no llsed endpoint at /admin/relaod"`) {
+		t.Errorf("/admin/relaod: body %s", rec.Body.String())
+	}
+	if atomic.LoadInt32(&proxied) != 0 {
+		t.Error("unknown internal path was proxied upstream")
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/admin/users", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusOK || atomic.LoadInt32(&proxied) != 1 {
+		t.Errorf("proxy path: code %d, %d upstream calls", rec.Code, atomic.LoadInt32(&proxied))
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "passthrough"})
+	l.maxHeaderBytes = 2048
+	srv := l.newServer("")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(logOversizedHeaders(ln, srv.MaxHeaderBytes))
+	defer srv.Close()
+
+	logs := captureLog(t)
+	send := func(size int) int {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+ln.Addr().String()+"/v1/chat/completions", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer "+strings.Repeat("x", size))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := send(1024); code != http.StatusOK {
+		t.Errorf("headers under the limit: code = %d, want 200", code)
+	}
+	// net/http allows 4 KiB of slack above MaxHeaderBytes.
+	if code := send(16 * 1024); code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("oversized headers: code = %d, want 431", code)
+	}
+	if !strings.Contains(logs.String(), "headers larger than -max-header-bytes (2048 bytes)") {
+		t.Errorf("431 not logged: %q", logs.String())
+	}
+}
+
+func TestAdminAddrSeparatesInternalRoutes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"proxied":%q}`, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "passthrough"})
+	l.adminToken = "secret"
+	l.adminAddr = "127.0.0.1:0"
+	proxy := httptest.NewServer(l.Handler())
+	defer proxy.Close()
+	admin := httptest.NewServer(l.AdminHandler())
+	defer admin.Close()
+
+	get := func(base, path string) (int, string) {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	for _, path := range []string{"/healthz", "/metrics"} {
+		if code, _ := get(admin.URL, path); code != http.StatusOK {
+			t.Errorf("admin %s: code = %d, want 200", path, code)
+		}
+		if _, body := get(proxy.URL, path); body != fmt.Sprintf(`{"proxied":%q}`, path) {
+			t.Errorf("proxy %s served locally: %q", path, body)
+		}
+	}
+	if code, _ := get(admin.URL, "/v1/models"); code != http.StatusNotFound {
+		t.Errorf("admin listener proxied /v1/models: code = %d, want 404", code)
+	}
+	req, _ := http.NewRequest(http.MethodPost, admin.URL+"/admin/reload", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("admin /admin/reload without token: code = %d, want 401", resp.StatusCode)
+	}
+
+	// The admin namespace is never proxied, even with its routes moved.
+	for _, path := range []string{"/admin/reload", "/admin/relaod"} {
+		resp, err := http.Post(proxy.URL+path, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound || strings.Contains(string(body), "proxied") {
+			t.Errorf("proxy %s: code %d, body %s, want a local 404", path, resp.StatusCode, body)
+		}
+	}
+}
+
+// serve starts l's proxy server on a loopback port and returns its address.
+func serve(t *testing.T, l *LLMSed) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := l.newServer("")
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestReadHeaderTimeoutDisconnectsSlowClient(t *testing.T) {
+	l := newTestLLMSed("http://127.0.0.1:0")
+	l.timeouts = serverTimeouts{readHeader: 100 * time.Millisecond}
+	conn, err := net.Dial("tcp", serve(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Start a request and never finish its headers.
+	io.WriteString(conn, "POST /v1/chat/completions HTTP/1.1\r\nHost: llsed\r\nX-Slow: ")
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatal("server kept the slow connection open")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("connection closed after %s, before the read timeout", elapsed)
+	}
+}
+
+func TestIdleTimeoutClosesIdleConnectionsNotStreams(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "data: {\"n\":%d}\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(60 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "stream"})
+	l.timeouts = serverTimeouts{readHeader: time.Second, idle: 100 * time.Millisecond}
+	addr := serve(t, l)
+
+	// A keep-alive connection left idle after its request is closed.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /healthz HTTP/1.1\r\nHost: llsed\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatal("server kept the idle connection open")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("connection closed after %s, before the idle timeout", elapsed)
+	}
+
+	// A stream that runs longer than the idle timeout is not idle.
+	stream, err := http.Post("http://"+addr+"/v1/chat/completions", "application/json", strings.NewReader(`{"stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	body, err := io.ReadAll(stream.Body)
+	if err != nil || strings.Count(string(body), "data: ") != 5 {
+		t.Errorf("stream cut short (%v): %q", err, body)
+	}
+}
+
+func TestWriteTimeoutAppliesPerStreamChunk(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "data: {\"n\":%d}\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(60 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	// With -capture-file the stream is written through the capture
+	// wrapper, which must still let the deadline be extended.
+	for _, capture := range []bool{false, true} {
+		l := newTestLLMSed(upstream.URL, TransformRule{Tag: "stream"})
+		l.timeouts = serverTimeouts{write: 150 * time.Millisecond}
+		if capture {
+			c, err := openCapture(filepath.Join(t.TempDir(), "capture.jsonl"), defaultCaptureMaxBytes, defaultCaptureBodyBytes, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			l.capture = c
+		}
+		resp, err := http.Post("http://"+serve(t, l)+"/v1/chat/completions", "application/json", strings.NewReader(`{"stream":true}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("capture %v: stream cut off after %q: %v", capture, body, err)
+		}
+		if !strings.Contains(string(body), `{"n":4}`) {
+			t.Errorf("capture %v: stream incomplete: %q", capture, body)
+		}
+	}
+}
+
+func init() {
+	registerTransformer("test-panic", newTransformer(stagePre, func(params, payload map[string]interface{}) (map[string]interface{}, error) {
+		panic("transform bug")
+	}))
+}
+
+func TestPanicRecovery(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "boom", Type: "test-panic"}, TransformRule{Tag: "fine"})
+	l.ruleOverrideParam = "rule"
+	srv := httptest.NewServer(l.Handler())
+	defer srv.Close()
+	logs := captureLog(t)
+
+	post := func(tag string) int {
+		resp, err := http.Post(srv.URL+"/v1/chat/completions?rule="+tag, "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatalf("%s: %v", tag, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("boom"); code != http.StatusInternalServerError {
+		t.Errorf("panicking request: code %d, want 500", code)
+	}
+	if code := post("fine"); code != http.StatusOK {
+		t.Errorf("request after the panic: code %d, want 200", code)
+	}
+	if got := testutil.ToFloat64(l.metrics.panics); got != 1 {
+		t.Errorf("llsed_panics_total = %v, want 1", got)
+	}
+	if !regexp.MustCompile(`Panic handling POST /v1/chat/completions \(request [0-9a-f]{32}\): transform bug\n(?s).*goroutine`).MatchString(logs.String()) {
+		t.Errorf("panic log lacks request ID or stack:\n%s", logs)
+	}
+}
+
+func TestRootAction(t *testing.T) {
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.URL.Path
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		action, target string
+		status         int
+		forwarded      string
+	}{
+		{rootForward, "", http.StatusOK, "/"},
+		{rootInfo, "", http.StatusNotFound, ""},
+		{rootRedirect, "/v1/chat/completions", http.StatusTemporaryRedirect, ""},
+		{rootRewrite, "/v1/chat/completions", http.StatusOK, "/v1/chat/completions"},
+	} {
+		forwarded = ""
+		l := newTestLLMSed(upstream.URL, TransformRule{Tag: "chat"})
+		l.rootAction, l.rootTarget = tc.action, tc.target
+		h := l.Handler()
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/?trace=1", strings.NewReader(`{}`)))
+		if rec.Code != tc.status || forwarded != tc.forwarded {
+			t.Errorf("%s: got %d, forwarded to %q; want %d, %q", tc.action, rec.Code, forwarded, tc.status, tc.forwarded)
+		}
+		switch tc.action {
+		case rootInfo:
+			if !strings.Contains(rec.Body.String(), "/v1/chat/completions") || rec.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("info: body %q is not a JSON hint", rec.Body)
+			}
+		case rootRedirect:
+			if got := rec.Header().Get("Location"); got != "/v1/chat/completions?trace=1" {
+				t.Errorf("redirect: Location = %q", got)
+			}
+		}
+
+		// Other paths are proxied as usual.
+		forwarded = ""
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/models", strings.NewReader(`{}`)))
+		if forwarded != "/v1/models" {
+			t.Errorf("%s: /v1/models forwarded to %q", tc.action, forwarded)
+		}
+	}
+
+	if err := checkRootAction(rootRewrite, ""); err == nil {
+		t.Error("expected error for rewrite without a target")
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	l := newTestLLMSed(upstream.URL, TransformRule{})
+	l.adminToken = "s3cret"
+	proxy := httptest.NewServer(l.Handler())
+	defer proxy.Close()
+
+	call := func(method, path, token string) int {
+		req, _ := http.NewRequest(method, proxy.URL+path, strings.NewReader(`{}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := call(http.MethodGet, "/readyz", ""); code != http.StatusOK {
+		t.Fatalf("ready before drain: %d", code)
+	}
+	if code := call(http.MethodPost, "/admin/drain", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("drain with a wrong token: %d, want 401", code)
+	}
+	if code := call(http.MethodPost, "/admin/drain", "s3cret"); code != http.StatusOK {
+		t.Fatalf("drain: %d", code)
+	}
+	for path, want := range map[string]int{"/readyz": http.StatusServiceUnavailable, "/healthz": http.StatusOK} {
+		if code := call(http.MethodGet, path, ""); code != want {
+			t.Errorf("%s while draining: %d, want %d", path, code, want)
+		}
+	}
+	if code := call(http.MethodPost, "/v1/chat/completions", ""); code != http.StatusOK {
+		t.Errorf("request while draining: %d, want 200", code)
+	}
+
+	if code := call(http.MethodDelete, "/admin/drain", "s3cret"); code != http.StatusOK {
+		t.Fatalf("undrain: %d", code)
+	}
+	if code := call(http.MethodGet, "/readyz", ""); code != http.StatusOK {
+		t.Errorf("ready after undrain: %d", code)
+	}
+}
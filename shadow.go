@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultShadowTimeout     = 30 * time.Second
+	defaultMaxShadowRequests = 64
+)
+
+// credentialHeaders carry the client's or llsed's upstream credentials:
+// OpenAI-style bearer tokens, Anthropic's x-api-key and Azure's api-key.
+var credentialHeaders = []string{"Authorization", "X-Api-Key", "Api-Key"}
+
+// mirror sends a copy of the forwarded request to the rule's shadow backend
+// in the background and discards the response. Shadow requests get their own
+// deadline, independent of the client request, and at most
+// maxShadowRequests may be outstanding; beyond that they are dropped rather
+// than queued. Credential headers are left out unless the rule sets
+// shadow_credentials.
+func (l *LLMSed) mirror(r *http.Request, rule TransformRule, client *http.Client, body []byte) {
+	if l.shadowInFlight.Add(1) > int64(l.maxShadowRequests) {
+		l.shadowInFlight.Add(-1)
+		l.metrics.shadowDropped.Inc()
+		l.logf(r.Context(), levelWarn, "Dropping shadow request for rule %s: %d already in flight", rule.Tag, l.maxShadowRequests)
+		return
+	}
+
+	targetURL := strings.TrimSuffix(rule.Shadow, "/") + rule.upstreamPath(r.URL.Path)
+	header := l.upstreamHeader(r, rule)
+	if !rule.ShadowCredentials {
+		for _, name := range credentialHeaders {
+			header.Del(name)
+		}
+	}
+	method, body := rule.upstreamRequest(r.Method, body)
+	logCtx := r.Context()
+
+	go func() {
+		defer l.shadowInFlight.Add(-1)
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.shadowTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, method, targetURL, bytes.NewReader(body))
+		if err != nil {
+			l.logf(logCtx, levelWarn, "Shadow request failed: %v", err)
+			return
+		}
+		req.Header = header
+
+		resp, err := client.Do(req)
+		if err != nil {
+			l.logf(logCtx, levelWarn, "Shadow request to %s failed: %v", targetURL, err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestShadowRequestsAreBoundedAndDropped(t *testing.T) {
+	var received, cancelled int32
+	var body atomic.Value
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body.Store(string(b))
+		atomic.AddInt32(&received, 1)
+		// Slow backend: hold the request until the shadow deadline cancels it.
+		<-r.Context().Done()
+		atomic.AddInt32(&cancelled, 1)
+	}))
+	defer shadow.Close()
+	upstream := newEchoUpstream(t)
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "mirrored", Shadow: shadow.URL})
+	l.maxShadowRequests = 2
+	l.shadowTimeout = 200 * time.Millisecond
+
+	for i := 0; i < 5; i++ {
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4"}`)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: code = %d; a slow shadow must not affect the client", i, rec.Code)
+		}
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&received) == 2 })
+	if got := testutil.ToFloat64(l.metrics.shadowDropped); got != 3 {
+		t.Errorf("dropped = %v, want 3", got)
+	}
+	if got := body.Load(); got != `{"model":"gpt-4"}` {
+		t.Errorf("shadow body = %v", got)
+	}
+
+	// The deadline frees the slots once the slow backend is given up on.
+	waitFor(t, func() bool { return l.shadowInFlight.Load() == 0 })
+	waitFor(t, func() bool { return atomic.LoadInt32(&cancelled) == 2 })
+	if atomic.LoadInt32(&received) != 2 {
+		t.Errorf("received = %d, want 2", atomic.LoadInt32(&received))
+	}
+}
+
+func TestShadowDropsCredentials(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+	}))
+	defer shadow.Close()
+	var upstreamAuth atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamAuth.Store(r.Header.Get("Authorization"))
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	send := func(rule TransformRule) http.Header {
+		t.Helper()
+		l := newTestLLMSed(upstream.URL, rule)
+		key := "sk-from-file"
+		l.apiKey.Store(&key)
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`))
+		req.Header.Set("X-Api-Key", "sk-client")
+		req.Header.Set("X-Trace", "t1")
+		l.handleProxy(httptest.NewRecorder(), req)
+		select {
+		case h := <-headers:
+			return h
+		case <-time.After(2 * time.Second):
+			t.Fatal("shadow not called")
+			return nil
+		}
+	}
+
+	h := send(TransformRule{Tag: "mirrored", Shadow: shadow.URL})
+	if h.Get("Authorization") != "" || h.Get("X-Api-Key") != "" {
+		t.Errorf("shadow got credentials: Authorization %q, X-Api-Key %q", h.Get("Authorization"), h.Get("X-Api-Key"))
+	}
+	if h.Get("X-Trace") != "t1" {
+		t.Errorf("shadow X-Trace = %q, want other headers kept", h.Get("X-Trace"))
+	}
+	if got := upstreamAuth.Load(); got != "Bearer sk-from-file" {
+		t.Errorf("upstream Authorization = %v, want the -api-key-file key", got)
+	}
+
+	h = send(TransformRule{Tag: "mirrored", Shadow: shadow.URL, ShadowCredentials: true})
+	if h.Get("Authorization") != "Bearer sk-from-file" || h.Get("X-Api-Key") != "sk-client" {
+		t.Errorf("shadow_credentials: Authorization %q, X-Api-Key %q", h.Get("Authorization"), h.Get("X-Api-Key"))
+	}
+}
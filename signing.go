@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Default headers carrying a request signature.
+const (
+	defaultSignatureHeader = "X-Signature"
+	defaultTimestampHeader = "X-Timestamp"
+)
+
+// SigningConfig signs forwarded requests with
+// hex(HMAC-SHA256(secret, timestamp + body)), where timestamp is the Unix
+// time in seconds sent alongside the signature.
+type SigningConfig struct {
+	// SecretEnv names the environment variable holding the secret. When
+	// empty, the -signing-secret flag is used.
+	SecretEnv       string `json:"secret_env"`
+	SignatureHeader string `json:"signature_header"`
+	TimestampHeader string `json:"timestamp_header"`
+}
+
+// signature computes the hex-encoded HMAC-SHA256 of timestamp + body.
+func signature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign sets the signature and timestamp headers on a forwarded request.
+func (l *LLMSed) sign(req *http.Request, cfg *SigningConfig, body []byte) error {
+	secret := l.signingSecret
+	if cfg.SecretEnv != "" {
+		secret = os.Getenv(cfg.SecretEnv)
+	}
+	if secret == "" {
+		return fmt.Errorf("%w: no signing secret (set %s or -signing-secret)", ErrConfig, cfg.SecretEnv)
+	}
+
+	signatureHeader, timestampHeader := cfg.SignatureHeader, cfg.TimestampHeader
+	if signatureHeader == "" {
+		signatureHeader = defaultSignatureHeader
+	}
+	if timestampHeader == "" {
+		timestampHeader = defaultTimestampHeader
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, signature(secret, timestamp, body))
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSignedForwardMatchesIndependentHMAC(t *testing.T) {
+	var header http.Header
+	var body []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GATEWAY_SECRET", "top-secret")
+	l := newTestLLMSed(upstream.URL,
+		TransformRule{Tag: "env", Sign: &SigningConfig{SecretEnv: "GATEWAY_SECRET", SignatureHeader: "X-Gateway-Signature", TimestampHeader: "X-Gateway-Time"}},
+		TransformRule{Tag: "flag", Sign: &SigningConfig{}},
+	)
+	l.ruleOverrideParam = "rule"
+	l.signingSecret = "flag-secret"
+
+	for _, tt := range []struct{ tag, secret, sigHeader, tsHeader string }{
+		{"env", "top-secret", "X-Gateway-Signature", "X-Gateway-Time"},
+		{"flag", "flag-secret", "X-Signature", "X-Timestamp"},
+	} {
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions?rule="+tt.tag, strings.NewReader(`{"model":"gpt-4"}`)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code %d: %s", tt.tag, rec.Code, rec.Body.String())
+		}
+
+		timestamp := header.Get(tt.tsHeader)
+		if timestamp == "" {
+			t.Fatalf("%s: no %s header", tt.tag, tt.tsHeader)
+		}
+		mac := hmac.New(sha256.New, []byte(tt.secret))
+		mac.Write([]byte(timestamp + string(body)))
+		if want := hex.EncodeToString(mac.Sum(nil)); header.Get(tt.sigHeader) != want {
+			t.Errorf("%s: %s = %q, want %q", tt.tag, tt.sigHeader, header.Get(tt.sigHeader), want)
+		}
+	}
+}
+
+func TestSigningWithoutSecretFails(t *testing.T) {
+	l := newTestLLMSed(newEchoUpstream(t).URL, TransformRule{Tag: "sign", Sign: &SigningConfig{SecretEnv: "LLMSED_TEST_UNSET_SECRET"}})
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "signing secret") {
+		t.Errorf("code %d body %s", rec.Code, rec.Body.String())
+	}
+}
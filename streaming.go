@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// defaultStreamIdleTimeout bounds the gap between chunks of a streamed
+// upstream response.
+const defaultStreamIdleTimeout = 2 * time.Minute
+
+// isEventStream reports whether resp is a Server-Sent Events stream.
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// streamResponse relays an SSE response to the client chunk by chunk, also
+// copying each chunk to tee when it is non-nil. If the upstream goes quiet
+// for longer than the idle timeout, or the stream runs past the overall
+// deadline, the client gets an error event and the stream is closed. A client
+// disconnect cancels the upstream request, which ends the relay. It reports
+// whether the whole stream was relayed. The client gets header rather than the
+// upstream's own headers.
+func (l *LLMSed) streamResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, header http.Header, tee io.Writer) bool {
+	copyHeader(w.Header(), header, l.singletonHeaders)
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	rc := http.NewResponseController(w)
+
+	chunks := make(chan []byte)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				chunk := append([]byte(nil), buf[:n]...)
+				select {
+				case chunks <- chunk:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	idle := newTimer(l.streamIdleTimeout)
+	defer idle.Stop()
+	deadline := newTimer(l.streamTimeout)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case chunk := <-chunks:
+			l.extendWriteDeadline(rc)
+			if _, err := w.Write(chunk); err != nil {
+				return false
+			}
+			if tee != nil {
+				tee.Write(chunk)
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			if l.streamIdleTimeout > 0 {
+				idle.Reset(l.streamIdleTimeout)
+			}
+		case err := <-readErr:
+			if err == io.EOF {
+				return true
+			}
+			if r.Context().Err() == nil {
+				l.logf(r.Context(), levelWarn, "Stream from upstream failed: %v", err)
+				l.extendWriteDeadline(rc)
+				writeStreamError(w, flusher, "upstream stream failed")
+			}
+			return false
+		case <-idle.C:
+			l.logf(r.Context(), levelWarn, "Stream idle for %s, closing", l.streamIdleTimeout)
+			l.extendWriteDeadline(rc)
+			writeStreamError(w, flusher, fmt.Sprintf("stream idle for more than %s", l.streamIdleTimeout))
+			return false
+		case <-deadline.C:
+			l.logf(r.Context(), levelWarn, "Stream exceeded %s deadline, closing", l.streamTimeout)
+			l.extendWriteDeadline(rc)
+			writeStreamError(w, flusher, fmt.Sprintf("stream exceeded %s deadline", l.streamTimeout))
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
+
+// streamTransform pipes an upstream SSE response through rule's stream
+// transform: the upstream body is sent as the chunked body of a POST to the
+// endpoint as it arrives, and the transform's own event stream comes back
+// in the response, which is returned once its headers arrive. The transform
+// must answer with a 2xx and text/event-stream; its stream then replaces
+// the upstream's, keeping the upstream status.
+func (l *LLMSed) streamTransform(r *http.Request, rule TransformRule, client *http.Client, upstream *http.Response) (*http.Response, error) {
+	header, err := rule.transformHeader("post")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, rule.StreamTransform, upstream.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "text/event-stream")
+	if id := correlationID(r.Context()); id != "" {
+		req.Header.Set(headerCorrelationID, id)
+	}
+	l.logf(r.Context(), levelInfo, "Calling stream transform: %s", rule.StreamTransform)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("stream transform answered %s", resp.Status)
+	}
+	if !isEventStream(resp) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("stream transform answered %q, not text/event-stream", resp.Header.Get("Content-Type"))
+	}
+	transformed := *upstream
+	transformed.Body = resp.Body
+	return &transformed, nil
+}
+
+// relayResponse copies a non-SSE response of unknown length to the client,
+// flushing each chunk as it arrives, with header as its headers.
+func (l *LLMSed) relayResponse(w http.ResponseWriter, resp *http.Response, header http.Header) {
+	copyHeader(w.Header(), header, l.singletonHeaders)
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	rc := http.NewResponseController(w)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			l.extendWriteDeadline(rc)
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			l.copyTrailers(w, resp)
+			return
+		}
+		if err != nil {
+			l.logf(resp.Request.Context(), levelWarn, "Relaying response from upstream failed: %v", err)
+			return
+		}
+	}
+}
+
+// newTimer returns a timer that fires after d, or never if d is zero.
+func newTimer(d time.Duration) *time.Timer {
+	if d <= 0 {
+		t := time.NewTimer(time.Hour)
+		t.Stop()
+		return t
+	}
+	return time.NewTimer(d)
+}
+
+// writeStreamError sends an SSE error event in the OpenAI error shape.
+func writeStreamError(w io.Writer, flusher http.Flusher, message string) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "type": "llsed_error"},
+	})
+	fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSSEUpstream starts an upstream that writes events, flushing after each,
+// and then blocks until stall is closed.
+func newSSEUpstream(t *testing.T, events []string, stall chan struct{}) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			fmt.Fprintf(w, "data: %s\n\n", event)
+			w.(http.Flusher).Flush()
+		}
+		if stall != nil {
+			select {
+			case <-stall:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestStreamPassesEventsThrough(t *testing.T) {
+	upstream := newSSEUpstream(t, []string{`{"delta":"Hel"}`, `{"delta":"lo"}`, "[DONE]"}, nil)
+	proxy := httptest.NewServer(newTestLLMSed(upstream.URL, TransformRule{Tag: "stream"}).Handler())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	want := "data: {\"delta\":\"Hel\"}\n\ndata: {\"delta\":\"lo\"}\n\ndata: [DONE]\n\n"
+	if string(body) != want {
+		t.Fatalf("body = %q, want %q", body, want)
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	stall := make(chan struct{})
+	defer close(stall)
+	upstream := newSSEUpstream(t, []string{`{"delta":"Hel"}`}, stall)
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "stream"})
+	l.streamIdleTimeout = 100 * time.Millisecond
+	proxy := httptest.NewServer(l.Handler())
+	defer proxy.Close()
+
+	start := time.Now()
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	elapsed := time.Since(start)
+
+	if !strings.HasPrefix(string(body), "data: {\"delta\":\"Hel\"}\n\n") {
+		t.Errorf("missing first chunk: %q", body)
+	}
+	if !strings.Contains(string(body), "event: error") || !strings.Contains(string(body), "idle") {
+		t.Errorf("missing idle error event: %q", body)
+	}
+	if elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("stream closed after %s, want about 100ms", elapsed)
+	}
+}
+
+func TestStreamDeadline(t *testing.T) {
+	stall := make(chan struct{})
+	defer close(stall)
+	upstream := newSSEUpstream(t, []string{`{"delta":"Hel"}`}, stall)
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "stream"})
+	l.streamIdleTimeout = 0
+	l.streamTimeout = 100 * time.Millisecond
+	proxy := httptest.NewServer(l.Handler())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "deadline") {
+		t.Errorf("missing deadline error event: %q", body)
+	}
+}
+
+func TestStreamStopsOnClientDisconnect(t *testing.T) {
+	upstreamDone := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(upstreamDone)
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(newTestLLMSed(upstream.URL, TransformRule{Tag: "stream"}).Handler())
+	defer proxy.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("data: first\n\n"))
+	io.ReadFull(resp.Body, buf)
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case <-upstreamDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request was not cancelled after client disconnect")
+	}
+}
+
+// newChunkedUpstream writes a JSON body in two flushed chunks, holding the
+// second until release is closed.
+func newChunkedUpstream(t *testing.T, release chan struct{}) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"Hel`)
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, `lo"}}]}`)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestChunkedResponseRelayedWithoutTransform(t *testing.T) {
+	release := make(chan struct{})
+	upstream := newChunkedUpstream(t, release)
+	proxy := httptest.NewServer(newTestLLMSed(upstream.URL, TransformRule{Tag: "passthrough"}).Handler())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("TransferEncoding = %q, want chunked", resp.TransferEncoding)
+	}
+
+	// The first chunk arrives while the upstream is still holding the rest.
+	first := make([]byte, len(`{"choices":[{"message":{"content":"Hel`))
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	rest, _ := io.ReadAll(resp.Body)
+	if got := string(first) + string(rest); got != `{"choices":[{"message":{"content":"Hello"}}]}` {
+		t.Errorf("body = %q", got)
+	}
+}
+
+func TestChunkedResponseBufferedForTransform(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	var upstreamReq *http.Request
+	upstream := newChunkedUpstream(t, release)
+	capture := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamReq = r
+		resp, err := http.Post(upstream.URL, "application/json", r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(w, resp.Body)
+	}))
+	defer capture.Close()
+
+	rule := TransformRule{Tag: "normalize", Type: transformNormalizeResponse, Params: map[string]interface{}{
+		"mapping": map[string]interface{}{"choices.0.message.content": "text"},
+	}}
+	proxy := httptest.NewServer(newTestLLMSed(capture.URL, rule).Handler())
+	defer proxy.Close()
+
+	// A chunked client request reaches the upstream with a fixed length.
+	body := io.MultiReader(strings.NewReader(`{"model":`), strings.NewReader(`"gpt-4"}`))
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, _ := io.ReadAll(resp.Body)
+	if string(got) != `{"text":"Hello"}` {
+		t.Errorf("body = %s", got)
+	}
+	if upstreamReq.ContentLength != int64(len(`{"model":"gpt-4"}`)) || len(upstreamReq.TransferEncoding) != 0 {
+		t.Errorf("upstream request length %d, transfer encoding %q", upstreamReq.ContentLength, upstreamReq.TransferEncoding)
+	}
+}
+
+func TestPreserveTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Trailer", "X-Checksum, Keep-Alive")
+		w.Write([]byte(`{"usage":{"input_tokens":3}}`))
+		// Only known once the body is written.
+		w.Header().Set("X-Checksum", "abc123")
+		w.Header().Set("Keep-Alive", "timeout=5")
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL,
+		TransformRule{Tag: "relayed"},
+		TransformRule{Tag: "buffered", Type: transformRenameResponse, Params: map[string]interface{}{
+			"fields": map[string]interface{}{"usage.input_tokens": "usage.prompt_tokens"},
+		}},
+	)
+	l.ruleOverrideParam = "rule"
+	proxy := httptest.NewServer(l.Handler())
+	defer proxy.Close()
+
+	fetch := func(tag string) (string, http.Header) {
+		resp, err := http.Post(proxy.URL+"/v1/chat/completions?rule="+tag, "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), resp.Trailer
+	}
+
+	if _, trailer := fetch("relayed"); trailer.Get("X-Checksum") != "" {
+		t.Errorf("trailer copied without -preserve-trailers: %v", trailer)
+	}
+
+	l.preserveTrailers = true
+	for tag, want := range map[string]string{
+		"relayed":  `{"usage":{"input_tokens":3}}`,
+		"buffered": `{"usage":{"prompt_tokens":3}}`,
+	} {
+		body, trailer := fetch(tag)
+		if body != want {
+			t.Errorf("%s: body = %s, want %s", tag, body, want)
+		}
+		if trailer.Get("X-Checksum") != "abc123" {
+			t.Errorf("%s: trailer = %v, want X-Checksum", tag, trailer)
+		}
+		if trailer.Get("Keep-Alive") != "" {
+			t.Errorf("%s: hop-by-hop trailer relayed: %v", tag, trailer)
+		}
+	}
+}
+
+// newUppercaseStreamTransform starts a stream transform that answers each
+// line of the stream it is sent, uppercased, as soon as it reads it.
+func newUppercaseStreamTransform(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := http.NewResponseController(w).EnableFullDuplex(); err != nil {
+			t.Errorf("stream transform: %v", err)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			fmt.Fprintf(w, "%s\n", strings.ToUpper(scanner.Text()))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStreamTransformRewritesStream(t *testing.T) {
+	stall := make(chan struct{})
+	upstream := newSSEUpstream(t, []string{`{"delta":"hel"}`, `{"delta":"lo"}`}, stall)
+	transform := newUppercaseStreamTransform(t)
+	proxy := httptest.NewServer(newTestLLMSed(upstream.URL, TransformRule{Tag: "redact", StreamTransform: transform.URL}).Handler())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Both events arrive transformed while the upstream stream is still open.
+	want := "DATA: {\"DELTA\":\"HEL\"}\n\nDATA: {\"DELTA\":\"LO\"}\n\n"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(resp.Body, got); err != nil {
+		t.Fatalf("reading stream: %v (got %q)", err, got)
+	}
+	if string(got) != want {
+		t.Fatalf("stream = %q, want %q", got, want)
+	}
+	close(stall)
+	if rest, _ := io.ReadAll(resp.Body); len(rest) != 0 {
+		t.Errorf("unexpected trailing data %q", rest)
+	}
+}
+
+func TestStreamTransformFailure(t *testing.T) {
+	upstream := newSSEUpstream(t, []string{`{"delta":"hi"}`}, nil)
+	transform := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer transform.Close()
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "redact", StreamTransform: transform.URL})
+
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"stream":true}`)))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "503") {
+		t.Errorf("status = %d, body %q; want the transform failure", rec.Code, rec.Body)
+	}
+}
+
+func TestWriteStreamErrorIsValidJSON(t *testing.T) {
+	var buf bytes.Buffer
+	writeStreamError(&buf, nil, "bad \x00 byte \xff and \"quotes\"")
+	data, ok := strings.CutPrefix(buf.String(), "event: error\ndata: ")
+	if !ok || !strings.HasSuffix(data, "\n\n") {
+		t.Fatalf("not an SSE error event: %q", buf.String())
+	}
+	var event struct {
+		Error struct{ Message, Type string }
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSuffix(data, "\n\n")), &event); err != nil {
+		t.Fatalf("event data is not JSON: %v: %q", err, data)
+	}
+	if event.Error.Type != "llsed_error" || !strings.HasPrefix(event.Error.Message, "bad \x00 byte") {
+		t.Errorf("event = %+v", event)
+	}
+}
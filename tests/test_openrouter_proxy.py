@@ -13,7 +13,7 @@ class TestOpenRouterProxy(unittest.TestCase):
         # Use the existing config file (can be empty) and point to OpenRouter's API endpoint.
         cls.server_process = subprocess.Popen(
             [
-                "go", "run", "llsed.go",
+                "go", "run", ".",
                 "--host", "127.0.0.1",
                 "--port", "8080",
                 "--map_file", "config.json",
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsVersions are the -tls-min-version values.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// defaultTLSMinVersion is the oldest TLS version llsed accepts by default.
+const defaultTLSMinVersion = "1.2"
+
+// newServerTLSConfig returns the serving TLS settings for -tls-min-version
+// and -tls-ciphers. ciphers is a comma-separated list of Go cipher suite
+// names such as TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384; empty keeps Go's
+// defaults. Only suites Go considers secure are accepted. TLS 1.3 suites are
+// rejected because they cannot be configured: TLS 1.3 always offers all of
+// them.
+func newServerTLSConfig(minVersion, ciphers string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q, want 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+	cfg := &tls.Config{MinVersion: version}
+
+	for _, name := range strings.Split(ciphers, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		suite := cipherSuite(name)
+		if suite == nil {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("cipher suite %s is TLS 1.3 only; TLS 1.3 suites cannot be restricted", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, suite.ID)
+	}
+	return cfg, nil
+}
+
+func cipherSuite(name string) *tls.CipherSuite {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite
+		}
+	}
+	return nil
+}
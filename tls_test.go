@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveTLS starts l's proxy server over TLS with httptest's certificate.
+func serveTLS(t *testing.T, l *LLMSed) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(l.Handler())
+	srv.TLS = l.newServer("").TLSConfig
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func handshake(srv *httptest.Server, cfg *tls.Config) error {
+	cfg.InsecureSkipVerify = true
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), cfg)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestTLSMinVersionRefusesOlderClients(t *testing.T) {
+	cfg, err := newServerTLSConfig("1.3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTestLLMSed("http://127.0.0.1:0")
+	l.tlsConfig = cfg
+	srv := serveTLS(t, l)
+
+	if err := handshake(srv, &tls.Config{MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Error("TLS 1.2 handshake accepted with -tls-min-version 1.3")
+	}
+	if err := handshake(srv, &tls.Config{MinVersion: tls.VersionTLS13}); err != nil {
+		t.Errorf("TLS 1.3 handshake: %v", err)
+	}
+
+	client := srv.Client()
+	resp, err := client.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz over TLS: code = %d", resp.StatusCode)
+	}
+}
+
+func TestTLSCiphersRestrictSuites(t *testing.T) {
+	cfg, err := newServerTLSConfig("1.2", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTestLLMSed("http://127.0.0.1:0")
+	l.tlsConfig = cfg
+	srv := serveTLS(t, l)
+
+	tls12 := func(suite uint16) *tls.Config {
+		return &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{suite}}
+	}
+	if err := handshake(srv, tls12(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)); err == nil {
+		t.Error("handshake with an unlisted cipher suite accepted")
+	}
+	if err := handshake(srv, tls12(tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384)); err != nil {
+		t.Errorf("handshake with a listed cipher suite: %v", err)
+	}
+}
+
+func TestNewServerTLSConfigRejectsBadValues(t *testing.T) {
+	for _, c := range []struct{ version, ciphers, want string }{
+		{"1.4", "", "unknown TLS version"},
+		{"tls1.2", "", "unknown TLS version"},
+		{"1.2", "TLS_NOPE", `unknown or insecure cipher suite "TLS_NOPE"`},
+		{"1.2", "TLS_RSA_WITH_RC4_128_SHA", "unknown or insecure"},
+		{"1.2", "TLS_AES_128_GCM_SHA256", "TLS 1.3 only"},
+	} {
+		_, err := newServerTLSConfig(c.version, c.ciphers)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("(%q, %q): err = %v, want %q", c.version, c.ciphers, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// transformStep describes one transform applied while handling a request.
+type transformStep struct {
+	Stage       string  `json:"stage"`
+	Transform   string  `json:"transform"`
+	InputBytes  int     `json:"input_bytes"`
+	OutputBytes int     `json:"output_bytes,omitempty"`
+	DurationMS  float64 `json:"duration_ms"`
+	Error       string  `json:"error,omitempty"`
+
+	// Output is the transform's result, kept only for captures.
+	Output json.RawMessage `json:"output,omitempty"`
+}
+
+// requestTrace collects the transform steps of one request. It is only
+// attached to a request's context when diagnostics are wanted, since
+// measuring sizes costs an extra encode per step.
+type requestTrace struct {
+	mu    sync.Mutex
+	steps []transformStep
+	rule  string
+
+	// keepOutput records each step's output as well as its size.
+	keepOutput bool
+}
+
+func (t *requestTrace) add(step transformStep) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps, step)
+}
+
+func (t *requestTrace) setRule(tag string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rule = tag
+}
+
+func (t *requestTrace) Rule() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rule
+}
+
+func (t *requestTrace) Steps() []transformStep {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]transformStep(nil), t.steps...)
+}
+
+type traceKey struct{}
+
+func withTrace(ctx context.Context, t *requestTrace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+func traceFrom(ctx context.Context) *requestTrace {
+	t, _ := ctx.Value(traceKey{}).(*requestTrace)
+	return t
+}
+
+// traced runs a transform, recording it in ctx's trace when there is one.
+func traced(ctx context.Context, stage, name string, payload map[string]interface{}, fn func(map[string]interface{}) (map[string]interface{}, error)) (map[string]interface{}, error) {
+	t := traceFrom(ctx)
+	if t == nil {
+		return fn(payload)
+	}
+
+	// Measure the input first: built-in transforms modify it in place.
+	step := transformStep{Stage: stage, Transform: name, InputBytes: jsonSize(payload)}
+	start := time.Now()
+	out, err := fn(payload)
+	step.DurationMS = milliseconds(time.Since(start))
+	if err != nil {
+		step.Error = err.Error()
+	} else {
+		data, _ := json.Marshal(out)
+		step.OutputBytes = len(data)
+		if t.keepOutput {
+			step.Output = data
+		}
+	}
+	t.add(step)
+	return out, err
+}
+
+func jsonSize(v interface{}) int {
+	b, _ := json.Marshal(v)
+	return len(b)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// echo runs the request transforms for rule and answers with the result and
+// diagnostics instead of forwarding to the upstream. A request without a
+// JSON body has nothing to transform, as on the proxy path, so it reports
+// no transforms and a null request.
+func (l *LLMSed) echo(w http.ResponseWriter, r *http.Request, rule TransformRule, payload map[string]interface{}, inputBytes int) {
+	t := &requestTrace{}
+	start := time.Now()
+	var out map[string]interface{}
+	var err error
+	if payload != nil {
+		out, err = l.transformRequest(withTrace(r.Context(), t), rule, payload)
+	}
+
+	steps := t.Steps()
+	if steps == nil {
+		steps = []transformStep{}
+	}
+	result := map[string]interface{}{
+		"rule":        rule.Tag,
+		"input_bytes": inputBytes,
+		"transforms":  steps,
+		"duration_ms": milliseconds(time.Since(start)),
+	}
+	status := http.StatusOK
+	switch {
+	case err != nil:
+		status = errorStatus(err)
+		result["error"] = err.Error()
+	case out == nil:
+		result["request"] = nil
+		result["output_bytes"] = 0
+	default:
+		result["request"] = out
+		result["output_bytes"] = jsonSize(out)
+	}
+	writeJSON(w, status, result)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEchoPathReturnsDiagnostics(t *testing.T) {
+	var upstreamCalls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamCalls, 1)
+	}))
+	defer upstream.Close()
+	pre, _ := newRPCServer(t, func(params map[string]interface{}) map[string]interface{} {
+		params["model"] = "gpt-4o"
+		return params
+	})
+
+	l := newTestLLMSed(upstream.URL, TransformRule{
+		Tag:    "policy",
+		Type:   transformSystemPrompt,
+		Params: map[string]interface{}{"prompt": "Be brief."},
+		Pre:    pre.URL,
+	})
+	l.echoPath = "/_echo"
+
+	const body = `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/_echo", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d: %s", rec.Code, rec.Body.String())
+	}
+	if atomic.LoadInt32(&upstreamCalls) != 0 {
+		t.Error("echo path contacted the upstream")
+	}
+
+	var echo struct {
+		Rule        string                 `json:"rule"`
+		InputBytes  int                    `json:"input_bytes"`
+		OutputBytes int                    `json:"output_bytes"`
+		Request     map[string]interface{} `json:"request"`
+		Transforms  []transformStep        `json:"transforms"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &echo); err != nil {
+		t.Fatal(err)
+	}
+
+	if echo.Rule != "policy" {
+		t.Errorf("rule = %q", echo.Rule)
+	}
+	if echo.InputBytes != len(body) {
+		t.Errorf("input_bytes = %d, want %d", echo.InputBytes, len(body))
+	}
+	if echo.Request["model"] != "gpt-4o" {
+		t.Errorf("request = %v", echo.Request)
+	}
+	if echo.OutputBytes != jsonSize(echo.Request) {
+		t.Errorf("output_bytes = %d, want %d", echo.OutputBytes, jsonSize(echo.Request))
+	}
+	if len(echo.Transforms) != 2 {
+		t.Fatalf("transforms = %+v, want 2 steps", echo.Transforms)
+	}
+	if s := echo.Transforms[0]; s.Transform != transformSystemPrompt || s.Stage != "pre" || s.OutputBytes <= s.InputBytes {
+		t.Errorf("system-prompt step = %+v", s)
+	}
+	if s := echo.Transforms[1]; s.Transform != pre.URL || s.InputBytes != echo.Transforms[0].OutputBytes {
+		t.Errorf("pre step = %+v", s)
+	}
+}
+
+func TestEchoPathReportsTransformErrors(t *testing.T) {
+	l := newTestLLMSed("http://127.0.0.1:0", TransformRule{Tag: "broken", Type: transformSystemPrompt})
+	l.echoPath = "/_echo"
+
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/_echo", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("code = %d", rec.Code)
+	}
+	var echo struct {
+		Error      string          `json:"error"`
+		Transforms []transformStep `json:"transforms"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &echo)
+	if echo.Error == "" || len(echo.Transforms) != 1 || echo.Transforms[0].Error == "" {
+		t.Errorf("echo = %+v", echo)
+	}
+}
+
+func TestEchoPathWithoutBody(t *testing.T) {
+	l := newTestLLMSed("http://127.0.0.1:0", TransformRule{
+		Tag:    "policy",
+		Type:   transformSystemPrompt,
+		Params: map[string]interface{}{"prompt": "Be brief."},
+	})
+	l.echoPath = "/_echo"
+
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodGet, "/_echo", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d: %s", rec.Code, rec.Body.String())
+	}
+	var echo map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &echo); err != nil {
+		t.Fatal(err)
+	}
+	if steps, ok := echo["transforms"].([]interface{}); !ok || len(steps) != 0 {
+		t.Errorf("transforms = %#v, want an empty list", echo["transforms"])
+	}
+	if request, ok := echo["request"]; !ok || request != nil {
+		t.Errorf("request = %#v, want null", request)
+	}
+}
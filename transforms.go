@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// Built-in transform types, registered at init and selected by a rule's
+// "type" field.
+const (
+	transformSystemPrompt      = "system-prompt"
+	transformNormalizeResponse = "normalize-response"
+	transformTokenLimit        = "token-limit"
+	transformModelAlias        = "model-alias"
+	transformTemplate          = "template"
+	transformRename            = "rename"
+	transformRenameResponse    = "rename-response"
+	transformAllowModels       = "allow-models"
+	transformCEL               = "cel"
+	transformCELResponse       = "cel-response"
+	transformJSONPath          = "jsonpath"
+	transformDedupMessages     = "dedup-messages"
+	transformNormalizeSpace    = "normalize-whitespace"
+	transformLimitMessages     = "limit-messages"
+	transformScript            = "script"
+	transformScriptResponse    = "script-response"
+	transformNoop              = "noop"
+	transformDetectLanguage    = "detect-language"
+)
+
+// checkTransformType reports whether typ names a registered transformer,
+// and checks params for transformers that validate them.
+func checkTransformType(typ string, params map[string]interface{}) error {
+	if typ == "" {
+		return nil
+	}
+	t, ok := lookupTransformer(typ)
+	if !ok {
+		return fmt.Errorf("unknown transform type %q, registered types are %s", typ, strings.Join(transformerNames(), ", "))
+	}
+	if v, ok := t.(paramsValidator); ok {
+		return v.ValidateParams(params)
+	}
+	return nil
+}
+
+// isRequestTransform reports whether typ is an in-process request transform.
+func isRequestTransform(typ string) bool {
+	t, ok := lookupTransformer(typ)
+	return ok && t.Stage() == stagePre
+}
+
+// isResponseTransform reports whether typ is an in-process response
+// transform.
+func isResponseTransform(typ string) bool {
+	t, ok := lookupTransformer(typ)
+	return ok && t.Stage() == stagePost
+}
+
+// applyRequestTransform runs the rule's in-process request transform, if any,
+// on the incoming request body. Script transforms load from scriptDir.
+func applyRequestTransform(scriptDir string, rule TransformRule, payload map[string]interface{}) (map[string]interface{}, error) {
+	t, ok := lookupTransformer(rule.Type)
+	if !ok || t.Stage() != stagePre {
+		return payload, nil
+	}
+	return withScriptDir(t, scriptDir).Transform(rule.Params, payload)
+}
+
+// applyResponseTransform runs the rule's in-process response transform, if
+// any, on the upstream response body. Script transforms load from scriptDir.
+func applyResponseTransform(scriptDir string, rule TransformRule, payload map[string]interface{}) (map[string]interface{}, error) {
+	t, ok := lookupTransformer(rule.Type)
+	if !ok || t.Stage() != stagePost {
+		return payload, nil
+	}
+	return withScriptDir(t, scriptDir).Transform(rule.Params, payload)
+}
+
+// systemPrompt puts a system message at the start of the messages array.
+//
+// Params:
+//   - prompt: the system message text (required)
+//   - mode: "insert" always adds a new leading system message (default),
+//     "replace" overwrites the content of an existing leading system message,
+//     "merge" prefixes the existing system message's content with the prompt.
+//     With no existing system message, every mode inserts one.
+func systemPrompt(params map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, error) {
+	prompt, ok := params["prompt"].(string)
+	if !ok || prompt == "" {
+		return nil, fmt.Errorf("%s: params.prompt must be a non-empty string", transformSystemPrompt)
+	}
+	mode, _ := params["mode"].(string)
+	switch mode {
+	case "", "insert", "replace", "merge":
+	default:
+		return nil, fmt.Errorf("%s: unknown mode %q", transformSystemPrompt, mode)
+	}
+
+	messages, _ := payload["messages"].([]interface{})
+
+	var existing map[string]interface{}
+	if len(messages) > 0 {
+		if first, ok := messages[0].(map[string]interface{}); ok && first["role"] == "system" {
+			existing = first
+		}
+	}
+
+	switch {
+	case existing == nil || mode == "" || mode == "insert":
+		system := map[string]interface{}{"role": "system", "content": prompt}
+		payload["messages"] = append([]interface{}{system}, messages...)
+	case mode == "replace":
+		existing["content"] = prompt
+	case mode == "merge":
+		if content, ok := existing["content"].(string); ok && content != "" {
+			existing["content"] = prompt + "\n\n" + content
+		} else {
+			existing["content"] = prompt
+		}
+	}
+	return payload, nil
+}
+
+// normalizeResponse builds a new response body, typically OpenAI-shaped, out
+// of fields picked from the upstream response.
+//
+// Params:
+//   - mapping: source path in the upstream response -> target path in the
+//     new body (required). Missing sources are skipped.
+//   - defaults: target path -> constant value, set before the mapping is
+//     applied, e.g. {"object": "chat.completion"}.
+func normalizeResponse(params map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, error) {
+	mapping, ok := params["mapping"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: params.mapping must be an object", transformNormalizeResponse)
+	}
+	defaults, _ := params["defaults"].(map[string]interface{})
+
+	out := make(map[string]interface{})
+	for _, target := range sortedKeys(defaults) {
+		path, err := parsePath(target)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", transformNormalizeResponse, err)
+		}
+		if err := setPath(out, path, defaults[target]); err != nil {
+			return nil, fmt.Errorf("%s: %w", transformNormalizeResponse, err)
+		}
+	}
+
+	// Apply in target order so array elements are created index by index.
+	type field struct{ source, target []string }
+	var fields []field
+	for source, t := range mapping {
+		target, ok := t.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: target for %q must be a string", transformNormalizeResponse, source)
+		}
+		sourcePath, err := parsePath(source)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", transformNormalizeResponse, err)
+		}
+		targetPath, err := parsePath(target)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", transformNormalizeResponse, err)
+		}
+		fields = append(fields, field{sourcePath, targetPath})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return strings.Join(fields[i].target, ".") < strings.Join(fields[j].target, ".")
+	})
+
+	for _, f := range fields {
+		value, ok := getPath(payload, f.source)
+		if !ok {
+			continue
+		}
+		if err := setPath(out, f.target, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", transformNormalizeResponse, err)
+		}
+	}
+	return out, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// tokenEstimator estimates how many tokens text uses.
+type tokenEstimator func(text string) int
+
+// estimateTokens is the estimator used by the token-limit transform. A real
+// tokenizer would be plugged in here; tests replace it.
+var estimateTokens tokenEstimator = estimateTokensHeuristic
+
+// estimateTokensHeuristic assumes about four characters per token, which is
+// close for English text with common tokenizers.
+func estimateTokensHeuristic(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// messageText returns the text of a chat message whose content is either a
+// string or an array of content parts.
+func messageText(message interface{}) string {
+	m, _ := message.(map[string]interface{})
+	switch content := m["content"].(type) {
+	case string:
+		return content
+	case []interface{}:
+		var b strings.Builder
+		for _, part := range content {
+			if p, ok := part.(map[string]interface{}); ok {
+				if text, ok := p["text"].(string); ok {
+					b.WriteString(text)
+				}
+			}
+		}
+		return b.String()
+	}
+	return ""
+}
+
+func isSystemMessage(message interface{}) bool {
+	m, _ := message.(map[string]interface{})
+	return m["role"] == "system"
+}
+
+func estimateMessages(messages []interface{}) int {
+	total := 0
+	for _, m := range messages {
+		total += estimateTokens(messageText(m))
+	}
+	return total
+}
+
+// tokenLimit enforces a ceiling on the estimated prompt size of the
+// messages array.
+//
+// Params:
+//   - max_tokens: the ceiling (required)
+//   - action: "reject" answers 413 when the prompt is over the ceiling
+//     (default); "trim" drops the oldest non-system messages until it fits,
+//     always keeping the latest message, and rejects if that is not enough.
+func tokenLimit(params map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, error) {
+	ceiling, ok := params["max_tokens"].(float64)
+	if !ok || ceiling <= 0 {
+		return nil, fmt.Errorf("%s: params.max_tokens must be a positive number", transformTokenLimit)
+	}
+	action, _ := params["action"].(string)
+	if action != "" && action != "reject" && action != "trim" {
+		return nil, fmt.Errorf("%s: unknown action %q", transformTokenLimit, action)
+	}
+
+	messages, _ := payload["messages"].([]interface{})
+	estimate := estimateMessages(messages)
+	if estimate <= int(ceiling) {
+		return payload, nil
+	}
+
+	if action == "trim" {
+		for estimate > int(ceiling) {
+			oldest := -1
+			for i, m := range messages[:len(messages)-1] {
+				if !isSystemMessage(m) {
+					oldest = i
+					break
+				}
+			}
+			if oldest < 0 {
+				break
+			}
+			estimate -= estimateTokens(messageText(messages[oldest]))
+			messages = append(messages[:oldest:oldest], messages[oldest+1:]...)
+		}
+		if estimate <= int(ceiling) {
+			payload["messages"] = messages
+			return payload, nil
+		}
+	}
+
+	return nil, &RejectError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Message: fmt.Sprintf("prompt is about %d tokens, over the limit of %d", estimate, int(ceiling)),
+	}
+}
+
+// modelAlias rewrites the request's model field so clients can keep asking
+// for a name while the upstream receives another.
+//
+// Params: alias -> upstream model name, e.g. {"gpt-4": "gpt-4o-2024-08-06"}.
+// Models without an alias pass through unchanged.
+func modelAlias(params map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, error) {
+	model, ok := payload["model"].(string)
+	if !ok {
+		return payload, nil
+	}
+	alias, ok := params[model]
+	if !ok {
+		return payload, nil
+	}
+	target, ok := alias.(string)
+	if !ok || target == "" {
+		return nil, fmt.Errorf("%s: alias for %q must be a non-empty string", transformModelAlias, model)
+	}
+	payload["model"] = target
+	return payload, nil
+}
+
+// templateFuncs are available to "template" transforms. json renders a value
+// as JSON, which is how strings, arrays and objects should be inserted.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// renderTemplate builds a new request body by executing a text/template with
+// the incoming body as its data.
+//
+// Params:
+//   - template: the template source (required). Its output must be a JSON
+//     object.
+func renderTemplate(params map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, error) {
+	source, ok := params["template"].(string)
+	if !ok || source == "" {
+		return nil, fmt.Errorf("%s: params.template must be a non-empty string", transformTemplate)
+	}
+	tmpl, err := template.New(transformTemplate).Funcs(templateFuncs).Option("missingkey=zero").Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", transformTemplate, err)
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, payload); err != nil {
+		return nil, fmt.Errorf("%s: %w", transformTemplate, err)
+	}
+	var rendered map[string]interface{}
+	if err := decodeJSON(out.Bytes(), &rendered); err != nil {
+		return nil, fmt.Errorf("%s: rendered body is not a JSON object: %w", transformTemplate, err)
+	}
+	return rendered, nil
+}
+
+// renameFields moves values between paths, for "rename" on the request and
+// "rename-response" on the response.
+//
+// Params:
+//   - fields: old path -> new path (required). Missing sources are skipped.
+//   - overwrite: replace a value already at the new path. By default such a
+//     field is left where it is and the existing target kept.
+func renameFields(typ string, params map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, error) {
+	fields, ok := params["fields"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: params.fields must be an object", typ)
+	}
+	overwrite, _ := params["overwrite"].(bool)
+
+	for _, source := range sortedKeys(fields) {
+		target, ok := fields[source].(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: new path for %q must be a string", typ, source)
+		}
+		sourcePath, err := parsePath(source)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", typ, err)
+		}
+		targetPath, err := parsePath(target)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", typ, err)
+		}
+
+		value, ok := getPath(payload, sourcePath)
+		if !ok {
+			continue
+		}
+		if _, exists := getPath(payload, targetPath); exists && !overwrite {
+			continue
+		}
+		deletePath(payload, sourcePath)
+		if err := setPath(payload, targetPath, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", typ, err)
+		}
+	}
+	return payload, nil
+}
+
+// allowModels rejects requests for models outside an approved list with a
+// 403, including requests that name no model.
+//
+// Params:
+//   - models: the allowed model names (required)
+func allowModels(params map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, error) {
+	models, ok := params["models"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: params.models must be a list", transformAllowModels)
+	}
+	model, _ := payload["model"].(string)
+	for _, m := range models {
+		if m == model && model != "" {
+			return payload, nil
+		}
+	}
+	if model == "" {
+		return nil, &RejectError{Status: http.StatusForbidden, Message: "request names no model; a model from the allowed list is required"}
+	}
+	return nil, &RejectError{Status: http.StatusForbidden, Message: fmt.Sprintf("model %q is not allowed", model)}
+}
+
+// dedupMessages drops each message that repeats the one before it.
+//
+// Params:
+//   - compare: "role+content" treats messages as duplicates when both role
+//     and content match (default); "content" compares content alone.
+func dedupMessages(params map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, error) {
+	compare, _ := params["compare"].(string)
+	switch compare {
+	case "":
+		compare = "role+content"
+	case "role+content", "content":
+	default:
+		return nil, fmt.Errorf("%s: unknown compare %q", transformDedupMessages, compare)
+	}
+
+	messages, ok := payload["messages"].([]interface{})
+	if !ok || len(messages) < 2 {
+		return payload, nil
+	}
+	same := func(a, b interface{}) bool {
+		am, aok := a.(map[string]interface{})
+		bm, bok := b.(map[string]interface{})
+		if !aok || !bok {
+			return false
+		}
+		if compare == "role+content" && am["role"] != bm["role"] {
+			return false
+		}
+		return reflect.DeepEqual(am["content"], bm["content"])
+	}
+	kept := messages[:1:1]
+	for _, m := range messages[1:] {
+		if !same(kept[len(kept)-1], m) {
+			kept = append(kept, m)
+		}
+	}
+	payload["messages"] = kept
+	return payload, nil
+}
+
+// noop passes the request through unchanged. transformRequest logs each
+// time it runs, with the rule's tag, so a new rule's matching can be
+// checked before it does anything.
+func noop(params, payload map[string]interface{}) (map[string]interface{}, error) {
+	return payload, nil
+}
+
+// limitMessages caps the number of entries in messages, dropping the
+// oldest non-system messages first. System messages are always kept, as is
+// the latest message, so a cap smaller than the system messages still
+// leaves the conversation something to answer.
+//
+// Params:
+//   - max_messages: the most messages to forward (required)
+func limitMessages(params map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, error) {
+	limit, ok := params["max_messages"].(float64)
+	if !ok || limit < 1 || limit != float64(int(limit)) {
+		return nil, fmt.Errorf("%s: params.max_messages must be a positive integer", transformLimitMessages)
+	}
+	messages, ok := payload["messages"].([]interface{})
+	if !ok || len(messages) <= int(limit) {
+		return payload, nil
+	}
+
+	system := 0
+	for _, m := range messages {
+		if isSystemMessage(m) {
+			system++
+		}
+	}
+	// Walk back from the latest message, keeping as many of the others as
+	// the cap leaves room for.
+	keep := max(int(limit)-system, 1)
+	drop := make(map[int]bool)
+	for i := len(messages) - 1; i >= 0; i-- {
+		if isSystemMessage(messages[i]) {
+			continue
+		}
+		if keep > 0 {
+			keep--
+			continue
+		}
+		drop[i] = true
+	}
+	kept := make([]interface{}, 0, len(messages)-len(drop))
+	for i, m := range messages {
+		if !drop[i] {
+			kept = append(kept, m)
+		}
+	}
+	payload["messages"] = kept
+	return payload, nil
+}
+
+// codeFence opens and closes Markdown code blocks.
+const codeFence = "```"
+
+// normalizeWhitespace collapses each run of whitespace in message content
+// to a single space and trims the ends, so equivalent prompts hit caches
+// alike and spend fewer tokens. Both string content and the text of
+// content parts are normalized.
+//
+// Params:
+//   - preserve_code_blocks: leave ``` fenced blocks untouched, keeping the
+//     line breaks around them (default true).
+func normalizeWhitespace(params map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, error) {
+	preserve := true
+	if v, ok := params["preserve_code_blocks"]; ok {
+		if preserve, ok = v.(bool); !ok {
+			return nil, fmt.Errorf("%s: params.preserve_code_blocks must be a boolean", transformNormalizeSpace)
+		}
+	}
+
+	messages, _ := payload["messages"].([]interface{})
+	for _, message := range messages {
+		m, ok := message.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch content := m["content"].(type) {
+		case string:
+			m["content"] = collapseWhitespace(content, preserve)
+		case []interface{}:
+			for _, part := range content {
+				if p, ok := part.(map[string]interface{}); ok {
+					if text, ok := p["text"].(string); ok {
+						p["text"] = collapseWhitespace(text, preserve)
+					}
+				}
+			}
+		}
+	}
+	return payload, nil
+}
+
+// collapseWhitespace normalizes text for normalizeWhitespace. With
+// preserveCode, text from each ``` to the next, or to the end when a block
+// is left open, is kept as it is and set on its own lines.
+func collapseWhitespace(text string, preserveCode bool) string {
+	if !preserveCode {
+		return strings.Join(strings.Fields(text), " ")
+	}
+	var parts []string
+	for rest := text; rest != ""; {
+		start := strings.Index(rest, codeFence)
+		if start < 0 {
+			parts = appendProse(parts, rest)
+			break
+		}
+		parts = appendProse(parts, rest[:start])
+		end := strings.Index(rest[start+len(codeFence):], codeFence)
+		if end < 0 {
+			parts = append(parts, rest[start:])
+			break
+		}
+		end += start + 2*len(codeFence)
+		parts = append(parts, rest[start:end])
+		rest = rest[end:]
+	}
+	return strings.Join(parts, "\n")
+}
+
+func appendProse(parts []string, prose string) []string {
+	if collapsed := strings.Join(strings.Fields(prose), " "); collapsed != "" {
+		parts = append(parts, collapsed)
+	}
+	return parts
+}
+
+// jsonPathOperations applies a list of set, get and delete operations to the
+// response body. Paths are written as for rename ("$.choices[0].message")
+// and a "*" segment matches every element of an array or key of an object,
+// e.g. "$.choices[*].logprobs".
+//
+// Params:
+//   - operations: the operations, applied in order (required). Each has an
+//     "op" and a "path":
+//   - "set" stores "value" at path, creating missing objects and arrays.
+//   - "get" copies the value at "from" to path. With a wildcard in "from"
+//     the matches are collected into a list; when nothing matches, path is
+//     left alone.
+//   - "delete" removes path. Missing paths are ignored.
+func jsonPathOperations(params map[string]interface{}, payload map[string]interface{}) (map[string]interface{}, error) {
+	ops, ok := params["operations"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: params.operations must be a list", transformJSONPath)
+	}
+	for n, o := range ops {
+		if err := jsonPathOperation(o, payload); err != nil {
+			return nil, fmt.Errorf("%s: operation %d: %w", transformJSONPath, n, err)
+		}
+	}
+	return payload, nil
+}
+
+func jsonPathOperation(o interface{}, payload map[string]interface{}) error {
+	op, ok := o.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("must be an object")
+	}
+	raw, _ := op["path"].(string)
+	path, err := parsePath(raw)
+	if err != nil {
+		return err
+	}
+
+	switch op["op"] {
+	case "set":
+		value, ok := op["value"]
+		if !ok {
+			return fmt.Errorf("set needs a value")
+		}
+		for _, p := range expandPath(payload, path) {
+			if err := setPath(payload, p, value); err != nil {
+				return err
+			}
+		}
+	case "get":
+		rawFrom, _ := op["from"].(string)
+		from, err := parsePath(rawFrom)
+		if err != nil {
+			return err
+		}
+		matches := expandPath(payload, from)
+		var values []interface{}
+		for _, p := range matches {
+			if v, ok := getPath(payload, p); ok {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			return nil
+		}
+		var value interface{} = values
+		if !slices.Contains(from, "*") {
+			value = values[0]
+		}
+		return setPath(payload, path, value)
+	case "delete":
+		// Later matches first, so deleting array elements does not shift
+		// the indexes still to be deleted.
+		matches := expandPath(payload, path)
+		for i := len(matches) - 1; i >= 0; i-- {
+			deletePath(payload, matches[i])
+		}
+	default:
+		return fmt.Errorf("unknown op %v, want set, get or delete", op["op"])
+	}
+	return nil
+}
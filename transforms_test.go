@@ -0,0 +1,593 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// decode parses a JSON object literal for use as a test payload.
+func decode(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("decode %s: %v", s, err)
+	}
+	return v
+}
+
+func assertJSON(t *testing.T, got interface{}, want string) {
+	t.Helper()
+	var w interface{}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("decode want: %v", err)
+	}
+	gotJSON, _ := json.Marshal(got)
+	var g interface{}
+	json.Unmarshal(gotJSON, &g)
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("got %s\nwant %s", gotJSON, want)
+	}
+}
+
+func TestSystemPromptInsert(t *testing.T) {
+	rule := TransformRule{Type: transformSystemPrompt, Params: map[string]interface{}{"prompt": "Be brief."}}
+
+	out, err := applyRequestTransform("", rule, decode(t, `{"messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"hi"}]}`)
+
+	// Insert mode adds a new message even when one exists.
+	out, err = applyRequestTransform("", rule, decode(t, `{"messages":[{"role":"system","content":"Old."},{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"messages":[{"role":"system","content":"Be brief."},{"role":"system","content":"Old."},{"role":"user","content":"hi"}]}`)
+}
+
+func TestSystemPromptReplace(t *testing.T) {
+	rule := TransformRule{Type: transformSystemPrompt, Params: map[string]interface{}{"prompt": "Be brief.", "mode": "replace"}}
+
+	out, err := applyRequestTransform("", rule, decode(t, `{"messages":[{"role":"system","content":"Old."},{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"hi"}]}`)
+
+	// Without an existing system message, replace inserts one.
+	out, err = applyRequestTransform("", rule, decode(t, `{"messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"hi"}]}`)
+}
+
+func TestSystemPromptMerge(t *testing.T) {
+	rule := TransformRule{Type: transformSystemPrompt, Params: map[string]interface{}{"prompt": "Be brief.", "mode": "merge"}}
+
+	out, err := applyRequestTransform("", rule, decode(t, `{"messages":[{"role":"system","content":"Old."}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"messages":[{"role":"system","content":"Be brief.\n\nOld."}]}`)
+}
+
+func TestSystemPromptRequiresPrompt(t *testing.T) {
+	rule := TransformRule{Type: transformSystemPrompt}
+	if _, err := applyRequestTransform("", rule, decode(t, `{"messages":[]}`)); err == nil {
+		t.Fatal("expected error without params.prompt")
+	}
+}
+
+func TestConfigRejectsUnknownTransformType(t *testing.T) {
+	cfg := Config{Rules: []TransformRule{{Tag: "bad", Type: "nope"}}}
+	if err := cfg.validate(); err == nil {
+		t.Fatal("expected validation error for unknown type")
+	}
+}
+
+func TestNormalizeResponseToOpenAIShape(t *testing.T) {
+	rule := TransformRule{
+		Type: transformNormalizeResponse,
+		Params: decode(t, `{
+			"mapping": {
+				"id": "id",
+				"result.model_name": "model",
+				"result.output.text": "choices[0].message.content",
+				"result.stop": "choices[0].finish_reason",
+				"result.missing": "usage.total_tokens"
+			},
+			"defaults": {
+				"object": "chat.completion",
+				"choices.0.index": 0,
+				"choices.0.message.role": "assistant"
+			}
+		}`),
+	}
+
+	out, err := applyResponseTransform("", rule, decode(t, `{
+		"id": "gen-1",
+		"result": {"model_name": "custom-llm", "output": {"text": "Hello!"}, "stop": "end_turn"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{
+		"id": "gen-1",
+		"object": "chat.completion",
+		"model": "custom-llm",
+		"choices": [{"index": 0, "message": {"role": "assistant", "content": "Hello!"}, "finish_reason": "end_turn"}]
+	}`)
+}
+
+func TestNormalizeResponseRequiresMapping(t *testing.T) {
+	rule := TransformRule{Type: transformNormalizeResponse}
+	if _, err := applyResponseTransform("", rule, decode(t, `{}`)); err == nil {
+		t.Fatal("expected error without params.mapping")
+	}
+}
+
+// countWords is a predictable estimator for tests: one token per word.
+func countWords(text string) int { return len(strings.Fields(text)) }
+
+func useEstimator(t *testing.T, e tokenEstimator) {
+	old := estimateTokens
+	estimateTokens = e
+	t.Cleanup(func() { estimateTokens = old })
+}
+
+func TestTokenLimitRejects(t *testing.T) {
+	useEstimator(t, countWords)
+
+	var upstreamCalls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	l := newTestLLMSed(upstream.URL, TransformRule{
+		Type:   transformTokenLimit,
+		Params: map[string]interface{}{"max_tokens": float64(5)},
+	})
+
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"one two three four five six"}]}`)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("code = %d, want 413", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "limit of 5") {
+		t.Errorf("body = %q", rec.Body.String())
+	}
+	if atomic.LoadInt32(&upstreamCalls) != 0 {
+		t.Error("rejected request reached the upstream")
+	}
+
+	rec = httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"one two"}]}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("under the limit: code = %d, want 200", rec.Code)
+	}
+}
+
+func TestTokenLimitTrimsOldestMessages(t *testing.T) {
+	useEstimator(t, countWords)
+	rule := TransformRule{
+		Type:   transformTokenLimit,
+		Params: map[string]interface{}{"max_tokens": float64(6), "action": "trim"},
+	}
+
+	out, err := applyRequestTransform("", rule, decode(t, `{"messages":[
+		{"role":"system","content":"be brief"},
+		{"role":"user","content":"first question here"},
+		{"role":"assistant","content":"first answer"},
+		{"role":"user","content":"second question"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"messages":[
+		{"role":"system","content":"be brief"},
+		{"role":"assistant","content":"first answer"},
+		{"role":"user","content":"second question"}
+	]}`)
+
+	// When even the latest message does not fit, trim falls back to reject.
+	_, err = applyRequestTransform("", rule, decode(t, `{"messages":[
+		{"role":"system","content":"be brief"},
+		{"role":"user","content":"a b c d e f g h"}
+	]}`))
+	var rejectErr *RejectError
+	if !errors.As(err, &rejectErr) || rejectErr.Status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("err = %v, want 413 RejectError", err)
+	}
+}
+
+func TestMessageTextHandlesContentParts(t *testing.T) {
+	msg := decode(t, `{"role":"user","content":[{"type":"text","text":"Hello "},{"type":"image_url"},{"type":"text","text":"world"}]}`)
+	if got := messageText(msg); got != "Hello world" {
+		t.Errorf("messageText = %q", got)
+	}
+}
+
+func TestModelAliasRewritesMappedModel(t *testing.T) {
+	rule := TransformRule{Type: transformModelAlias, Params: map[string]interface{}{"gpt-4": "gpt-4o-2024-08-06"}}
+
+	out, err := applyRequestTransform("", rule, decode(t, `{"model":"gpt-4","messages":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"model":"gpt-4o-2024-08-06","messages":[]}`)
+}
+
+func TestModelAliasPassesUnmappedModel(t *testing.T) {
+	rule := TransformRule{Type: transformModelAlias, Params: map[string]interface{}{"gpt-4": "gpt-4o-2024-08-06"}}
+
+	out, err := applyRequestTransform("", rule, decode(t, `{"model":"claude-3-opus","messages":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"model":"claude-3-opus","messages":[]}`)
+}
+
+func TestTemplateReshapesRequest(t *testing.T) {
+	rule := TransformRule{Type: transformTemplate, Params: map[string]interface{}{
+		"template": `{"modelId": {{json .model}}, "input": {"prompt": {{json (index .messages 0).content}}, "maxTokens": {{or .max_tokens 256}}}}`,
+	}}
+
+	var payload map[string]interface{}
+	decodeJSON([]byte(`{"model":"claude-3","messages":[{"role":"user","content":"say \"hi\""}],"max_tokens":100}`), &payload)
+	out, err := applyRequestTransform("", rule, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"modelId":"claude-3","input":{"prompt":"say \"hi\"","maxTokens":100}}`)
+
+	// Missing fields render as their zero value, so defaults still apply.
+	out, err = applyRequestTransform("", rule, decode(t, `{"model":"claude-3","messages":[{"content":"x"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"modelId":"claude-3","input":{"prompt":"x","maxTokens":256}}`)
+}
+
+func TestTemplateRejectsInvalidJSON(t *testing.T) {
+	rule := TransformRule{Type: transformTemplate, Params: map[string]interface{}{"template": `{"model": {{.model}}}`}}
+
+	if _, err := applyRequestTransform("", rule, decode(t, `{"model":"gpt-4"}`)); err == nil || !strings.Contains(err.Error(), "not a JSON object") {
+		t.Errorf("err = %v, want invalid JSON error", err)
+	}
+}
+
+func TestRenameRequestFields(t *testing.T) {
+	rule := TransformRule{Type: transformRename, Params: map[string]interface{}{
+		"fields": map[string]interface{}{"max_completion_tokens": "max_tokens", "user": "metadata.user_id"},
+	}}
+
+	out, err := applyRequestTransform("", rule, decode(t, `{"model":"m","max_completion_tokens":50}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "user" is missing and skipped.
+	assertJSON(t, out, `{"model":"m","max_tokens":50}`)
+}
+
+func TestRenameKeepsExistingTargetUnlessOverwrite(t *testing.T) {
+	params := map[string]interface{}{"fields": map[string]interface{}{"max_completion_tokens": "max_tokens"}}
+	rule := TransformRule{Type: transformRename, Params: params}
+
+	out, err := applyRequestTransform("", rule, decode(t, `{"max_completion_tokens":50,"max_tokens":10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"max_completion_tokens":50,"max_tokens":10}`)
+
+	params["overwrite"] = true
+	out, err = applyRequestTransform("", rule, decode(t, `{"max_completion_tokens":50,"max_tokens":10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"max_tokens":50}`)
+}
+
+func TestRenameResponseFields(t *testing.T) {
+	rule := TransformRule{Type: transformRenameResponse, Params: map[string]interface{}{
+		"fields": map[string]interface{}{"usage.input_tokens": "usage.prompt_tokens", "stop_reason": "finish_reason"},
+	}}
+
+	out, err := applyResponseTransform("", rule, decode(t, `{"usage":{"input_tokens":3,"output_tokens":2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"usage":{"prompt_tokens":3,"output_tokens":2}}`)
+}
+
+func TestAllowModels(t *testing.T) {
+	rule := TransformRule{Type: transformAllowModels, Params: map[string]interface{}{
+		"models": []interface{}{"gpt-4o-mini", "gpt-4o"},
+	}}
+
+	out, err := applyRequestTransform("", rule, decode(t, `{"model":"gpt-4o"}`))
+	if err != nil {
+		t.Fatalf("allowed model rejected: %v", err)
+	}
+	assertJSON(t, out, `{"model":"gpt-4o"}`)
+
+	for _, body := range []string{`{"model":"o1-pro"}`, `{}`} {
+		_, err := applyRequestTransform("", rule, decode(t, body))
+		var reject *RejectError
+		if !errors.As(err, &reject) || reject.Status != http.StatusForbidden {
+			t.Errorf("%s: err = %v, want 403 rejection", body, err)
+		}
+	}
+	if _, err := applyRequestTransform("", rule, decode(t, `{"model":"o1-pro"}`)); !strings.Contains(err.Error(), `"o1-pro" is not allowed`) {
+		t.Errorf("message %q does not name the model", err)
+	}
+}
+
+func TestDedupMessagesRemovesConsecutiveDuplicates(t *testing.T) {
+	rule := TransformRule{Type: transformDedupMessages}
+	out, err := applyRequestTransform("", rule, decode(t, `{"messages":[
+		{"role":"user","content":"hi"},{"role":"user","content":"hi"},{"role":"user","content":"hi"},
+		{"role":"assistant","content":"hi"},{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":"hi"},{"role":"user","content":"hi"}]}`)
+}
+
+func TestDedupMessagesContentOnly(t *testing.T) {
+	rule := TransformRule{Type: transformDedupMessages, Params: map[string]interface{}{"compare": "content"}}
+	out, err := applyRequestTransform("", rule, decode(t, `{"messages":[
+		{"role":"user","content":"hi"},{"role":"assistant","content":"hi"},{"role":"user","content":"bye"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"messages":[{"role":"user","content":"hi"},{"role":"user","content":"bye"}]}`)
+}
+
+func TestDedupMessagesKeepsDistinctMessages(t *testing.T) {
+	const body = `{"messages":[{"role":"system","content":"be brief"},{"role":"user","content":[{"type":"text","text":"a"}]},{"role":"user","content":[{"type":"text","text":"b"}]}]}`
+	out, err := applyRequestTransform("", TransformRule{Type: transformDedupMessages}, decode(t, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, body)
+
+	bad := TransformRule{Type: transformDedupMessages, Params: map[string]interface{}{"compare": "role"}}
+	if _, err := applyRequestTransform("", bad, decode(t, body)); err == nil {
+		t.Error("expected error for unknown compare mode")
+	}
+}
+
+func TestLimitMessagesTrimsOldest(t *testing.T) {
+	rule := TransformRule{Type: transformLimitMessages, Params: map[string]interface{}{"max_messages": float64(3)}}
+	out, err := applyRequestTransform("", rule, decode(t, `{"messages":[
+		{"role":"system","content":"be brief"},{"role":"user","content":"1"},{"role":"assistant","content":"2"},
+		{"role":"user","content":"3"},{"role":"assistant","content":"4"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"messages":[{"role":"system","content":"be brief"},{"role":"user","content":"3"},{"role":"assistant","content":"4"}]}`)
+
+	const short = `{"messages":[{"role":"user","content":"1"},{"role":"assistant","content":"2"}]}`
+	out, err = applyRequestTransform("", rule, decode(t, short))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, short)
+}
+
+func TestLimitMessagesKeepsSystemMessages(t *testing.T) {
+	rule := TransformRule{Type: transformLimitMessages, Params: map[string]interface{}{"max_messages": float64(2)}}
+	out, err := applyRequestTransform("", rule, decode(t, `{"messages":[
+		{"role":"system","content":"a"},{"role":"user","content":"1"},{"role":"system","content":"b"},
+		{"role":"user","content":"2"},{"role":"user","content":"3"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both system messages fill the cap, so only the latest message joins them.
+	assertJSON(t, out, `{"messages":[{"role":"system","content":"a"},{"role":"system","content":"b"},{"role":"user","content":"3"}]}`)
+
+	for _, bad := range []interface{}{nil, float64(0), float64(2.5), "3"} {
+		rule := TransformRule{Type: transformLimitMessages, Params: map[string]interface{}{"max_messages": bad}}
+		if _, err := applyRequestTransform("", rule, decode(t, `{"messages":[]}`)); err == nil {
+			t.Errorf("max_messages %v: expected error", bad)
+		}
+	}
+}
+
+func TestNoopPassesRequestThroughAndLogs(t *testing.T) {
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		forwarded = string(body)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+	logs := captureLog(t)
+
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "wiring", Type: transformNoop})
+	const body = `{"messages":[{"content":"  spaced  ","role":"user"}],"model":"gpt-4o","temperature":0.25}`
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body.String())
+	}
+	assertJSON(t, decode(t, forwarded), body)
+	if !strings.Contains(logs.String(), `noop transform ran for rule "wiring"`) {
+		t.Errorf("no noop log line in %q", logs.String())
+	}
+}
+
+func TestNormalizeWhitespaceCollapsesOutsideCodeFences(t *testing.T) {
+	payload := map[string]interface{}{"messages": []interface{}{
+		map[string]interface{}{"role": "user", "content": "  Fix   this:\n\n\t```go\nfunc f() {\n\treturn  1\n}\n```\n\n  please  \n"},
+		map[string]interface{}{"role": "user", "content": []interface{}{
+			map[string]interface{}{"type": "text", "text": "a \n\n b"},
+		}},
+	}}
+	out, err := applyRequestTransform("", TransformRule{Type: transformNormalizeSpace}, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := out["messages"].([]interface{})
+	if got, want := messages[0].(map[string]interface{})["content"], "Fix this:\n```go\nfunc f() {\n\treturn  1\n}\n```\nplease"; got != want {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+	if got := messages[1].(map[string]interface{})["content"].([]interface{})[0].(map[string]interface{})["text"]; got != "a b" {
+		t.Errorf("content part text = %q", got)
+	}
+}
+
+func TestNormalizeWhitespaceWithoutCodePreservation(t *testing.T) {
+	rule := TransformRule{Type: transformNormalizeSpace, Params: map[string]interface{}{"preserve_code_blocks": false}}
+	out, err := applyRequestTransform("", rule, map[string]interface{}{"messages": []interface{}{
+		map[string]interface{}{"role": "user", "content": "x\n```\n  y\n```"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out["messages"].([]interface{})[0].(map[string]interface{})["content"]; got != "x ``` y ```" {
+		t.Errorf("content = %q", got)
+	}
+}
+
+func TestCollapseWhitespaceKeepsUnclosedFence(t *testing.T) {
+	if got, want := collapseWhitespace("see:  ```\n  open  block", true), "see:\n```\n  open  block"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCELModifiesField(t *testing.T) {
+	rule := TransformRule{Type: transformCEL, Params: map[string]interface{}{
+		"expression": `body.with("model", body.model == "fast" ? "gpt-4o-mini" : body.model)`,
+	}}
+	out, err := applyRequestTransform("", rule, decode(t, `{"model":"fast","messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`)
+}
+
+func TestCELBuildsBody(t *testing.T) {
+	rule := TransformRule{Type: transformCEL, Params: map[string]interface{}{
+		"expression": `{"model": body.model, "max_tokens": body.max_tokens * 2, "prompt": body.messages.map(m, m.content)}`,
+	}}
+	var payload map[string]interface{}
+	if err := decodeJSON([]byte(`{"model":"m","max_tokens":100,"messages":[{"content":"a"},{"content":"b"}]}`), &payload); err != nil {
+		t.Fatal(err)
+	}
+	out, err := applyRequestTransform("", rule, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"model":"m","max_tokens":200,"prompt":["a","b"]}`)
+}
+
+func TestCELResponse(t *testing.T) {
+	rule := TransformRule{Type: transformCELResponse, Params: map[string]interface{}{
+		"expression": `{"text": body.choices[0].message.content}`,
+	}}
+	out, err := applyResponseTransform("", rule, decode(t, `{"choices":[{"message":{"content":"hello"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"text":"hello"}`)
+}
+
+func TestCELRejectsNonMapResult(t *testing.T) {
+	rule := TransformRule{Type: transformCEL, Params: map[string]interface{}{"expression": `body.model`}}
+	if _, err := applyRequestTransform("", rule, decode(t, `{"model":"m"}`)); err == nil || !strings.Contains(err.Error(), "must evaluate to a map") {
+		t.Errorf("err = %v, want non-map error", err)
+	}
+}
+
+func TestCELInvalidExpressionFailsLoad(t *testing.T) {
+	for _, params := range []map[string]interface{}{
+		{"expression": `body.with("model"`},
+		{"expression": `body.nope(1)`},
+		{},
+	} {
+		config := Config{Rules: []TransformRule{{Tag: "cel", Type: transformCEL, Params: params}}}
+		if err := config.validate(); err == nil || !strings.Contains(err.Error(), "rule 0 (cel): cel:") {
+			t.Errorf("%v: err = %v, want load error", params, err)
+		}
+	}
+}
+
+func jsonPathRule(ops ...string) TransformRule {
+	var operations []interface{}
+	for _, op := range ops {
+		var o interface{}
+		json.Unmarshal([]byte(op), &o)
+		operations = append(operations, o)
+	}
+	return TransformRule{Type: transformJSONPath, Params: map[string]interface{}{"operations": operations}}
+}
+
+func TestJSONPathSet(t *testing.T) {
+	rule := jsonPathRule(
+		`{"op":"set","path":"$.provider","value":"llsed"}`,
+		`{"op":"set","path":"$.choices[*].message.role","value":"assistant"}`,
+		`{"op":"set","path":"meta.tags[0]","value":"new"}`,
+	)
+	out, err := applyResponseTransform("", rule, decode(t, `{"choices":[{"message":{}},{"message":{"role":"bot"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"provider":"llsed","choices":[{"message":{"role":"assistant"}},{"message":{"role":"assistant"}}],"meta":{"tags":["new"]}}`)
+}
+
+func TestJSONPathGetIntoNewField(t *testing.T) {
+	rule := jsonPathRule(
+		`{"op":"get","from":"$.choices[0].message.content","path":"$.text"}`,
+		`{"op":"get","from":"$.choices[*].finish_reason","path":"$.reasons"}`,
+		`{"op":"get","from":"$.usage.total_tokens","path":"$.tokens"}`,
+	)
+	out, err := applyResponseTransform("", rule, decode(t, `{"choices":[{"message":{"content":"hi"},"finish_reason":"stop"},{"finish_reason":"length"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"choices":[{"message":{"content":"hi"},"finish_reason":"stop"},{"finish_reason":"length"}],"text":"hi","reasons":["stop","length"]}`)
+}
+
+func TestJSONPathDelete(t *testing.T) {
+	rule := jsonPathRule(
+		`{"op":"delete","path":"$.choices[*].logprobs"}`,
+		`{"op":"delete","path":"$.system_fingerprint"}`,
+		`{"op":"delete","path":"$.usage.missing"}`,
+		`{"op":"delete","path":"$.extra[*]"}`,
+	)
+	out, err := applyResponseTransform("", rule, decode(t, `{"choices":[{"index":0,"logprobs":{}},{"index":1,"logprobs":null}],"system_fingerprint":"fp","extra":[1,2,3]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, out, `{"choices":[{"index":0},{"index":1}],"extra":[]}`)
+}
+
+func TestJSONPathRejectsBadOperations(t *testing.T) {
+	for _, op := range []string{
+		`{"op":"move","path":"a"}`,
+		`{"op":"set","path":"a"}`,
+		`{"op":"get","path":"a"}`,
+		`{"op":"delete"}`,
+		`{"op":"set","path":"a.b","value":1}`,
+	} {
+		_, err := applyResponseTransform("", jsonPathRule(op), decode(t, `{"a":"string"}`))
+		if err == nil || !strings.Contains(err.Error(), "jsonpath: operation 0") {
+			t.Errorf("%s: err = %v, want operation error", op, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Condition is one test against the parsed request body. Exactly one of
+// Equals and Exists is set.
+type Condition struct {
+	Path   string      `json:"path"`
+	Equals interface{} `json:"equals"`
+	Exists *bool       `json:"exists"`
+}
+
+func (c Condition) validate() error {
+	if _, err := parsePath(c.Path); err != nil {
+		return fmt.Errorf("when: %w", err)
+	}
+	if (c.Equals == nil) == (c.Exists == nil) {
+		return fmt.Errorf("when: condition on %q needs exactly one of equals and exists", c.Path)
+	}
+	return nil
+}
+
+// matches reports whether the condition holds for payload.
+func (c Condition) matches(payload map[string]interface{}) bool {
+	path, err := parsePath(c.Path)
+	if err != nil {
+		return false
+	}
+	value, found := getPath(payload, path)
+	if c.Exists != nil {
+		return found == *c.Exists
+	}
+	return found && jsonEqual(value, c.Equals)
+}
+
+// jsonEqual compares two decoded JSON values by their JSON meaning, so a
+// json.Number from the request body equals the float64 from the config.
+func jsonEqual(a, b interface{}) bool {
+	normalize := func(v interface{}) interface{} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil
+		}
+		var out interface{}
+		json.Unmarshal(data, &out)
+		return out
+	}
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+// transformsApply reports whether the rule's transforms run for this request
+// body: every When condition must hold.
+func (r TransformRule) transformsApply(payload map[string]interface{}) bool {
+	for _, c := range r.When {
+		if !c.matches(payload) {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutTransforms returns the rule with its transforms removed, leaving
+// forwarding settings such as the client and headers in place.
+func (r TransformRule) withoutTransforms() TransformRule {
+	r.Type, r.Params = "", nil
+	r.Pre, r.Post, r.PreChain, r.PostChain = "", "", nil, nil
+	r.StreamTransform = ""
+	return r
+}
+
+// StatusOverride replaces the status code sent to the client when the
+// response body matches every condition in When.
+type StatusOverride struct {
+	When   []Condition `json:"when"`
+	Status int         `json:"status"`
+}
+
+func (o StatusOverride) validate() error {
+	if o.Status < 100 || o.Status > 599 {
+		return fmt.Errorf("status_map: invalid status %d", o.Status)
+	}
+	if len(o.When) == 0 {
+		return fmt.Errorf("status_map: entry for %d has no conditions", o.Status)
+	}
+	for _, c := range o.When {
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("status_map: %w", err)
+		}
+	}
+	return nil
+}
+
+// responseStatus returns the status of the first StatusMap entry whose
+// conditions all hold for payload, or status when none matches.
+func (r TransformRule) responseStatus(status int, payload map[string]interface{}) int {
+	for _, o := range r.StatusMap {
+		matched := true
+		for _, c := range o.When {
+			if !c.matches(payload) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return o.Status
+		}
+	}
+	return status
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWhenGatesTransforms(t *testing.T) {
+	var got map[string]interface{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = nil
+		json.Unmarshal(body, &got)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	yes := true
+	l := newTestLLMSed(upstream.URL, TransformRule{
+		Tag:    "streaming-tools",
+		Type:   transformModelAlias,
+		Params: map[string]interface{}{"gpt-4": "gpt-4o"},
+		When: []Condition{
+			{Path: "stream", Equals: true},
+			{Path: "tools", Exists: &yes},
+		},
+	})
+
+	tests := []struct {
+		body, model string
+	}{
+		{`{"model":"gpt-4","stream":true,"tools":[]}`, "gpt-4o"},
+		{`{"model":"gpt-4","stream":false,"tools":[]}`, "gpt-4"},
+		{`{"model":"gpt-4","stream":true}`, "gpt-4"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(tt.body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code %d", tt.body, rec.Code)
+		}
+		if got["model"] != tt.model {
+			t.Errorf("%s: upstream model = %v, want %s", tt.body, got["model"], tt.model)
+		}
+	}
+}
+
+func TestConditionEqualsComparesNumbers(t *testing.T) {
+	var payload map[string]interface{}
+	if err := decodeJSON([]byte(`{"n":2,"opts":{"temperature":0.5}}`), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if !(Condition{Path: "n", Equals: float64(2)}).matches(payload) {
+		t.Error("n == 2 did not match")
+	}
+	if !(Condition{Path: "opts", Equals: map[string]interface{}{"temperature": 0.5}}).matches(payload) {
+		t.Error("object equality did not match")
+	}
+	if (Condition{Path: "n", Equals: float64(3)}).matches(payload) {
+		t.Error("n == 3 matched")
+	}
+}
+
+func TestConfigRejectsInvalidCondition(t *testing.T) {
+	yes := true
+	for _, c := range []Condition{
+		{Path: "stream"},
+		{Path: "stream", Equals: true, Exists: &yes},
+		{Path: "", Exists: &yes},
+	} {
+		if err := (Config{Rules: []TransformRule{{Tag: "r", When: []Condition{c}}}}).validate(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestStatusMapTurnsErrorBodyInto400(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.Write([]byte(`{"error":{"message":"bad model"}}`))
+			return
+		}
+		w.Write([]byte(`{"choices":[]}`))
+	}))
+	defer upstream.Close()
+
+	yes := true
+	l := newTestLLMSed(upstream.URL, TransformRule{
+		Tag:       "status",
+		StatusMap: []StatusOverride{{When: []Condition{{Path: "error", Exists: &yes}}, Status: http.StatusBadRequest}},
+	})
+
+	for path, want := range map[string]int{"/fail": http.StatusBadRequest, "/ok": http.StatusOK} {
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{}`)))
+		if rec.Code != want {
+			t.Errorf("%s: code = %d, want %d (body %s)", path, rec.Code, want, rec.Body.String())
+		}
+	}
+}
+
+func TestConfigRejectsInvalidStatusMap(t *testing.T) {
+	yes := true
+	for _, o := range []StatusOverride{
+		{When: []Condition{{Path: "error", Exists: &yes}}, Status: 42},
+		{Status: http.StatusBadRequest},
+	} {
+		if err := (Config{Rules: []TransformRule{{Tag: "r", StatusMap: []StatusOverride{o}}}}).validate(); err == nil {
+			t.Errorf("%+v: expected error", o)
+		}
+	}
+}
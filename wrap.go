@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Payload wrapping shapes for a rule's payload_wrap, which decide how the
+// body is put into JSON-RPC params and taken back out of the result.
+const (
+	// wrapRaw sends the body as params and takes the result as the new body.
+	wrapRaw = "raw"
+	// wrapInput sends {"input": body} and expects {"output": body}.
+	wrapInput = "input"
+	// wrapMessages sends {"messages": body.messages} and expects
+	// {"messages": [...]}, which replaces the body's messages; every other
+	// field of the body is kept as it was.
+	wrapMessages = "messages"
+	// wrapPositional sends [body], JSON-RPC's positional params, and takes
+	// the result as the new body.
+	wrapPositional = "positional"
+)
+
+func validatePayloadWrap(shape string) error {
+	switch shape {
+	case "", wrapRaw, wrapInput, wrapMessages, wrapPositional:
+		return nil
+	}
+	return fmt.Errorf("unknown payload_wrap %q, want %q, %q, %q or %q", shape, wrapRaw, wrapInput, wrapMessages, wrapPositional)
+}
+
+// wrapPayload returns the JSON-RPC params for payload under shape.
+func wrapPayload(shape string, payload map[string]interface{}) interface{} {
+	switch shape {
+	case wrapInput:
+		return map[string]interface{}{"input": payload}
+	case wrapMessages:
+		return map[string]interface{}{"messages": payload["messages"]}
+	case wrapPositional:
+		return []interface{}{payload}
+	}
+	return payload
+}
+
+// unwrapResult returns the new body from a JSON-RPC result under shape.
+// payload is the body that was sent, which wrapMessages builds on.
+func unwrapResult(shape string, payload map[string]interface{}, result interface{}) (map[string]interface{}, error) {
+	object, isObject := result.(map[string]interface{})
+	switch shape {
+	case wrapInput:
+		output, ok := object["output"].(map[string]interface{})
+		if !ok {
+			return nil, shapeError(shape, `{"output": {...}}`, result)
+		}
+		return output, nil
+	case wrapMessages:
+		messages, ok := object["messages"].([]interface{})
+		if !ok {
+			return nil, shapeError(shape, `{"messages": [...]}`, result)
+		}
+		body := maps.Clone(payload)
+		body["messages"] = messages
+		return body, nil
+	}
+	if !isObject {
+		if shape == "" {
+			shape = wrapRaw
+		}
+		return nil, shapeError(shape, "a JSON object", result)
+	}
+	return object, nil
+}
+
+// maxSnippetBytes bounds how much of an unexpected result errors quote.
+const maxSnippetBytes = 200
+
+// shapeError reports a transform result that does not have the shape
+// payload_wrap expects, naming both and quoting the start of the result.
+func shapeError(shape, want string, result interface{}) error {
+	quoted, err := json.Marshal(result)
+	if err != nil {
+		quoted = []byte(fmt.Sprint(result))
+	}
+	snippet := string(quoted)
+	if len(snippet) > maxSnippetBytes {
+		snippet = strings.ToValidUTF8(snippet[:maxSnippetBytes], "") + "..."
+	}
+	return fmt.Errorf("payload_wrap %q expects a result of %s, got %s: %s", shape, want, describeJSON(result), snippet)
+}
+
+// describeJSON names the JSON type of v, listing an object's keys.
+func describeJSON(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return "an empty object"
+		}
+		keys := slices.Sorted(maps.Keys(v))
+		return fmt.Sprintf("an object with keys %s", strings.Join(keys, ", "))
+	case []interface{}:
+		return fmt.Sprintf("a list of %d items", len(v))
+	case string:
+		return "a string"
+	case json.Number, float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("a %T", v)
+}
+
+type originalRequestKey struct{}
+
+// withOriginalRequest returns ctx carrying the client's request body as it
+// was before any request transform, for rules with PostIncludeRequest.
+func withOriginalRequest(ctx context.Context, payload map[string]interface{}) context.Context {
+	return context.WithValue(ctx, originalRequestKey{}, payload)
+}
+
+// postParams returns the post-transform params for rule: the wrapped
+// response on its own, or with PostIncludeRequest beside the original
+// request as {"request": ..., "response": ...}.
+func postParams(ctx context.Context, rule TransformRule, payload map[string]interface{}) interface{} {
+	params := wrapPayload(rule.PayloadWrap, payload)
+	if !rule.PostIncludeRequest {
+		return params
+	}
+	request, _ := ctx.Value(originalRequestKey{}).(map[string]interface{})
+	return map[string]interface{}{"request": request, "response": params}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newWrapServer is a transform server that records the raw params it was
+// sent and answers with result.
+func newWrapServer(t *testing.T, result string, params *string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     int             `json:"id"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("transform server: bad request: %v", err)
+			return
+		}
+		*params = string(req.Params)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":` + result + `}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPayloadWrap(t *testing.T) {
+	const body = `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+	for _, tc := range []struct {
+		shape, result, wantParams, wantBody string
+	}{
+		{"", `{"model":"raw"}`, body, `{"model":"raw"}`},
+		{wrapRaw, `{"model":"raw"}`, body, `{"model":"raw"}`},
+		{wrapInput, `{"output":{"model":"wrapped"}}`, `{"input":` + body + `}`, `{"model":"wrapped"}`},
+		{wrapMessages, `{"messages":[{"role":"user","content":"bye"}]}`, `{"messages":[{"role":"user","content":"hi"}]}`,
+			`{"model":"m","messages":[{"role":"user","content":"bye"}]}`},
+		{wrapPositional, `{"model":"listed"}`, `[` + body + `]`, `{"model":"listed"}`},
+	} {
+		t.Run(tc.shape, func(t *testing.T) {
+			var params string
+			pre := newWrapServer(t, tc.result, &params)
+			var forwarded []byte
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded, _ = io.ReadAll(r.Body)
+				w.Write([]byte(`{}`))
+			}))
+			t.Cleanup(upstream.Close)
+			l := newTestLLMSed(upstream.URL, TransformRule{Tag: "wrap", Pre: pre.URL, PayloadWrap: tc.shape})
+
+			rec := httptest.NewRecorder()
+			l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			var sent interface{}
+			if err := json.Unmarshal([]byte(params), &sent); err != nil {
+				t.Fatalf("params %s: %v", params, err)
+			}
+			// The correlation param rides along on object params, and on
+			// the body in positional ones.
+			holder := sent
+			if list, ok := sent.([]interface{}); ok && len(list) > 0 {
+				holder = list[0]
+			}
+			if object, ok := holder.(map[string]interface{}); ok {
+				if _, ok := object[reservedParam]; !ok {
+					t.Errorf("params %s carry no %s", params, reservedParam)
+				}
+				delete(object, reservedParam)
+			}
+			assertJSON(t, sent, tc.wantParams)
+			assertJSON(t, decode(t, string(forwarded)), tc.wantBody)
+		})
+	}
+}
+
+func TestPayloadWrapRejectsMissingEnvelope(t *testing.T) {
+	for _, shape := range []string{wrapInput, wrapMessages} {
+		var params string
+		pre := newWrapServer(t, `{"model":"bare"}`, &params)
+		l := newTestLLMSed(newEchoUpstream(t).URL, TransformRule{Tag: "wrap", Pre: pre.URL, PayloadWrap: shape})
+
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[]}`)))
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("%s: status = %d, want %d: %s", shape, rec.Code, http.StatusInternalServerError, rec.Body)
+		}
+	}
+}
+
+func TestPayloadWrapShapeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		shape, result, want string
+	}{
+		{wrapInput, `{"model":"bare","messages":[]}`, `payload_wrap "input" expects a result of {"output": {...}}, got an object with keys messages, model: {"messages":[],"model":"bare"}`},
+		{wrapMessages, `["a","b"]`, `payload_wrap "messages" expects a result of {"messages": [...]}, got a list of 2 items: ["a","b"]`},
+		{"", `"done"`, `payload_wrap "raw" expects a result of a JSON object, got a string: "done"`},
+	} {
+		var params string
+		pre := newWrapServer(t, tc.result, &params)
+		l := newTestLLMSed(newEchoUpstream(t).URL, TransformRule{Tag: "wrap", Pre: pre.URL, PayloadWrap: tc.shape})
+
+		rec := httptest.NewRecorder()
+		l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[]}`)))
+		if !strings.Contains(rec.Body.String(), tc.want) {
+			t.Errorf("%q: error %q does not contain %q", tc.shape, rec.Body.String(), tc.want)
+		}
+	}
+
+	long := map[string]interface{}{"text": strings.Repeat("é", 300)}
+	if msg := shapeError(wrapInput, "x", long).Error(); !strings.HasSuffix(msg, "...") || len(msg) > maxSnippetBytes+120 {
+		t.Errorf("long result not cut short: %d bytes", len(msg))
+	}
+}
+
+func TestPayloadWrapValidation(t *testing.T) {
+	if err := (Config{Rules: []TransformRule{{PayloadWrap: "envelope"}}}).validate(); err == nil {
+		t.Error("expected validation error for unknown payload_wrap")
+	}
+}
+
+func TestPostIncludeRequest(t *testing.T) {
+	pre, _ := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		p["model"] = "rewritten"
+		return p
+	})
+	var sent map[string]interface{}
+	post, _ := newRPCServer(t, func(p map[string]interface{}) map[string]interface{} {
+		sent = p
+		return map[string]interface{}{"answered_for": p["request"].(map[string]interface{})["model"]}
+	})
+	upstream := newEchoUpstream(t)
+	l := newTestLLMSed(upstream.URL, TransformRule{Tag: "both", Pre: pre.URL, Post: post.URL, PostIncludeRequest: true})
+
+	rec := httptest.NewRecorder()
+	l.handleProxy(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	delete(sent, reservedParam)
+	assertJSON(t, sent, `{"request":{"model":"gpt-4"},"response":{"ok":true}}`)
+	assertJSON(t, decode(t, rec.Body.String()), `{"answered_for":"gpt-4"}`)
+}